@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// effectiveConfig is the configuration piper runs with after all
+// flags have been parsed and defaults applied. It is printed by
+// --print-effective-config.
+type effectiveConfig struct {
+	Output           string              `yaml:"output"`
+	OutputDir        string              `yaml:"output_dir"`
+	Inputs           []string            `yaml:"inputs"`
+	Env              string              `yaml:"env"`
+	Pipeline         string              `yaml:"pipeline"`
+	Team             string              `yaml:"team"`
+	Vars             map[string]string   `yaml:"vars"`
+	WorldGroup       effectiveWorldGroup `yaml:"worldgroup"`
+	GroupPerPipeline bool                `yaml:"group_per_pipeline"`
+	ImageRegistry    string              `yaml:"image_registry"`
+	PinFile          string              `yaml:"pin_file"`
+	NamePrefix       string              `yaml:"name_prefix"`
+	NameFilter       string              `yaml:"name_filter"`
+	NameFilterPrune  bool                `yaml:"name_filter_prune"`
+	Normalize        bool                `yaml:"normalize"`
+	DedupSuffix      bool                `yaml:"dedup_suffix"`
+	StrictInstances  bool                `yaml:"strict_instances"`
+	Base             string              `yaml:"base"`
+	ResourceDefaults string              `yaml:"resource_defaults"`
+	JobDefaults      string              `yaml:"job_defaults"`
+	PreHook          string              `yaml:"pre_hook"`
+	FailFast         bool                `yaml:"fail_fast"`
+	Sequential       bool                `yaml:"sequential"`
+	Incremental      bool                `yaml:"incremental"`
+	MaxFileSize      int64               `yaml:"max_file_size"`
+	MaxInstances     int                 `yaml:"max_instances"`
+	ReadRetries      int                 `yaml:"read_retries"`
+	Indent           int                 `yaml:"indent"`
+	OmitEmpty        bool                `yaml:"omit_empty"`
+	SetPipeline      string              `yaml:"set_pipeline"`
+}
+
+type effectiveWorldGroup struct {
+	Enabled       bool     `yaml:"enabled"`
+	Name          string   `yaml:"name"`
+	ResourceTypes bool     `yaml:"resource_types"`
+	Exclude       []string `yaml:"exclude"`
+}
+
+// writeEffectiveConfig prints the given configuration as YAML.
+func writeEffectiveConfig(w io.Writer, cfg effectiveConfig) error {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
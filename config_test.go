@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestWriteEffectiveConfig(t *testing.T) {
+	cfg := effectiveConfig{
+		Output:   "pipeline.generated.yaml",
+		Inputs:   []string{"shared", "."},
+		Pipeline: "prod",
+		Vars:     map[string]string{"region": "eu", "env": "prod"},
+		WorldGroup: effectiveWorldGroup{
+			Enabled: true,
+			Name:    "all",
+			Exclude: []string{"cleanup"},
+		},
+		MaxInstances: 1000,
+		Indent:       2,
+	}
+	var out bytes.Buffer
+	require.NoError(t, writeEffectiveConfig(&out, cfg))
+	require.Contains(t, out.String(), "inputs:\n- shared\n- .\n")
+	require.Contains(t, out.String(), "vars:\n  env: prod\n  region: eu\n")
+	require.Contains(t, out.String(), "worldgroup:\n  enabled: true\n  name: all\n  resource_types: false\n  exclude:\n  - cleanup\n")
+
+	var parsed effectiveConfig
+	require.NoError(t, yaml.UnmarshalStrict(out.Bytes(), &parsed))
+	require.Equal(t, cfg, parsed)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// flyTarget is the fly target and the name of the pipeline the
+// generated pipeline is set to using --set-pipeline.
+type flyTarget struct {
+	target   string
+	pipeline string
+}
+
+// parseFlyTarget parses a value of the form target/pipeline.
+func parseFlyTarget(value string) (flyTarget, error) {
+	idx := strings.Index(value, "/")
+	if idx <= 0 || idx == len(value)-1 {
+		return flyTarget{}, fmt.Errorf("invalid value %s: expected target/pipeline", value)
+	}
+	return flyTarget{target: value[:idx], pipeline: value[idx+1:]}, nil
+}
+
+// setPipelineArgs returns the arguments fly is called with to set the
+// pipeline to the given config file.
+func (t flyTarget) setPipelineArgs(config string, yes bool) []string {
+	args := []string{"-t", t.target, "set-pipeline", "-p", t.pipeline, "-c", config}
+	if yes {
+		args = append(args, "--non-interactive")
+	}
+	return args
+}
+
+// setPipeline calls the given fly binary to set the pipeline. Without
+// yes fly asks for confirmation, so stdin is passed through. fly's
+// output is written to stdout and stderr.
+func setPipeline(fly string, t flyTarget, config string, yes bool, stdout io.Writer, stderr io.Writer) error {
+	cmd := exec.Command(fly, t.setPipelineArgs(config, yes)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
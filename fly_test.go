@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFlyTarget(t *testing.T) {
+	target, err := parseFlyTarget("ci/my-app")
+	require.NoError(t, err)
+	require.Equal(t, flyTarget{target: "ci", pipeline: "my-app"}, target)
+
+	target, err = parseFlyTarget("ci/team/app")
+	require.NoError(t, err)
+	require.Equal(t, flyTarget{target: "ci", pipeline: "team/app"}, target)
+
+	for _, value := range []string{"", "ci", "/my-app", "ci/"} {
+		_, err := parseFlyTarget(value)
+		require.Error(t, err, value)
+	}
+}
+
+func TestSetPipeline(t *testing.T) {
+	fly := filepath.Join(t.TempDir(), "fly")
+	require.NoError(t, ioutil.WriteFile(fly, []byte("#!/bin/sh\necho \"$@\"\necho failed >&2\nexit 3\n"), 0755))
+	target := flyTarget{target: "ci", pipeline: "my-app"}
+
+	var stdout, stderr bytes.Buffer
+	err := setPipeline(fly, target, "pipeline.generated.yaml", false, &stdout, &stderr)
+	var exitErr *exec.ExitError
+	require.True(t, errors.As(err, &exitErr))
+	require.Equal(t, 3, exitErr.ExitCode())
+	require.Equal(t, "-t ci set-pipeline -p my-app -c pipeline.generated.yaml\n", stdout.String())
+	require.Equal(t, "failed\n", stderr.String())
+
+	stdout.Reset()
+	setPipeline(fly, target, "pipeline.generated.yaml", true, &stdout, &stderr)
+	require.Equal(t, "-t ci set-pipeline -p my-app -c pipeline.generated.yaml --non-interactive\n", stdout.String())
+}
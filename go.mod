@@ -1,6 +1,6 @@
 module github.com/zerok/concourse-piper
 
-go 1.12
+go 1.16
 
 require (
 	github.com/Sirupsen/logrus v1.0.3
@@ -16,4 +16,5 @@ require (
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	gopkg.in/gemnasium/logrus-airbrake-hook.v2 v2.1.2 // indirect
 	gopkg.in/yaml.v2 v2.2.1
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -1,371 +1,1046 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
 	"strings"
 	"sync"
-	"text/template"
+	"text/tabwriter"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/spf13/afero"
 	"github.com/spf13/pflag"
+	"github.com/zerok/concourse-piper/pkg/piper"
 	yaml "gopkg.in/yaml.v2"
 )
 
 var version, commit, date string
 
-func findHeader(data []byte) ([]byte, error) {
-	idx := bytes.Index(data, []byte("data:\n"))
-	if idx == -1 {
-		return nil, fmt.Errorf("could not find header")
-	}
-	return data[0 : idx-1], nil
-}
+// Exit codes piper terminates with so that scripts can tell the
+// different classes of failures apart.
+const (
+	exitUsage      = 1
+	exitGeneration = 2
+	exitValidation = 3
+	exitOutput     = 4
+	exitWarning    = 5
+	exitFly        = 6
+)
 
 func main() {
 	var output string
+	var outputDir string
 	var verbose bool
+	var failOnWarning bool
+	var printContext bool
 	var worldGroupName string
 	var wantWorldGroup bool
 	var selectedPipeline string
+	var selectedTeam string
+	var env string
+	var vars []string
 	var showVersion bool
+	var runSelfTest bool
+	var maxFileSize int64
+	var maxInstances int
+	var readRetries int
+	var preHook string
+	var mermaidOutput string
+	var provenanceOutput string
+	var watch bool
+	var watchInterval time.Duration
+	var onChange string
+	var inputs []string
+	var fromStdin bool
+	var cpuProfile string
+	var memProfile string
+	var failFast bool
+	var sequential bool
+	var incremental bool
+	var check bool
+	var summary bool
+	var strictKeys bool
+	var noConcourseVars bool
+	var concourseVersion string
+	var outputPerms string
+	var outputUID int
+	var outputGID int
+	var worldGroupResourceTypes bool
+	var worldGroupExclude []string
+	var groupPerPipeline bool
+	var imageRegistry string
+	var namePrefix string
+	var nameFilter string
+	var pruneNameFilter bool
+	var normalize bool
+	var dedupSuffix bool
+	var strictInstances bool
+	var basePath string
+	var resourceDefaultsPath string
+	var jobDefaultsPath string
+	var pinFile string
+	var omitEmpty bool
+	var indent int
+	var listOrphans bool
+	var countOnly bool
+	var dumpPartials bool
+	var setPipelineTarget string
+	var yes bool
+	var printEffectiveConfig bool
+	var changedFiles []string
+	var outputTemplate string
+	var annotationsPath string
 	pflag.StringVar(&output, "output", "pipeline.generated.yaml", "Path to an output file for the generated pipeline")
+	pflag.StringArrayVar(&inputs, "input", []string{"."}, "Folder containing the templates (can be specified multiple times, later folders override earlier ones)")
+	pflag.StringVar(&outputPerms, "output-perms", "0644", "Permissions (octal) of the generated output files")
+	pflag.IntVar(&outputUID, "output-uid", -1, "User id the generated output files are owned by (ignored on Windows)")
+	pflag.IntVar(&outputGID, "output-gid", -1, "Group id the generated output files are owned by (ignored on Windows)")
+	pflag.BoolVar(&omitEmpty, "omit-empty", false, "Leave categories without any entries out of the output")
+	pflag.IntVar(&indent, "indent", 2, "Number of spaces per indentation level of the generated output (2-9)")
+	pflag.StringVar(&annotationsPath, "annotations", "", "Path to a YAML file mapping names of entries to comments added above them in the output")
+	pflag.StringVar(&outputTemplate, "output-template", "", "Path to a template the generated pipeline is wrapped with before writing it")
+	pflag.StringVar(&outputDir, "output-dir", "", "Path to a folder where each category is written to a separate file")
 	pflag.BoolVar(&wantWorldGroup, "worldgroup", false, "Generate a group containing all resources and jobs")
-	pflag.StringVar(&worldGroupName, "worldgroup-name", "WORLD", "Name of the group that contains all jobs and resources")
+	pflag.StringVar(&worldGroupName, "worldgroup-name", piper.DefaultWorldGroupName, "Name of the group that contains all jobs and resources")
+	pflag.BoolVar(&worldGroupResourceTypes, "worldgroup-resource-types", false, "Include all resource types in the world group")
+	pflag.StringArrayVar(&worldGroupExclude, "worldgroup-exclude", nil, "Name of a job, resource, or resource type that should not be part of the world group (can be specified multiple times)")
+	pflag.BoolVar(&groupPerPipeline, "group-per-pipeline", false, "Generate a group for the selected pipeline containing its jobs and resources")
+	pflag.StringVar(&imageRegistry, "image-registry", "", "Registry host to prepend to the image repository of every resource type")
+	pflag.StringVar(&pinFile, "pin-file", "", "Path to a YAML file mapping names of resource types to the tag and/or digest their image is pinned to")
+	pflag.StringVar(&namePrefix, "name-prefix", "", "Prefix to prepend to the name of every generated job, resource, resource type, and group")
+	pflag.StringVar(&nameFilter, "name-filter", "", "Glob pattern the names of all generated jobs, resources, resource types, groups, and var sources have to match to be kept")
+	pflag.BoolVar(&pruneNameFilter, "name-filter-prune", false, "Also remove references to entries dropped by --name-filter")
+	pflag.BoolVar(&normalize, "normalize", false, "Canonicalize the values of well-known fields like serial or passed")
+	pflag.BoolVar(&dedupSuffix, "dedup-suffix", false, "Append -2, -3, etc. to the names of entries colliding with an earlier entry instead of keeping duplicates")
+	pflag.BoolVar(&strictInstances, "strict-instances", false, "Fail if the name_template of a template with multiple instances renders the same name for different instances")
+	pflag.StringVar(&basePath, "base", "", "Path to an existing pipeline the generated jobs, resources, etc. are added to")
+	pflag.StringVar(&resourceDefaultsPath, "resource-defaults", "", "Path to a YAML file with keys added to every generated resource not setting them itself")
+	pflag.StringVar(&jobDefaultsPath, "job-defaults", "", "Path to a YAML file with keys added to every generated job not setting them itself")
+	pflag.StringVar(&preHook, "pre-hook", "", "Shell command every template file is piped through before it is processed")
 	pflag.BoolVar(&verbose, "verbose", false, "Verbose logging")
+	pflag.BoolVar(&failOnWarning, "fail-on-warning", false, "Exit with a non-zero status code if any warning was logged")
+	pflag.BoolVar(&printContext, "print-context", false, "Log the context every instance is rendered with (requires --verbose)")
 	pflag.StringVar(&selectedPipeline, "pipeline", "", "Specify the name of the pipeline you want to generate")
+	pflag.StringVar(&env, "env", "", "Name of an environment whose category folders (e.g. jobs.<env>) override templates of the same name")
+	pflag.StringArrayVar(&vars, "var", nil, "Variable in the form name=value made available to all templates as .Vars (can be specified multiple times)")
+	pflag.StringVar(&selectedTeam, "team", "", "Only include templates owned by the given team")
+	pflag.BoolVar(&printEffectiveConfig, "print-effective-config", false, "Print the configuration piper would run with as YAML and exit")
 	pflag.BoolVar(&showVersion, "version", false, "Show version information")
-	pflag.Parse()
+	pflag.BoolVar(&runSelfTest, "self-test", false, "Generate the pipeline of a built-in example, print it, and fail if it differs from the expected result")
+	pflag.BoolVar(&fromStdin, "stdin", false, "Render a single template read from stdin and print the result to stdout")
+	pflag.StringVar(&mermaidOutput, "mermaid", "", "Path to an output file for a Mermaid flowchart of the pipeline")
+	pflag.StringVar(&provenanceOutput, "provenance-file", "", "Path to a JSON file listing the template every generated entry originates from")
+	pflag.BoolVar(&failFast, "fail-fast", false, "Stop loading all categories as soon as one of them fails")
+	pflag.BoolVar(&sequential, "sequential", false, "Load the categories one after another instead of concurrently, e.g. for easier to follow logs")
+	pflag.StringVar(&setPipelineTarget, "set-pipeline", "", "Set the generated pipeline using fly in the form target/pipeline")
+	pflag.BoolVar(&yes, "yes", false, "Don't ask for confirmation before setting the pipeline using --set-pipeline")
+	pflag.BoolVar(&check, "check", false, "Only build and validate the pipeline without writing any output")
+	pflag.BoolVar(&summary, "summary", false, "Only print which entries would be added, removed, or modified compared to the existing --output file")
+	pflag.StringVar(&concourseVersion, "concourse-version", "", "Warn about features of the generated pipeline the given Concourse version (X.Y.Z) doesn't support")
+	pflag.BoolVar(&noConcourseVars, "no-concourse-vars", false, "Fail if the generated output still contains Concourse ((var)) placeholders")
+	pflag.BoolVar(&strictKeys, "strict-keys", false, "Fail if a generated job, resource, resource type, or group contains a key unknown to Concourse")
+	pflag.BoolVar(&listOrphans, "list-orphans", false, "List templates that are the only ones being part of one of their pipelines or not part of the selected pipeline and exit")
+	pflag.BoolVar(&countOnly, "count-only", false, "Print the number of entries per category of every pipeline without rendering any template and exit")
+	pflag.BoolVar(&dumpPartials, "dump-partials", false, "List the names of all loaded partials and the files they come from and exit")
+	pflag.StringSliceVar(&changedFiles, "changed-files", nil, "Files changed e.g. by a commit (separated by commas or whitespace); the pipeline entries generated from them are printed")
+	pflag.BoolVar(&watch, "watch", false, "Keep running and regenerate the pipeline whenever a file within the --input folders changes")
+	pflag.DurationVar(&watchInterval, "watch-interval", time.Second, "How often the --input folders are checked for changes in --watch mode")
+	pflag.StringVar(&onChange, "on-change", "", "Shell command executed after every successful regeneration in --watch mode")
+	pflag.BoolVar(&incremental, "incremental", false, "Only render templates that changed since the last run (tracked in a cache file next to the output)")
+	pflag.StringVar(&cpuProfile, "cpuprofile", "", "Write a CPU profile of the pipeline generation to the given file")
+	pflag.StringVar(&memProfile, "memprofile", "", "Write a memory profile after the pipeline generation to the given file")
+	pflag.IntVar(&maxInstances, "max-instances", 1000, "Maximum number of instances per template and of entries in the whole pipeline (0 disables the limit)")
+	pflag.IntVar(&readRetries, "read-retries", 0, "Number of times reading a template file is retried after a transient error")
+	pflag.Int64Var(&maxFileSize, "max-file-size", 4*1024*1024, "Maximum size in bytes of a template file (0 disables the limit)")
+	pflag.CommandLine.Init(os.Args[0], pflag.ContinueOnError)
+	if err := pflag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if err == pflag.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(exitUsage)
+	}
 	log := logrus.New()
 	if verbose {
 		log.SetLevel(logrus.DebugLevel)
 	}
+	// warnings stays nil unless --fail-on-warning is set. Modes
+	// without side effects are only checked once they are done.
+	var warnings *warningCounter
+	if failOnWarning {
+		warnings = &warningCounter{}
+		log.Hooks.Add(warnings)
+		defer checkWarnings(log, warnings)
+	}
 	if showVersion {
 		fmt.Printf("Version: %s\nCommit: %s\nDate: %s\n", version, commit, date)
 		os.Exit(0)
 	}
+	if runSelfTest {
+		if e := selfTest(log, os.Stdout); e != nil {
+			fail(log, exitGeneration, e, "Self-test failed")
+		}
+		log.Info("Self-test passed")
+		return
+	}
+	if outputDir != "" && pflag.CommandLine.Changed("output") {
+		fail(log, exitUsage, nil, "--output and --output-dir are mutually exclusive")
+	}
+	if outputDir != "" && summary {
+		fail(log, exitUsage, nil, "--summary and --output-dir are mutually exclusive")
+	}
+	if outputDir != "" && outputTemplate != "" {
+		fail(log, exitUsage, nil, "--output-template and --output-dir are mutually exclusive")
+	}
+	if onChange != "" && !watch {
+		fail(log, exitUsage, nil, "--on-change requires --watch")
+	}
+	if watch && (check || summary) {
+		fail(log, exitUsage, nil, "--watch can't be combined with --check or --summary")
+	}
+	if indent < 2 || indent > 9 {
+		fail(log, exitUsage, nil, "--indent must be between 2 and 9")
+	}
+	if yes && setPipelineTarget == "" {
+		fail(log, exitUsage, nil, "--yes requires --set-pipeline")
+	}
+	var fly string
+	var pipelineTarget flyTarget
+	if setPipelineTarget != "" {
+		if outputDir != "" || check || summary || watch {
+			fail(log, exitUsage, nil, "--set-pipeline can't be combined with --output-dir, --check, --summary, or --watch")
+		}
+		var e error
+		if pipelineTarget, e = parseFlyTarget(setPipelineTarget); e != nil {
+			fail(log, exitUsage, e, "Invalid --set-pipeline")
+		}
+		if fly, e = exec.LookPath("fly"); e != nil {
+			fail(log, exitUsage, e, "--set-pipeline requires fly to be on your PATH")
+		}
+	}
+	perm, err := parseFileMode(outputPerms)
+	if err != nil {
+		fail(log, exitUsage, err, "Invalid --output-perms")
+	}
+	owner := fileOwner{uid: outputUID, gid: outputGID}
+	var targetVersion piper.ConcourseVersion
+	if concourseVersion != "" {
+		if targetVersion, err = piper.ParseConcourseVersion(concourseVersion); err != nil {
+			fail(log, exitUsage, err, "Invalid --concourse-version")
+		}
+	}
+	parsedVars, err := parseVars(vars)
+	if err != nil {
+		fail(log, exitUsage, err, "Invalid --var")
+	}
 
 	ctx := context.Background()
-	fs := afero.NewOsFs()
+	opts := piper.Options{
+		Fs:                      afero.NewOsFs(),
+		Folders:                 inputs,
+		Pipeline:                selectedPipeline,
+		Team:                    selectedTeam,
+		Env:                     env,
+		Vars:                    parsedVars,
+		WorldGroup:              wantWorldGroup,
+		WorldGroupName:          worldGroupName,
+		WorldGroupResourceTypes: worldGroupResourceTypes,
+		WorldGroupExclude:       worldGroupExclude,
+		GroupPerPipeline:        groupPerPipeline,
+		ImageRegistry:           imageRegistry,
+		NamePrefix:              namePrefix,
+		NameFilter:              nameFilter,
+		PruneNameFilter:         pruneNameFilter,
+		Normalize:               normalize,
+		PrintContext:            printContext,
+		DedupNames:              dedupSuffix,
+		StrictInstances:         strictInstances,
+		FailFast:                failFast,
+		Sequential:              sequential,
+		MaxFileSize:             maxFileSize,
+		MaxInstances:            maxInstances,
+		ReadRetries:             readRetries,
+		PreHook:                 preHook,
+		Log:                     log,
+	}
 
-	p, err := buildPipeline(ctx, selectedPipeline, fs, ".", wantWorldGroup, worldGroupName, log)
-	if err != nil {
-		log.WithError(err).Fatal("Failed to build pipeline")
+	marshalOpts := piper.MarshalOptions{
+		OmitEmpty: omitEmpty,
+		Indent:    indent,
 	}
 
-	if e := savePipeline(output, p); e != nil {
-		log.WithError(e).Fatalf("Failed to write to %s: %s", output, e.Error())
+	if printEffectiveConfig {
+		cfg := effectiveConfig{
+			Output:    output,
+			OutputDir: outputDir,
+			Inputs:    inputs,
+			Env:       env,
+			Pipeline:  selectedPipeline,
+			Team:      selectedTeam,
+			Vars:      parsedVars,
+			WorldGroup: effectiveWorldGroup{
+				Enabled:       wantWorldGroup,
+				Name:          worldGroupName,
+				ResourceTypes: worldGroupResourceTypes,
+				Exclude:       worldGroupExclude,
+			},
+			GroupPerPipeline: groupPerPipeline,
+			ImageRegistry:    imageRegistry,
+			PinFile:          pinFile,
+			NamePrefix:       namePrefix,
+			NameFilter:       nameFilter,
+			NameFilterPrune:  pruneNameFilter,
+			Normalize:        normalize,
+			DedupSuffix:      dedupSuffix,
+			StrictInstances:  strictInstances,
+			Base:             basePath,
+			ResourceDefaults: resourceDefaultsPath,
+			JobDefaults:      jobDefaultsPath,
+			PreHook:          preHook,
+			FailFast:         failFast,
+			Sequential:       sequential,
+			Incremental:      incremental,
+			MaxFileSize:      maxFileSize,
+			MaxInstances:     maxInstances,
+			ReadRetries:      readRetries,
+			Indent:           indent,
+			OmitEmpty:        omitEmpty,
+			SetPipeline:      setPipelineTarget,
+		}
+		if e := writeEffectiveConfig(os.Stdout, cfg); e != nil {
+			fail(log, exitOutput, e, "Failed to write the effective configuration")
+		}
+		return
 	}
 
-	displayPipelineStats(log, p)
-}
+	if fromStdin {
+		if e := renderStdin(opts); e != nil {
+			fail(log, exitGeneration, e, "Failed to render template from stdin")
+		}
+		return
+	}
 
-func buildPipeline(ctx context.Context, selectedPipeline string, fs afero.Fs, folder string, wantWorldGroup bool, worldGroupName string, log *logrus.Logger) (*Pipeline, error) {
-	p := Pipeline{}
+	if listOrphans {
+		orphans, err := piper.FindOrphans(opts)
+		if err != nil {
+			fail(log, exitGeneration, err, "Failed to find orphaned templates")
+		}
+		for _, orphan := range orphans {
+			switch {
+			case !orphan.Unselected:
+				fmt.Printf("%s: no other template is part of pipeline %s\n", orphan.Path, orphan.Pipeline)
+			case orphan.Pipeline == "":
+				fmt.Printf("%s: not part of the default pipeline\n", orphan.Path)
+			default:
+				fmt.Printf("%s: not part of the selected pipeline %s\n", orphan.Path, orphan.Pipeline)
+			}
+		}
+		return
+	}
 
-	partials, err := loadPartials(fs, filepath.Join(folder, "partials"))
-	if err != nil {
-		return nil, fmt.Errorf("could not parse partial templates: %s", err.Error())
-	}
-
-	wg := sync.WaitGroup{}
-	errorWg := sync.WaitGroup{}
-	errorWg.Add(1)
-	wg.Add(4)
-	cancelContext, cancel := context.WithCancel(ctx)
-	defer cancel()
-	errChan := make(chan error, 4)
-	go func() {
-		defer errorWg.Done()
-		for {
-			select {
-			case <-cancelContext.Done():
-				return
-			case e := <-errChan:
-				fmt.Println(e)
-				err = e
-				cancel()
-				return
+	if countOnly {
+		counts, err := piper.CountInstances(opts)
+		if err != nil {
+			fail(log, exitGeneration, err, "Failed to count instances")
+		}
+		if e := writeCounts(os.Stdout, counts); e != nil {
+			fail(log, exitOutput, e, "Failed to write counts")
+		}
+		return
+	}
+
+	if dumpPartials {
+		partials, err := piper.ListPartials(opts)
+		if err != nil {
+			fail(log, exitGeneration, err, "Failed to load partials")
+		}
+		if e := writePartials(os.Stdout, partials); e != nil {
+			fail(log, exitOutput, e, "Failed to write partials")
+		}
+		return
+	}
+
+	// loadFiles reads all files passed next to the --input folders.
+	// It is called before every generation so that changes to them are
+	// picked up in --watch mode.
+	loadFiles := func() error {
+		if annotationsPath != "" {
+			annotations, err := piper.LoadAnnotations(opts.Fs, annotationsPath)
+			if err != nil {
+				return &exitError{exitUsage, fmt.Errorf("failed to load annotations from %s: %w", annotationsPath, err)}
+			}
+			marshalOpts.Annotations = annotations
+		}
+		if outputTemplate != "" {
+			tmpl, err := piper.LoadOutputTemplate(opts, outputTemplate)
+			if err != nil {
+				return &exitError{exitUsage, fmt.Errorf("failed to load output template from %s: %w", outputTemplate, err)}
+			}
+			marshalOpts.Template = tmpl
+		}
+		if pinFile != "" {
+			pins, err := piper.LoadPins(opts.Fs, pinFile)
+			if err != nil {
+				return &exitError{exitUsage, fmt.Errorf("failed to load pins from %s: %w", pinFile, err)}
+			}
+			opts.Pins = pins
+		}
+		if resourceDefaultsPath != "" {
+			defaults, err := piper.LoadDefaults(opts.Fs, resourceDefaultsPath)
+			if err != nil {
+				return &exitError{exitUsage, fmt.Errorf("failed to load resource defaults from %s: %w", resourceDefaultsPath, err)}
 			}
+			opts.ResourceDefaults = defaults
 		}
-	}()
+		if jobDefaultsPath != "" {
+			defaults, err := piper.LoadDefaults(opts.Fs, jobDefaultsPath)
+			if err != nil {
+				return &exitError{exitUsage, fmt.Errorf("failed to load job defaults from %s: %w", jobDefaultsPath, err)}
+			}
+			opts.JobDefaults = defaults
+		}
+		if basePath != "" {
+			base, err := piper.LoadPipeline(opts.Fs, basePath)
+			if err != nil {
+				return &exitError{exitGeneration, fmt.Errorf("failed to load base pipeline from %s: %w", basePath, err)}
+			}
+			opts.Base = base
+		}
+		return nil
+	}
 
-	go func() {
-		defer wg.Done()
-		resources, e := loadResources(cancelContext, fs, filepath.Join(folder, "resources"), selectedPipeline, partials, log)
-		if e != nil {
-			errChan <- fmt.Errorf("failed to load resources: %s", e.Error())
-			return
+	// checkPipeline runs all checks requested for the generated
+	// pipeline apart from --check.
+	checkPipeline := func(p *piper.Pipeline) error {
+		if pflag.CommandLine.Changed("changed-files") {
+			printAffectedEntries(log, piper.AffectedEntries(opts, p, splitFileList(changedFiles)))
 		}
-		p.Resources = resources
-	}()
+		if concourseVersion != "" {
+			if e := piper.CheckConcourseVersion(p, targetVersion); e != nil {
+				reportWarnings(log, e)
+			}
+		}
+		if strictKeys {
+			if e := piper.ValidateKeys(p); e != nil {
+				reportErrors(log, e)
+				return &exitError{exitValidation, errors.New("pipeline contains unknown keys")}
+			}
+		}
+		if noConcourseVars {
+			unresolved, err := findConcourseVars(p, output, outputDir, marshalOpts)
+			if err != nil {
+				return &exitError{exitOutput, fmt.Errorf("failed to render pipeline: %w", err)}
+			}
+			if len(unresolved) > 0 {
+				for _, msg := range unresolved {
+					log.Error(msg)
+				}
+				return &exitError{exitValidation, fmt.Errorf("pipeline contains %d Concourse var placeholder(s)", len(unresolved))}
+			}
+		}
+		return nil
+	}
 
-	go func() {
-		defer wg.Done()
-		resources, e := loadResources(cancelContext, fs, filepath.Join(folder, "jobs"), selectedPipeline, partials, log)
-		if e != nil {
-			errChan <- fmt.Errorf("failed to load jobs: %s", e.Error())
-			return
+	cachePath := output + ".cache"
+	if outputDir != "" {
+		cachePath = filepath.Join(outputDir, ".piper-cache.yaml")
+	}
+	if incremental && !check {
+		cache, err := piper.LoadCache(opts.Fs, cachePath)
+		if err != nil {
+			fail(log, exitOutput, err, "Failed to load cache from %s", cachePath)
 		}
-		p.Jobs = resources
-	}()
+		opts.Cache = cache
+	}
 
-	go func() {
-		defer wg.Done()
-		resources, e := loadResources(cancelContext, fs, filepath.Join(folder, "resource_types"), selectedPipeline, partials, log)
-		if e != nil {
-			errChan <- fmt.Errorf("failed to load resource_types: %s", e.Error())
-			return
+	target := output
+	if outputDir != "" {
+		target = outputDir
+	}
+	// writeOutputs writes the generated pipeline together with
+	// everything derived from it.
+	writeOutputs := func(p *piper.Pipeline) error {
+		var err error
+		if outputDir != "" {
+			err = savePipelineDir(outputDir, p, perm, owner, marshalOpts)
+		} else {
+			err = savePipeline(output, p, perm, owner, marshalOpts)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write to %s: %w", target, err)
+		}
+		if opts.Cache != nil {
+			if err := opts.Cache.Save(opts.Fs, cachePath); err != nil {
+				return fmt.Errorf("failed to write to %s: %w", cachePath, err)
+			}
 		}
-		p.ResourceTypes = resources
-	}()
+		if mermaidOutput != "" {
+			if err := saveMermaid(mermaidOutput, p, perm, owner); err != nil {
+				return fmt.Errorf("failed to write to %s: %w", mermaidOutput, err)
+			}
+		}
+		if provenanceOutput != "" {
+			if err := saveProvenance(provenanceOutput, p, perm, owner); err != nil {
+				return fmt.Errorf("failed to write to %s: %w", provenanceOutput, err)
+			}
+		}
+		return nil
+	}
 
-	go func() {
-		defer wg.Done()
-		resources, e := loadResources(cancelContext, fs, filepath.Join(folder, "groups"), selectedPipeline, partials, log)
-		if e != nil {
-			errChan <- fmt.Errorf("failed to load groups: %s", e.Error())
-			return
+	if watch {
+		regenerate := func() error {
+			warnings.Reset()
+			if err := loadFiles(); err != nil {
+				return err
+			}
+			p, err := piper.Build(ctx, opts)
+			if err != nil {
+				return err
+			}
+			if err := checkPipeline(p); err != nil {
+				return err
+			}
+			if err := warnings.Err(); err != nil {
+				return err
+			}
+			if err := writeOutputs(p); err != nil {
+				return err
+			}
+			log.Infof("Pipeline written to %s", target)
+			return nil
 		}
-		p.Groups = resources
-	}()
+		ignore := []string{target, cachePath}
+		for _, path := range []string{mermaidOutput, provenanceOutput} {
+			if path != "" {
+				ignore = append(ignore, path)
+			}
+		}
+		var files []string
+		for _, path := range []string{annotationsPath, outputTemplate, pinFile, resourceDefaultsPath, jobDefaultsPath, basePath} {
+			if path != "" {
+				files = append(files, path)
+			}
+		}
+		if e := watchInputs(log, opts.Fs, inputs, files, ignore, watchInterval, nil, regenerate, func() { runOnChange(log, onChange, target) }); e != nil {
+			fail(log, exitGeneration, e, "Failed to watch for changes")
+		}
+		return
+	}
+
+	if e := loadFiles(); e != nil {
+		fail(log, exitCode(e), e, "Failed to load input files")
+	}
+	stopCPUProfile, err := startCPUProfile(cpuProfile)
+	if err != nil {
+		fail(log, exitOutput, err, "Failed to start CPU profiling")
+	}
+	p, err := piper.Build(ctx, opts)
+	stopCPUProfile()
+	if err != nil {
+		fail(log, exitGeneration, err, "Failed to build pipeline")
+	}
+	if e := writeMemProfile(memProfile); e != nil {
+		fail(log, exitOutput, e, "Failed to write memory profile")
+	}
+
+	if e := checkPipeline(p); e != nil {
+		fail(log, exitCode(e), e, "Pipeline failed the requested checks")
+	}
+
+	if check {
+		if e := piper.Validate(p); e != nil {
+			reportErrors(log, e)
+			fail(log, exitValidation, nil, "Pipeline is invalid")
+		}
+		log.Info("Pipeline is valid")
+		return
+	}
 
-	wg.Wait()
-	cancel()
-	errorWg.Wait()
+	// Fail before anything is written or sent to fly.
+	checkWarnings(log, warnings)
 
-	if wantWorldGroup {
-		worldGroup := generateWorldGroup(worldGroupName, &p)
-		p.Groups = append([]Resource{worldGroup}, p.Groups...)
+	if summary {
+		current := &piper.Pipeline{}
+		if _, e := os.Stat(output); e == nil {
+			if current, err = piper.LoadPipeline(opts.Fs, output); err != nil {
+				fail(log, exitOutput, err, "Failed to load the existing pipeline")
+			}
+		}
+		changes, err := piper.Diff(current, p)
+		if err != nil {
+			fail(log, exitOutput, err, "Failed to compare pipelines")
+		}
+		writeSummary(os.Stdout, changes)
+		return
 	}
 
-	return &p, err
+	if e := writeOutputs(p); e != nil {
+		fail(log, exitOutput, e, "Failed to write the pipeline")
+	}
+
+	displayPipelineStats(log, p)
+
+	if setPipelineTarget != "" {
+		if e := setPipeline(fly, pipelineTarget, output, yes, os.Stdout, os.Stderr); e != nil {
+			var exitErr *exec.ExitError
+			if errors.As(e, &exitErr) {
+				fail(log, exitFly, nil, "fly set-pipeline failed with exit code %d", exitErr.ExitCode())
+			}
+			fail(log, exitFly, e, "Failed to run fly set-pipeline")
+		}
+	}
 }
 
-func savePipeline(f string, p *Pipeline) error {
-	out, err := yaml.Marshal(p)
+// fail logs the given message together with err (if not nil) and
+// terminates piper with the given exit code.
+func fail(log *logrus.Logger, code int, err error, format string, args ...interface{}) {
+	entry := logrus.NewEntry(log)
 	if err != nil {
-		return err
+		entry = entry.WithError(err)
 	}
-	return ioutil.WriteFile(f, out, 0644)
+	entry.Errorf(format, args...)
+	os.Exit(code)
 }
 
-func displayPipelineStats(log *logrus.Logger, p *Pipeline) {
-	log.Infof("Generated jobs (%d):", len(p.Jobs))
-	for _, r := range p.Jobs {
-		log.Infof(" - %s", r)
+// exitError is an error piper terminates with the given exit code on.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// exitCode returns the exit code carried by err, falling back to the
+// one of generation failures.
+func exitCode(err error) int {
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
 	}
-	log.Infof("Generated resource_types (%d):", len(p.ResourceTypes))
-	for _, r := range p.ResourceTypes {
-		log.Infof(" - %s", r)
+	return exitGeneration
+}
+
+// warningCounter is a logrus hook counting all warnings logged.
+type warningCounter struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (c *warningCounter) Levels() []logrus.Level {
+	return []logrus.Level{logrus.WarnLevel}
+}
+
+func (c *warningCounter) Fire(entry *logrus.Entry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count++
+	return nil
+}
+
+// Count returns the number of warnings logged so far.
+func (c *warningCounter) Count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.count
+}
+
+// Reset sets the number of warnings back to zero. It does nothing if
+// c is nil.
+func (c *warningCounter) Reset() {
+	if c == nil {
+		return
 	}
-	log.Infof("Generated resources (%d):", len(p.Resources))
-	for _, r := range p.Resources {
-		log.Infof(" - %s", r)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count = 0
+}
+
+// Err returns an error if any warning was logged. It returns nil if c
+// is nil.
+func (c *warningCounter) Err() error {
+	if c == nil {
+		return nil
 	}
-	log.Infof("Generated groups (%d):", len(p.Groups))
-	for _, r := range p.Groups {
-		log.Infof(" - %s", r)
+	if n := c.Count(); n > 0 {
+		return fmt.Errorf("%d warning(s) were logged", n)
 	}
+	return nil
 }
 
-func generateWorldGroup(name string, p *Pipeline) Resource {
-	r := Resource{}
-	jobNames := make([]string, 0, len(p.Jobs))
-	for _, j := range p.Jobs {
-		jobNames = append(jobNames, j["name"].(string))
+// checkWarnings terminates piper if any warning was counted by
+// warnings.
+func checkWarnings(log *logrus.Logger, warnings *warningCounter) {
+	if e := warnings.Err(); e != nil {
+		fail(log, exitWarning, nil, "%s", e)
 	}
-	resourceNames := make([]string, 0, len(p.Resources))
-	for _, r := range p.Resources {
-		resourceNames = append(resourceNames, r["name"].(string))
-	}
-	r["name"] = name
-	r["jobs"] = jobNames
-	r["resources"] = resourceNames
-	return r
 }
 
-func indent(data string, offset int) string {
-	lines := make([]string, 0, 5)
-	for idx, line := range strings.Split(data, "\n") {
-		if idx == 0 {
-			lines = append(lines, line)
-			continue
-		}
-		lines = append(lines, fmt.Sprintf("%s%s", strings.Repeat(" ", offset), line))
+// reportErrors logs every error combined within err separately.
+func reportErrors(log *logrus.Logger, err error) {
+	var errs piper.Errors
+	if !errors.As(err, &errs) {
+		log.Error(err)
+		return
+	}
+	for _, e := range errs {
+		log.Error(e)
 	}
-	return strings.Join(lines, "\n")
 }
 
-func ite(condition bool, trueValue interface{}, falseValue interface{}) interface{} {
-	if condition {
-		return trueValue
+// reportWarnings logs err as warning. If err is a piper.Errors, every
+// contained error is logged separately.
+func reportWarnings(log *logrus.Logger, err error) {
+	var errs piper.Errors
+	if !errors.As(err, &errs) {
+		log.Warn(err)
+		return
+	}
+	for _, e := range errs {
+		log.Warn(e)
 	}
-	return falseValue
 }
 
-func loadResources(ctx context.Context, fs afero.Fs, path string, pipeline string, partials *template.Template, log *logrus.Logger) ([]Resource, error) {
-	resources := make([]Resource, 0, 10)
-	if e := afero.Walk(fs, path, func(p string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-		}
-		if !strings.HasSuffix(p, ".yml") && !strings.HasSuffix(p, ".yaml") {
-			return nil
-		}
-		log.Infof("Processing %s", p)
-		var rc ResourceConfigHeader
-		data, err := afero.ReadFile(fs, p)
-		if err != nil {
-			return err
+// writeCounts prints the given counts as table.
+func writeCounts(w io.Writer, counts []piper.PipelineCount) error {
+	categories := []string{"jobs", "resources", "resource_types", "groups", "var_sources"}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "PIPELINE\t%s\n", strings.ToUpper(strings.Join(categories, "\t")))
+	for _, c := range counts {
+		name := c.Pipeline
+		if name == "" {
+			name = "(default)"
 		}
-		if err := parseHeader(&rc, data); err != nil {
-			return fmt.Errorf("failed to parse header of %s: %s", p, err.Error())
+		fmt.Fprint(tw, name)
+		for _, category := range categories {
+			fmt.Fprintf(tw, "\t%d", c.Counts[category])
 		}
-		if !rc.isRelevantForPipeline(pipeline) {
-			return nil
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// writePartials prints every name a partial is available under next
+// to the file it is loaded from.
+func writePartials(w io.Writer, partials []piper.PartialInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tKIND\tPATH")
+	for _, p := range partials {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", p.Name, p.Kind, p.Path)
+	}
+	return tw.Flush()
+}
+
+// writeSummary prints every change followed by the number of changes
+// per category.
+func writeSummary(w io.Writer, changes []piper.Change) {
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "No changes")
+		return
+	}
+	markers := map[string]string{piper.ChangeAdded: "+", piper.ChangeRemoved: "-", piper.ChangeModified: "~"}
+	counts := make(map[string]map[string]int)
+	var categories []string
+	for _, c := range changes {
+		fmt.Fprintf(w, "%s %s %s\n", markers[c.Kind], c.Category, c.Name)
+		if counts[c.Category] == nil {
+			counts[c.Category] = make(map[string]int)
+			categories = append(categories, c.Category)
 		}
-		for _, instance := range rc.Meta.AllInstances() {
-			var instanceRC ResourceConfig
-			if err := generateInstance(&instanceRC, instance, p, data, rc, pipeline, partials, log); err != nil {
-				return fmt.Errorf("failed to generate instance %s: %s", instance, err.Error())
+		counts[c.Category][c.Kind]++
+	}
+	summaries := make([]string, 0, len(categories))
+	for _, category := range categories {
+		var parts []string
+		for _, kind := range []string{piper.ChangeAdded, piper.ChangeRemoved, piper.ChangeModified} {
+			if n := counts[category][kind]; n > 0 {
+				parts = append(parts, fmt.Sprintf("%d %s", n, kind))
 			}
-			resources = append(resources, convertToResource(instanceRC, rc.Meta.Singleton()))
 		}
+		summaries = append(summaries, fmt.Sprintf("%s: %s", category, strings.Join(parts, ", ")))
+	}
+	fmt.Fprintln(w, strings.Join(summaries, "; "))
+}
+
+// splitFileList splits every element of files at whitespace so that
+// lists like the output of `git diff --name-only` can be passed as a
+// single value.
+func splitFileList(files []string) []string {
+	var result []string
+	for _, f := range files {
+		result = append(result, strings.Fields(f)...)
+	}
+	return result
+}
+
+// printAffectedEntries prints the given entries to stdout.
+func printAffectedEntries(log *logrus.Logger, affected []piper.Origin) {
+	if len(affected) == 0 {
+		log.Info("The changed files don't affect any entry of the pipeline")
+		return
+	}
+	for _, origin := range affected {
+		fmt.Printf("%s %s (generated from %s)\n", origin.Category, origin.Name, origin.Path)
+	}
+}
+
+// renderStdin renders the template passed via stdin and writes the
+// resulting resources to stdout.
+func renderStdin(opts piper.Options) error {
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	resources, err := piper.Render(opts, "<stdin>", data)
+	if err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(resources)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+func saveMermaid(f string, p *piper.Pipeline, perm os.FileMode, owner fileOwner) error {
+	var out bytes.Buffer
+	if err := piper.WriteMermaid(&out, p); err != nil {
+		return err
+	}
+	return writeFile(f, out.Bytes(), perm, owner)
+}
+
+func saveProvenance(f string, p *piper.Pipeline, perm os.FileMode, owner fileOwner) error {
+	out, err := json.MarshalIndent(piper.Provenance(p), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(f, append(out, '\n'), perm, owner)
+}
+
+// startCPUProfile starts CPU profiling into the given file. The
+// returned function stops the profiling. If path is empty, nothing
+// is profiled.
+func startCPUProfile(path string) (func(), error) {
+	if path == "" {
+		return func() {}, nil
+	}
+	fp, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(fp); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		fp.Close()
+	}, nil
+}
+
+// writeMemProfile writes a heap profile into the given file. If path
+// is empty, nothing is written.
+func writeMemProfile(path string) error {
+	if path == "" {
 		return nil
-	}); e != nil {
-		if os.IsNotExist(e) {
-			return []Resource{}, nil
-		}
-		return nil, fmt.Errorf("failed to process paths: %s: %s", path, e.Error())
 	}
-	return resources, nil
+	fp, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	runtime.GC()
+	return pprof.WriteHeapProfile(fp)
 }
 
-func generateInstance(output *ResourceConfig, instance string, path string, data []byte, input ResourceConfigHeader, activePipeline string, partials *template.Template, log *logrus.Logger) error {
-	var buf bytes.Buffer
-	params, ok := input.Meta.Params[instance]
-	if !ok {
-		params = make([]Param, 0)
+// parseVars parses variables of the form name=value. Later definitions
+// of a variable replace earlier ones.
+func parseVars(vars []string) (map[string]string, error) {
+	result := make(map[string]string, len(vars))
+	for _, v := range vars {
+		idx := strings.Index(v, "=")
+		if idx < 1 {
+			return nil, fmt.Errorf("%s is not of the form name=value", v)
+		}
+		result[v[:idx]] = v[idx+1:]
 	}
-	log.WithField("instance", instance).Debugf("Params: %v", params)
-	funcs := generateFuncMap(instance, params, partials)
-	tmpl, err := template.New("ROOT").Funcs(funcs).Parse(string(data))
+	return result, nil
+}
+
+// parseFileMode parses an octal permission string like "0644".
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
 	if err != nil {
-		log.Error(string(data))
-		return fmt.Errorf("failed to parse template %s: %s", path, err.Error())
+		return 0, fmt.Errorf("%s is not an octal number", s)
 	}
-	if err := tmpl.ExecuteTemplate(&buf, "ROOT", ResourceInstanceContext{
-		Instance: instance,
-		Params:   params,
-		Pipeline: activePipeline,
-	}); err != nil {
-		return fmt.Errorf("failed to render template %s: %s", path, err.Error())
+	if mode > 0777 {
+		return 0, fmt.Errorf("%s contains more than permission bits", s)
 	}
-	if err := yaml.Unmarshal(buf.Bytes(), output); err != nil {
-		log.Error(buf.String())
-		return fmt.Errorf("failed to unmarshal final instance config of %s (%s): %s", instance, path, err.Error())
+	return os.FileMode(mode), nil
+}
+
+// fileOwner is the user and group output files are owned by. An id of
+// -1 keeps the respective owner unchanged.
+type fileOwner struct {
+	uid int
+	gid int
+}
+
+// keepOwner leaves the ownership of output files as it is.
+var keepOwner = fileOwner{uid: -1, gid: -1}
+
+// writeFile writes data to the given file and ensures that it has
+// the given permissions and owner even if the file already existed.
+// Changing the owner is skipped on Windows, which doesn't support it.
+func writeFile(f string, data []byte, perm os.FileMode, owner fileOwner) error {
+	if err := ioutil.WriteFile(f, data, perm); err != nil {
+		return err
 	}
-	return nil
+	return applyFileMode(f, perm, owner)
 }
 
-func convertToResource(rc ResourceConfig, singleton bool) Resource {
-	resource := Resource{}
-	resource["name"] = rc.Meta.NameTemplate
-	if singleton {
-		resource["name"] = rc.Meta.Name
+// applyFileMode sets the permissions and owner of the given file.
+func applyFileMode(f string, perm os.FileMode, owner fileOwner) error {
+	if err := os.Chmod(f, perm); err != nil {
+		return err
 	}
-	for k, v := range rc.Data {
-		resource[k] = v
+	if owner == keepOwner || runtime.GOOS == "windows" {
+		return nil
 	}
-	return resource
+	return os.Chown(f, owner.uid, owner.gid)
 }
 
-func parseHeader(rc *ResourceConfigHeader, data []byte) error {
-	header, err := findHeader(data)
+// savePipeline streams the pipeline into the given file so that huge
+// pipelines don't have to be rendered in memory as a whole first. The
+// pipeline is written to a temporary file next to f first, which only
+// replaces f once it is complete, so that a failure never leaves a
+// truncated pipeline behind.
+func savePipeline(f string, p *piper.Pipeline, perm os.FileMode, owner fileOwner, opts piper.MarshalOptions) error {
+	file, err := ioutil.TempFile(filepath.Dir(f), "."+filepath.Base(f)+".*")
 	if err != nil {
 		return err
 	}
-	return yaml.Unmarshal(header, &rc)
+	out := bufio.NewWriter(file)
+	err = piper.MarshalTo(out, p, opts)
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = applyFileMode(file.Name(), perm, owner)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), f)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
 }
 
-func generateFuncMap(instance string, params []Param, partials *template.Template) template.FuncMap {
-	funcs := template.FuncMap{}
-	funcs["getParam"] = func(name, def string) string {
-		for _, p := range params {
-			if p.Name == name {
-				return p.Value
+// savePipelineDir writes every category of the pipeline into its own
+// file inside the given folder. Each file only contains the
+// category's top-level key so that it remains a valid pipeline
+// fragment. Files of categories omitted due to opts.OmitEmpty are
+// removed.
+func savePipelineDir(dir string, p *piper.Pipeline, perm os.FileMode, owner fileOwner, opts piper.MarshalOptions) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, category := range []string{"jobs", "resources", "resource_types", "groups", "var_sources"} {
+		out, err := piper.MarshalCategory(p, category, opts)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, category+".yaml")
+		if out == nil {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
 			}
+			continue
+		}
+		if err := writeFile(path, out, perm, owner); err != nil {
+			return err
 		}
-		return def
-	}
-	funcs["list"] = func(elems ...interface{}) []interface{} {
-		return elems
-	}
-	funcs["ite"] = ite
-	funcs["indent"] = indent
-	funcs["partial"] = func(name string, indentation int, context ResourceInstanceContext, kwargs ...interface{}) (string, error) {
-		var out bytes.Buffer
-		argsMap := make(map[string]interface{})
-		key := ""
-		for idx, arg := range kwargs {
-			if idx%2 == 0 {
-				key = arg.(string)
-			} else {
-				argsMap[key] = arg
+	}
+	return nil
+}
+
+// findConcourseVars renders the pipeline the same way it would be
+// written to output or outputDir and describes every ((var))
+// placeholder found together with the file and line it would end up
+// in.
+func findConcourseVars(p *piper.Pipeline, output string, outputDir string, opts piper.MarshalOptions) ([]string, error) {
+	files := make(map[string][]byte)
+	names := []string{output}
+	if outputDir != "" {
+		names = nil
+		for _, category := range []string{"jobs", "resources", "resource_types", "groups", "var_sources"} {
+			out, err := piper.MarshalCategory(p, category, opts)
+			if err != nil {
+				return nil, err
 			}
+			path := filepath.Join(outputDir, category+".yaml")
+			names = append(names, path)
+			files[path] = out
 		}
-		localContext := context.Clone()
-		localContext.Args = argsMap
-		innerFuncMap := template.FuncMap{}
-		innerFuncMap["getParam"] = funcs["getParam"]
-		innerFuncMap["ite"] = funcs["ite"]
-		innerFuncMap["partial"] = funcs["partial"]
-		innerFuncMap["list"] = funcs["list"]
-		innerFuncMap["indent"] = funcs["indent"]
-		tmpls, err := partials.Clone()
+	} else {
+		out, err := piper.Marshal(p, opts)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		if err := tmpls.Funcs(innerFuncMap).ExecuteTemplate(&out, name, localContext); err != nil {
-			return "", err
+		files[output] = out
+	}
+	var result []string
+	for _, name := range names {
+		for _, v := range piper.FindConcourseVars(files[name]) {
+			result = append(result, fmt.Sprintf("%s:%d: unresolved %s in %s", name, v.Line, v.Name, v.Context))
 		}
-		return indent(out.String(), indentation), nil
 	}
-	return funcs
+	return result, nil
 }
 
-// loadPartials optionally loads partial templates from the
-// "partials" folder.
-func loadPartials(fs afero.Fs, path string) (*template.Template, error) {
-	pat := filepath.Join(path, "*")
-	files, err := afero.Glob(fs, pat)
-	tmpl := template.New("PARTIALS")
-	tmpl.Funcs(generateFuncMap("", []Param{}, tmpl))
-	if err != nil {
-		return nil, err
-	}
-	if len(files) == 0 {
-		return tmpl, nil
+func displayPipelineStats(log *logrus.Logger, p *piper.Pipeline) {
+	categories := []struct {
+		key       string
+		resources []piper.Resource
+	}{
+		{"jobs", p.Jobs},
+		{"resource_types", p.ResourceTypes},
+		{"resources", p.Resources},
+		{"groups", p.Groups},
+		{"var_sources", p.VarSources},
 	}
-	var data []byte
-	for _, filename := range files {
-		fn := filepath.Base(filename)
-		data, err = afero.ReadFile(fs, filename)
-		if err != nil {
-			return nil, err
+	for _, c := range categories {
+		log.Infof("Generated %s (%d):", c.key, len(c.resources))
+		for _, r := range c.resources {
+			if origin, ok := p.Origin(c.key, r.String()); ok && origin.Meta.Description != "" {
+				log.Infof(" - %s: %s", r, origin.Meta.Description)
+				continue
+			}
+			log.Infof(" - %s", r)
 		}
-		_, err = tmpl.New(fn).Parse(string(data))
 	}
-	return tmpl, err
 }
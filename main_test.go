@@ -1,200 +1,238 @@
 package main
 
 import (
-	"context"
+	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"text/template"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
+	"github.com/zerok/concourse-piper/pkg/piper"
 	yaml "gopkg.in/yaml.v2"
 )
 
-type testInfo struct {
-	Title       string   `yaml:"title"`
-	Details     string   `yaml:"details"`
-	ExpectError bool     `yaml:"expectError"`
-	Result      Pipeline `yaml:"result"`
-}
-
-func loadTestInfo(path string) (*testInfo, error) {
-	var info testInfo
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
+func TestSavePipelineDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piper")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	p := &piper.Pipeline{
+		Jobs:      []piper.Resource{{"name": "build"}},
+		Resources: []piper.Resource{{"name": "source"}},
 	}
-	if err := yaml.Unmarshal(data, &info); err != nil {
-		return nil, err
+	require.NoError(t, savePipelineDir(dir, p, 0644, keepOwner, piper.MarshalOptions{}))
+	for _, key := range []string{"jobs", "resources", "resource_types", "groups"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, key+".yaml"))
+		require.NoError(t, err)
+		var fragment map[string][]piper.Resource
+		require.NoError(t, yaml.Unmarshal(data, &fragment))
+		require.Len(t, fragment, 1)
+		_, ok := fragment[key]
+		require.True(t, ok, "%s.yaml should contain the %s key", key, key)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "jobs.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, "jobs:\n- name: build\n", string(data))
+
+	require.NoError(t, savePipelineDir(dir, p, 0644, keepOwner, piper.MarshalOptions{OmitEmpty: true}))
+	for _, key := range []string{"resource_types", "groups"} {
+		_, err := os.Stat(filepath.Join(dir, key+".yaml"))
+		require.True(t, os.IsNotExist(err), "%s.yaml should have been removed", key)
 	}
-	return &info, nil
 }
 
-func TestFindHeader(t *testing.T) {
+func TestWriteCounts(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, writeCounts(&out, []piper.PipelineCount{
+		{Pipeline: "", Counts: map[string]int{"jobs": 1, "resources": 2}},
+		{Pipeline: "production", Counts: map[string]int{"jobs": 10, "resources": 3, "resource_types": 1, "groups": 2, "var_sources": 1}},
+	}))
+	require.Equal(t, `PIPELINE    JOBS  RESOURCES  RESOURCE_TYPES  GROUPS  VAR_SOURCES
+(default)   1     2          0               0       0
+production  10    3          1               2       1
+`, out.String())
+}
+
+func TestWritePartials(t *testing.T) {
+	var out bytes.Buffer
+	require.NoError(t, writePartials(&out, []piper.PartialInfo{
+		{Name: "git-source", Kind: piper.PartialAlias, Path: "partials/git-source.yml"},
+		{Name: "git-source.yml", Kind: piper.PartialFile, Path: "partials/git-source.yml"},
+		{Name: "notify", Kind: piper.PartialBlock, Path: "shared/partials/helpers.tmpl"},
+	}))
+	require.Equal(t, `NAME            KIND   PATH
+git-source      alias  partials/git-source.yml
+git-source.yml  file   partials/git-source.yml
+notify          block  shared/partials/helpers.tmpl
+`, out.String())
+}
+
+func TestParseFileMode(t *testing.T) {
 	tests := []struct {
 		input    string
-		header   []byte
+		mode     os.FileMode
 		hasError bool
-		message  string
 	}{
-		{
-			input:    `nothing`,
-			header:   nil,
-			hasError: true,
-			message:  `If no data: section can be found then an error should be returned.`,
-		},
-		{
-			input:    "something\ndata:\nbody",
-			header:   []byte(`something`),
-			hasError: false,
-			message:  `The header section should have been found.`,
-		},
+		{input: "0644", mode: 0644},
+		{input: "600", mode: 0600},
+		{input: "0777", mode: 0777},
+		{input: "0888", hasError: true},
+		{input: "rw-r--r--", hasError: true},
+		{input: "", hasError: true},
+		{input: "01777", hasError: true},
 	}
 	for _, test := range tests {
-		header, err := findHeader([]byte(test.input))
-		if string(header) != string(test.header) || (err != nil && !test.hasError) || (err == nil && test.hasError) {
-			t.Logf("Found header: %s", header)
-			t.Logf("Error: %v", err)
-			t.Fatal(test.message)
+		mode, err := parseFileMode(test.input)
+		if test.hasError {
+			require.Error(t, err, test.input)
+			continue
 		}
+		require.NoError(t, err, test.input)
+		require.Equal(t, test.mode, mode, test.input)
 	}
 }
 
-func TestBuildPipeline(t *testing.T) {
-	tests := []struct {
-		name           string
-		fillFS         func(afero.Fs)
-		expectedResult *Pipeline
-		expectedError  bool
-	}{
-		{
-			name: "empty",
-			fillFS: func(fs afero.Fs) {
-				fs.Mkdir("/", 0700)
-				fs.Mkdir("/jobs", 0700)
-				fs.Mkdir("/resources", 0700)
-				fs.Mkdir("/resource_types", 0700)
-			},
-			expectedResult: &Pipeline{
-				Groups:        []Resource{},
-				Resources:     []Resource{},
-				ResourceTypes: []Resource{},
-				Jobs:          []Resource{},
-			},
-			expectedError: false,
-		}, {
-			name: "simple",
-			fillFS: func(fs afero.Fs) {
-				fs.Mkdir("/", 0700)
-				fs.Mkdir("/jobs", 0700)
-				afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n"), 0600)
-			},
-			expectedResult: &Pipeline{
-				Groups:        []Resource{},
-				Resources:     []Resource{},
-				ResourceTypes: []Resource{},
-				Jobs: []Resource{
-					{"name": "build"},
-				},
-			},
-			expectedError: false,
-		}, {
-			name: "simple-with-yaml",
-			fillFS: func(fs afero.Fs) {
-				fs.Mkdir("/", 0700)
-				fs.Mkdir("/jobs", 0700)
-				afero.WriteFile(fs, "/jobs/build.yaml", []byte("meta:\n  name: build\ndata:\n"), 0600)
-			},
-			expectedResult: &Pipeline{
-				Groups:        []Resource{},
-				Resources:     []Resource{},
-				ResourceTypes: []Resource{},
-				Jobs: []Resource{
-					{"name": "build"},
-				},
-			},
-			expectedError: false,
-		}, {
-			name: "partials",
-			fillFS: func(fs afero.Fs) {
-				fs.Mkdir("/", 0700)
-				fs.Mkdir("/jobs", 0700)
-				fs.Mkdir("/partials", 0700)
-				afero.WriteFile(fs, "/partials/job-def.yml", []byte("file: some-other-file-{{ getParam \"param\" \"<nil>\" }}.yml"), 0600)
-				afero.WriteFile(fs, "/jobs/build.yml", []byte(`meta:
-  name_template: build-{{ .Instance }}
-  instances:
-  - a
-  - b
-  params:
-    a:
-    - name: param
-      value: a
-    b:
-    - name: param
-      value: b
-data:
-  {{ partial "job-def.yml" 0 . }}`), 0600)
-			},
-			expectedResult: &Pipeline{
-				Groups:        []Resource{},
-				Resources:     []Resource{},
-				ResourceTypes: []Resource{},
-				Jobs: []Resource{
-					{
-						"name": "build-a",
-						"file": "some-other-file-a.yml",
-					},
-					{
-						"name": "build-b",
-						"file": "some-other-file-b.yml",
-					},
-				},
-			},
-			expectedError: false,
-		},
-	}
-	ctx := context.Background()
-	log := logrus.New()
-	log.SetLevel(logrus.ErrorLevel)
-	for _, testcase := range tests {
-		t.Run(testcase.name, func(t *testing.T) {
-			fs := afero.NewMemMapFs()
-			testcase.fillFS(fs)
-			result, err := buildPipeline(ctx, "", fs, "/", false, "", log)
-			if testcase.expectedError {
-				require.Error(t, err)
-			} else {
-				require.NoError(t, err)
-				require.Equal(t, testcase.expectedResult, result)
-			}
-		})
+func TestSavePipelinePermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piper")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "pipeline.yaml")
+	require.NoError(t, ioutil.WriteFile(f, []byte{}, 0644))
+	require.NoError(t, savePipeline(f, &piper.Pipeline{}, 0600, keepOwner, piper.MarshalOptions{}))
+	info, err := os.Stat(f)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestSaveDerivedFilesPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piper")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	mermaid := filepath.Join(dir, "pipeline.mmd")
+	provenance := filepath.Join(dir, "provenance.json")
+	require.NoError(t, saveMermaid(mermaid, &piper.Pipeline{}, 0600, keepOwner))
+	require.NoError(t, saveProvenance(provenance, &piper.Pipeline{}, 0600, keepOwner))
+	for _, f := range []string{mermaid, provenance} {
+		info, err := os.Stat(f)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm(), f)
 	}
 }
 
-func TestNestedPartials(t *testing.T) {
-	fs := afero.NewMemMapFs()
-	afero.WriteFile(fs, "/inner.txt", []byte("data:\n  value: INNER"), 0600)
-	afero.WriteFile(fs, "/outer.txt", []byte("{{ partial \"inner.txt\" 0 . }}"), 0600)
-	tmpls, err := loadPartials(fs, "/")
+func TestSavePipelineOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piper")
 	require.NoError(t, err)
-	require.NotNil(t, tmpls)
-	out := &ResourceConfig{}
-	logger := logrus.New()
-	err = generateInstance(out, "some-instance", "some-path", []byte(`{{ partial "outer.txt" 4 . }}`), ResourceConfigHeader{}, "active-pipeline", tmpls, logger)
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "pipeline.yaml")
+	owner := fileOwner{uid: os.Getuid(), gid: os.Getgid()}
+	require.NoError(t, savePipeline(f, &piper.Pipeline{}, 0600, owner, piper.MarshalOptions{}))
+	require.NoError(t, savePipeline(f, &piper.Pipeline{}, 0600, fileOwner{uid: -1, gid: os.Getgid()}, piper.MarshalOptions{}))
+	require.NoError(t, saveMermaid(filepath.Join(dir, "pipeline.mmd"), &piper.Pipeline{}, 0600, owner))
+	require.NoError(t, saveProvenance(filepath.Join(dir, "provenance.json"), &piper.Pipeline{}, 0600, owner))
+}
+
+func TestSavePipelineFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piper")
 	require.NoError(t, err)
-	require.Equal(t, out.Data["value"], "INNER")
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "pipeline.yaml")
+	require.NoError(t, ioutil.WriteFile(f, []byte("jobs: []\n"), 0644))
+	tmpl := template.Must(template.New("output").Parse(`{{ template "missing" }}`))
+	require.Error(t, savePipeline(f, &piper.Pipeline{}, 0644, keepOwner, piper.MarshalOptions{Template: tmpl}))
+	data, err := ioutil.ReadFile(f)
+	require.NoError(t, err)
+	require.Equal(t, "jobs: []\n", string(data), "a failed write must keep the previous pipeline")
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1, "the temporary file must be removed")
+}
+
+func TestSplitFileList(t *testing.T) {
+	require.Equal(t, []string{"jobs/a.yml", "jobs/b.yml", "partials/c.yml"}, splitFileList([]string{"jobs/a.yml\njobs/b.yml\n", "partials/c.yml"}))
+	require.Nil(t, splitFileList([]string{"\n"}))
+}
+
+func TestWriteSummary(t *testing.T) {
+	var out bytes.Buffer
+	writeSummary(&out, []piper.Change{
+		{Kind: piper.ChangeAdded, Category: "resources", Name: "image"},
+		{Kind: piper.ChangeRemoved, Category: "resources", Name: "old-image"},
+		{Kind: piper.ChangeModified, Category: "jobs", Name: "build"},
+		{Kind: piper.ChangeModified, Category: "jobs", Name: "test"},
+	})
+	require.Equal(t, `+ resources image
+- resources old-image
+~ jobs build
+~ jobs test
+resources: 1 added, 1 removed; jobs: 2 modified
+`, out.String())
+
+	out.Reset()
+	writeSummary(&out, nil)
+	require.Equal(t, "No changes\n", out.String())
+}
+
+func TestWarningCounter(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	warnings := &warningCounter{}
+	log.Hooks.Add(warnings)
+	log.Info("info")
+	log.Error("error")
+	require.Equal(t, 0, warnings.Count())
+	log.Warn("first")
+	log.WithField("path", "jobs/build.yml").Warnf("second")
+	require.Equal(t, 2, warnings.Count())
+	require.EqualError(t, warnings.Err(), "2 warning(s) were logged")
+	warnings.Reset()
+	require.NoError(t, warnings.Err())
+
+	var disabled *warningCounter
+	disabled.Reset()
+	require.NoError(t, disabled.Err())
 }
 
-func TestPartialsWithArgs(t *testing.T) {
-	fs := afero.NewMemMapFs()
-	afero.WriteFile(fs, "/inner.txt", []byte("data:\n  value: {{ index .Args \"value\" }}"), 0600)
-	afero.WriteFile(fs, "/outer.txt", []byte("{{ partial \"inner.txt\" 0 . \"value\" \"INNER\" }}"), 0600)
-	tmpls, err := loadPartials(fs, "/")
+func TestExitCode(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &exitError{exitValidation, errors.New("invalid")})
+	require.Equal(t, exitValidation, exitCode(err))
+	require.Equal(t, "wrapped: invalid", err.Error())
+	require.Equal(t, exitGeneration, exitCode(errors.New("broken template")))
+}
+
+func TestParseVars(t *testing.T) {
+	vars, err := parseVars([]string{"regions=eu, us", "url=https://example.com/?a=b", "empty=", "regions=eu"})
 	require.NoError(t, err)
-	require.NotNil(t, tmpls)
-	out := &ResourceConfig{}
-	logger := logrus.New()
-	err = generateInstance(out, "some-instance", "some-path", []byte(`{{ partial "outer.txt" 4 . }}`), ResourceConfigHeader{}, "active-pipeline", tmpls, logger)
+	require.Equal(t, map[string]string{"regions": "eu", "url": "https://example.com/?a=b", "empty": ""}, vars)
+
+	_, err = parseVars([]string{"regions"})
+	require.Error(t, err)
+	_, err = parseVars([]string{"=value"})
+	require.Error(t, err)
+}
+
+func TestFindConcourseVars(t *testing.T) {
+	p := &piper.Pipeline{
+		Resources: []piper.Resource{
+			{"name": "source", "type": "git", "source": map[string]interface{}{"uri": "((git-uri))"}},
+		},
+		Jobs: []piper.Resource{
+			{"name": "build", "plan": []interface{}{}},
+		},
+	}
+	unresolved, err := findConcourseVars(p, "pipeline.yaml", "", piper.MarshalOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"pipeline.yaml:6: unresolved ((git-uri)) in uri: ((git-uri))"}, unresolved)
+
+	unresolved, err = findConcourseVars(p, "pipeline.yaml", "out", piper.MarshalOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join("out", "resources.yaml") + ":4: unresolved ((git-uri)) in uri: ((git-uri))"}, unresolved)
+
+	p.Resources[0]["source"] = map[string]interface{}{"uri": "https://example.org/repo.git"}
+	unresolved, err = findConcourseVars(p, "pipeline.yaml", "", piper.MarshalOptions{})
 	require.NoError(t, err)
+	require.Empty(t, unresolved)
 }
@@ -0,0 +1,181 @@
+package piper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Cache stores the resources generated out of each template file so
+// that unchanged files don't have to be rendered again. Since
+// partials, the selected pipeline, and the options affecting
+// rendering can influence every template, any change to them
+// invalidates the whole cache. Changes to custom template functions
+// are not detected.
+type Cache struct {
+	Key   string                `yaml:"key"`
+	Files map[string]CacheEntry `yaml:"files"`
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// CacheEntry holds the generation result of a single template file.
+type CacheEntry struct {
+	Hash      string     `yaml:"hash"`
+	Resources []Resource `yaml:"resources"`
+	Origins   []Origin   `yaml:"origins"`
+}
+
+// LoadCache reads a cache from the given path. If the file doesn't
+// exist, an empty cache is returned.
+func LoadCache(fs afero.Fs, path string) (*Cache, error) {
+	c := &Cache{}
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Save writes the cache to the given path. Entries of files that
+// were not part of the last generation are dropped.
+func (c *Cache) Save(fs afero.Fs, path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen != nil {
+		for p := range c.Files {
+			if _, ok := c.seen[p]; !ok {
+				delete(c.Files, p)
+			}
+		}
+	}
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, path, out, 0644)
+}
+
+// reset prepares the cache for a new generation with the given key.
+// If the key differs from the one of the previous generation, all
+// entries are discarded.
+func (c *Cache) reset(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Key != key || c.Files == nil {
+		c.Files = make(map[string]CacheEntry)
+	}
+	c.Key = key
+	c.seen = make(map[string]struct{})
+}
+
+func (c *Cache) get(path string, hash string) (CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen[path] = struct{}{}
+	entry, ok := c.Files[path]
+	if !ok || entry.Hash != hash {
+		return CacheEntry{}, false
+	}
+	resources, err := copyResources(entry.Resources)
+	if err != nil {
+		return CacheEntry{}, false
+	}
+	entry.Resources = resources
+	entry.Origins = append([]Origin{}, entry.Origins...)
+	return entry, true
+}
+
+func (c *Cache) put(path string, entry CacheEntry) error {
+	// The resources are copied so that later modifications of the
+	// generated pipeline don't end up in the cache.
+	resources, err := copyResources(entry.Resources)
+	if err != nil {
+		return err
+	}
+	entry.Resources = resources
+	entry.Origins = append([]Origin{}, entry.Origins...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen[path] = struct{}{}
+	c.Files[path] = entry
+	return nil
+}
+
+// copyResources creates a deep copy of the given resources.
+func copyResources(resources []Resource) ([]Resource, error) {
+	data, err := yaml.Marshal(resources)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Resource, 0, len(resources))
+	if err := yaml.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func hashData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheKey computes a key over everything besides the template file
+// itself that influences the generated resources.
+func cacheKey(opts Options) (string, error) {
+	h := sha256.New()
+	for _, value := range []string{
+		opts.Pipeline,
+		opts.Team,
+		opts.Env,
+		opts.PreHook,
+		strconv.Itoa(opts.MaxInstances),
+		strconv.FormatBool(opts.StrictInstances),
+		strconv.FormatBool(opts.OverrideFuncs),
+		strings.Join(opts.Folders, string(filepath.ListSeparator)),
+	} {
+		h.Write([]byte(value))
+		h.Write([]byte{0})
+	}
+	names := make([]string, 0, len(opts.Vars))
+	for name := range opts.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h.Write([]byte(name + "=" + opts.Vars[name]))
+		h.Write([]byte{0})
+	}
+	for _, folder := range opts.Folders {
+		files, err := afero.Glob(opts.Fs, filepath.Join(folder, "partials", "*"))
+		if err != nil {
+			return "", err
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			data, err := afero.ReadFile(opts.Fs, file)
+			if err != nil {
+				return "", err
+			}
+			h.Write([]byte(file))
+			h.Write([]byte{0})
+			h.Write([]byte(hashData(data)))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
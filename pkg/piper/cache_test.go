@@ -0,0 +1,177 @@
+package piper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/partials/type.yml", []byte("type: git"), 0600)
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/jobs/test.yml", []byte("meta:\n  name: test\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/resources/source.yml", []byte("meta:\n  name: source\ndata:\n  {{ partial \"type\" 2 . }}"), 0600)
+
+	build := func() *Pipeline {
+		cache, err := LoadCache(fs, "/cache.yml")
+		require.NoError(t, err)
+		result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log, Cache: cache})
+		require.NoError(t, err)
+		require.NoError(t, cache.Save(fs, "/cache.yml"))
+		return result
+	}
+	tamper := func(path string) {
+		cache, err := LoadCache(fs, "/cache.yml")
+		require.NoError(t, err)
+		entry := cache.Files[path]
+		entry.Resources[0]["cached"] = true
+		cache.Files[path] = entry
+		require.NoError(t, cache.Save(fs, "/cache.yml"))
+	}
+
+	result := build()
+	result.Jobs[0]["modified"] = true
+	result = build()
+	require.Equal(t, []Resource{{"name": "build", "serial": true}, {"name": "test", "serial": true}}, result.Jobs)
+	origin, ok := result.Origin("jobs", "test")
+	require.True(t, ok)
+	require.Equal(t, "/jobs/test.yml", origin.Path)
+
+	// Unchanged files are taken from the cache while changed ones
+	// are rendered again.
+	tamper("/jobs/build.yml")
+	tamper("/jobs/test.yml")
+	afero.WriteFile(fs, "/jobs/test.yml", []byte("meta:\n  name: test\ndata:\n  serial: false"), 0600)
+	result = build()
+	require.Equal(t, []Resource{{"name": "build", "serial": true, "cached": true}, {"name": "test", "serial": false}}, result.Jobs)
+	origin, ok = result.Origin("jobs", "build")
+	require.True(t, ok)
+	require.Equal(t, "/jobs/build.yml", origin.Path)
+
+	// A change to any partial invalidates the whole cache.
+	tamper("/jobs/build.yml")
+	afero.WriteFile(fs, "/partials/type.yml", []byte("type: hg"), 0600)
+	result = build()
+	require.Equal(t, []Resource{{"name": "build", "serial": true}, {"name": "test", "serial": false}}, result.Jobs)
+	require.Equal(t, []Resource{{"name": "source", "type": "hg"}}, result.Resources)
+
+	// Removed files are dropped from the cache.
+	fs.Remove("/jobs/test.yml")
+	build()
+	cache, err := LoadCache(fs, "/cache.yml")
+	require.NoError(t, err)
+	require.Len(t, cache.Files, 2)
+}
+
+func TestCacheKey(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	opts := Options{Fs: fs, Folders: []string{"/"}}
+	base, err := cacheKey(opts)
+	require.NoError(t, err)
+	for name, modify := range map[string]func(o *Options){
+		"env":              func(o *Options) { o.Env = "prod" },
+		"pre-hook":         func(o *Options) { o.PreHook = "cat" },
+		"max-instances":    func(o *Options) { o.MaxInstances = 10 },
+		"strict-instances": func(o *Options) { o.StrictInstances = true },
+		"override-funcs":   func(o *Options) { o.OverrideFuncs = true },
+		"folders":          func(o *Options) { o.Folders = []string{"/", "/overlay"} },
+		"vars":             func(o *Options) { o.Vars = map[string]string{"a": "b"} },
+	} {
+		modified := opts
+		modify(&modified)
+		key, err := cacheKey(modified)
+		require.NoError(t, err)
+		require.NotEqual(t, base, key, name)
+	}
+}
+
+func TestCacheSkipsRenderResource(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/resources/image.yml", []byte("meta:\n  name: image\ndata:\n  type: registry-image"), 0600)
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n  image: {{ renderResource \"resources/image.yml\" | toYaml | nindent 4 }}"), 0600)
+	afero.WriteFile(fs, "/jobs/test.yml", []byte("meta:\n  name: test\ndata:\n  serial: true"), 0600)
+
+	build := func() *Pipeline {
+		cache, err := LoadCache(fs, "/cache.yml")
+		require.NoError(t, err)
+		result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log, Cache: cache})
+		require.NoError(t, err)
+		require.NoError(t, cache.Save(fs, "/cache.yml"))
+		return result
+	}
+
+	build()
+	cache, err := LoadCache(fs, "/cache.yml")
+	require.NoError(t, err)
+	require.NotContains(t, cache.Files, "/jobs/build.yml")
+	require.Contains(t, cache.Files, "/jobs/test.yml")
+
+	// Changes to the rendered template show up although the template
+	// rendering it stays the same.
+	afero.WriteFile(fs, "/resources/image.yml", []byte("meta:\n  name: image\ndata:\n  type: docker-image"), 0600)
+	result := build()
+	require.Equal(t, map[interface{}]interface{}{"type": "docker-image"}, result.Jobs[0]["image"])
+}
+
+func TestCacheSkipsInstancesFrom(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/deploy.yml", []byte("meta:\n  name_template: deploy-{{ .Instance }}\n  instances_from: regions.csv\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/jobs/regions.csv", []byte("name\neu\n"), 0600)
+
+	build := func() *Pipeline {
+		cache, err := LoadCache(fs, "/cache.yml")
+		require.NoError(t, err)
+		result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log, Cache: cache})
+		require.NoError(t, err)
+		require.NoError(t, cache.Save(fs, "/cache.yml"))
+		return result
+	}
+
+	require.Len(t, build().Jobs, 1)
+	cache, err := LoadCache(fs, "/cache.yml")
+	require.NoError(t, err)
+	require.NotContains(t, cache.Files, "/jobs/deploy.yml")
+
+	afero.WriteFile(fs, "/jobs/regions.csv", []byte("name\neu\nus\n"), 0600)
+	require.Len(t, build().Jobs, 2, "Rows added to the file show up")
+}
+
+func TestCacheSkipsInstancesGlob(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/test.yml", []byte("meta:\n  name_template: test-{{ .Instance }}\n  instances_glob: services/*.yml\ndata:\n  port: {{ param \"port\" }}"), 0600)
+	afero.WriteFile(fs, "/services/api.yml", []byte("port: 80"), 0600)
+
+	build := func() *Pipeline {
+		cache, err := LoadCache(fs, "/cache.yml")
+		require.NoError(t, err)
+		result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log, Cache: cache})
+		require.NoError(t, err)
+		require.NoError(t, cache.Save(fs, "/cache.yml"))
+		return result
+	}
+
+	require.Equal(t, []Resource{{"name": "test-api", "port": 80}}, build().Jobs)
+	cache, err := LoadCache(fs, "/cache.yml")
+	require.NoError(t, err)
+	require.NotContains(t, cache.Files, "/jobs/test.yml")
+
+	afero.WriteFile(fs, "/services/api.yml", []byte("port: 8080"), 0600)
+	afero.WriteFile(fs, "/services/web.yml", []byte("port: 443"), 0600)
+	require.Equal(t, []Resource{{"name": "test-api", "port": 8080}, {"name": "test-web", "port": 443}}, build().Jobs)
+}
@@ -0,0 +1,58 @@
+package piper
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// AffectedEntries returns the origins of all entries of the pipeline
+// that were generated from one of the given files, e.g. the files
+// changed by a commit. Next to the template itself, this includes the
+// files listed in Origin.Inputs like that of meta.instances_from. As
+// partials may be used by any template, a changed partial affects
+// every generated entry. Paths are compared
+// after cleaning them, so they have to be relative to the same
+// directory as opts.Folders. Entries without an origin, like those of
+// a base pipeline, are never reported.
+func AffectedEntries(opts Options, p *Pipeline, files []string) []Origin {
+	opts = opts.withDefaults()
+	changed := make(map[string]struct{}, len(files))
+	partialChanged := false
+	for _, f := range files {
+		f = filepath.Clean(f)
+		changed[f] = struct{}{}
+		for _, folder := range opts.Folders {
+			rel, err := filepath.Rel(filepath.Join(folder, "partials"), f)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				partialChanged = true
+			}
+		}
+	}
+	affected := make([]Origin, 0, 5)
+	for _, category := range []string{"groups", "resource_types", "resources", "jobs", "var_sources"} {
+		resources, _ := p.category(category)
+		for _, r := range resources {
+			origin, ok := p.Origin(category, r.String())
+			if !ok {
+				continue
+			}
+			if _, ok := changed[filepath.Clean(origin.Path)]; ok || partialChanged || inputChanged(origin, changed) {
+				affected = append(affected, origin)
+			}
+		}
+	}
+	return affected
+}
+
+// inputChanged returns true if any of the changed files matches one of
+// the inputs of origin.
+func inputChanged(origin Origin, changed map[string]struct{}) bool {
+	for _, input := range origin.Inputs {
+		for f := range changed {
+			if matched, _ := filepath.Match(filepath.Clean(input), f); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
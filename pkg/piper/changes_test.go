@@ -0,0 +1,49 @@
+package piper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAffectedEntries(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "repo/partials/git.yml", []byte("type: git"), 0600)
+	afero.WriteFile(fs, "repo/resources/source.yml", []byte("meta:\n  name_template: source-{{ .Instance }}\n  instances: [a, b]\ndata:\n  {{ partial \"git.yml\" 2 . }}"), 0600)
+	afero.WriteFile(fs, "repo/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n  plan: [{get: source-a}]"), 0600)
+	opts := Options{Fs: fs, Folders: []string{"repo"}, Log: log}
+	p, err := Build(ctx, opts)
+	require.NoError(t, err)
+
+	names := func(origins []Origin) []string {
+		result := make([]string, 0, len(origins))
+		for _, o := range origins {
+			result = append(result, o.Category+"/"+o.Name)
+		}
+		return result
+	}
+	require.Empty(t, AffectedEntries(opts, p, []string{"README.md", "repo/jobs/other.yml"}))
+	require.Equal(t, []string{"resources/source-a", "resources/source-b"}, names(AffectedEntries(opts, p, []string{"./repo/resources/source.yml"})))
+	require.Equal(t, []string{"jobs/build"}, names(AffectedEntries(opts, p, []string{"repo/jobs/build.yml"})))
+	require.Equal(t, []string{"resources/source-a", "resources/source-b", "jobs/build"}, names(AffectedEntries(opts, p, []string{"repo/partials/git.yml"})))
+
+	// Files the instances are read from are inputs of the template.
+	afero.WriteFile(fs, "repo/jobs/deploy.yml", []byte("meta:\n  name_template: deploy-{{ .Instance }}\n  instances_from: regions.csv\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "repo/jobs/regions.csv", []byte("name\neu\n"), 0600)
+	p, err = Build(ctx, opts)
+	require.NoError(t, err)
+	require.Equal(t, []string{"jobs/deploy-eu"}, names(AffectedEntries(opts, p, []string{"repo/jobs/regions.csv"})))
+
+	afero.WriteFile(fs, "repo/jobs/test.yml", []byte("meta:\n  name_template: test-{{ .Instance }}\n  instances_glob: services/*.yml\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "repo/services/api.yml", []byte("port: 80"), 0600)
+	p, err = Build(ctx, opts)
+	require.NoError(t, err)
+	require.Equal(t, []string{"jobs/test-api"}, names(AffectedEntries(opts, p, []string{"repo/services/api.yml"})))
+	require.Equal(t, []string{"jobs/test-api"}, names(AffectedEntries(opts, p, []string{"repo/services/web.yml"})), "New files matching the pattern count as well")
+}
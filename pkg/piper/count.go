@@ -0,0 +1,57 @@
+package piper
+
+import (
+	"sort"
+)
+
+// PipelineCount is the number of entries per category a pipeline
+// would consist of.
+type PipelineCount struct {
+	// Pipeline is the name of the pipeline. The default pipeline
+	// (generated without selecting a pipeline) has an empty name.
+	Pipeline string
+	// Counts maps every category to the number of its entries.
+	Counts map[string]int
+}
+
+// CountInstances returns the number of entries each pipeline would
+// consist of. Only the headers of the templates are parsed, so the
+// counts don't reflect instances skipped while rendering or entries
+// overriding entries of earlier folders. The default pipeline comes
+// first, all other pipelines follow sorted by name.
+func CountInstances(opts Options) ([]PipelineCount, error) {
+	headers, err := scanHeaders(opts)
+	if err != nil {
+		return nil, err
+	}
+	pipelines := map[string]struct{}{"": {}}
+	for _, h := range headers {
+		if h.Header.Meta.Abstract {
+			continue
+		}
+		for _, pipeline := range h.Header.Meta.Pipelines {
+			if pipeline != AllPipelines {
+				pipelines[pipeline] = struct{}{}
+			}
+		}
+	}
+	names := make([]string, 0, len(pipelines))
+	for pipeline := range pipelines {
+		names = append(names, pipeline)
+	}
+	sort.Strings(names)
+	result := make([]PipelineCount, 0, len(names))
+	for _, pipeline := range names {
+		count := PipelineCount{Pipeline: pipeline, Counts: make(map[string]int, len(categories))}
+		for _, category := range categories {
+			count.Counts[category] = 0
+		}
+		for _, h := range headers {
+			if !h.Header.Meta.Abstract && h.Header.isRelevantForPipeline(pipeline) && h.Header.isRelevantForTeam(opts.Team) {
+				count.Counts[h.Category] += len(h.Header.Meta.AllInstances())
+			}
+		}
+		result = append(result, count)
+	}
+	return result, nil
+}
@@ -0,0 +1,38 @@
+package piper
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountInstances(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/build.yml", []byte(`meta:
+  name_template: build-{{ .Instance }}
+  instances: [a, b, c]
+  pipelines: [prod, staging]
+data:
+  serial: {{ broken`), 0600)
+	afero.WriteFile(fs, "/jobs/deploy.yml", []byte("meta:\n  name: deploy\n  pipelines: [prod]\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/resources/source.yml", []byte(`meta:
+  name: source
+  pipelines: ["*"]
+data:
+  type: git
+---
+meta:
+  name: default
+data:
+  type: git
+`), 0600)
+
+	counts, err := CountInstances(Options{Fs: fs, Folders: []string{"/"}})
+	require.NoError(t, err)
+	require.Equal(t, []PipelineCount{
+		{Pipeline: "", Counts: map[string]int{"resource_types": 0, "resources": 2, "jobs": 0, "groups": 0, "var_sources": 0}},
+		{Pipeline: "prod", Counts: map[string]int{"resource_types": 0, "resources": 1, "jobs": 4, "groups": 0, "var_sources": 0}},
+		{Pipeline: "staging", Counts: map[string]int{"resource_types": 0, "resources": 1, "jobs": 3, "groups": 0, "var_sources": 0}},
+	}, counts)
+}
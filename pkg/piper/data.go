@@ -0,0 +1,357 @@
+package piper
+
+import (
+	"fmt"
+)
+
+// Param is a parameter which can be applied to an instance
+// during the template-execution phase.
+type Param struct {
+	Name    string `yaml:"name"`
+	Value   string `yaml:"value"`
+	Section string `yaml:"section"`
+}
+
+// ResourceMeta represents the header of a resource template
+// defining what instances of the resource should be
+// generated.
+type ResourceMeta struct {
+	Name          string             `yaml:"name"`
+	NameTemplate  string             `yaml:"name_template"`
+	Instances     InstanceList       `yaml:"instances"`
+	InstancesFrom string             `yaml:"instances_from"`
+	InstancesGlob string             `yaml:"instances_glob"`
+	Pipelines     []string           `yaml:"pipelines"`
+	Teams         []string           `yaml:"teams"`
+	Params        map[string][]Param `yaml:"params"`
+	Description   string             `yaml:"description"`
+	Comment       string             `yaml:"comment"`
+	Comments      map[string]string  `yaml:"comments"`
+	Requires      []string           `yaml:"requires"`
+	Groups        []string           `yaml:"groups"`
+	Abstract      bool               `yaml:"abstract"`
+
+	// sources keeps the params of every instance separated by where
+	// they were configured, while Params contains them merged.
+	sources paramSources
+	// inputs are glob patterns of the files besides the template the
+	// instances were read from, e.g. the file of instances_from.
+	inputs []string
+}
+
+// paramSources are the params of every instance by source.
+type paramSources struct {
+	// inline are the params given within meta.instances.
+	inline map[string][]Param
+	// configured are the params listed in meta.params.
+	configured map[string][]Param
+	// file are the params read using meta.instances_from or
+	// meta.instances_glob.
+	file map[string][]Param
+}
+
+// paramsBySource returns the params of the given instance separately
+// for every source, ordered by their precedence: inline params,
+// meta.params, and params read from a file. If the sources are
+// unknown, e.g. because the meta section wasn't unmarshalled, Params
+// is the only source.
+func (m *ResourceMeta) paramsBySource(instance string) [][]Param {
+	s := m.sources
+	if s.inline == nil && s.configured == nil && s.file == nil {
+		return [][]Param{m.Params[instance]}
+	}
+	return [][]Param{s.inline[instance], s.configured[instance], s.file[instance]}
+}
+
+// addFileParams records params of the given instance read from a
+// file and merges them into Params with params already configured
+// winning.
+func (m *ResourceMeta) addFileParams(instance string, params []Param) {
+	if m.sources.file == nil {
+		m.sources.file = make(map[string][]Param)
+	}
+	m.sources.file[instance] = params
+	if m.Params == nil {
+		m.Params = make(map[string][]Param)
+	}
+	m.Params[instance] = mergeParams(params, m.Params[instance])
+}
+
+// Singleton returns true if no instances are configured.
+func (m *ResourceMeta) Singleton() bool {
+	return m.Instances == nil || len(m.Instances) == 0
+}
+
+// AllInstances returns the list of instances configured. If none are
+// defined, a singleton-list containing .Name will be returned.
+func (m *ResourceMeta) AllInstances() []string {
+	if m.Singleton() {
+		return []string{m.Name}
+	}
+	return m.Instances
+}
+
+// InstanceList is the list of instance names of a template. Within a
+// template's meta section every instance can either be given by its
+// name or as object with a name and params.
+type InstanceList []string
+
+// UnmarshalYAML accepts both forms of instances and keeps their names.
+func (l *InstanceList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var instances []inlineInstance
+	if err := unmarshal(&instances); err != nil {
+		return err
+	}
+	names := make(InstanceList, 0, len(instances))
+	for _, instance := range instances {
+		names = append(names, instance.Name)
+	}
+	*l = names
+	return nil
+}
+
+// inlineInstance is an entry of meta.instances.
+type inlineInstance struct {
+	Name   string  `yaml:"name"`
+	Params []Param `yaml:"params"`
+}
+
+func (i *inlineInstance) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		i.Name = name
+		return nil
+	}
+	type plain inlineInstance
+	if err := unmarshal((*plain)(i)); err != nil {
+		return err
+	}
+	if i.Name == "" {
+		return fmt.Errorf("instances must have a name")
+	}
+	return nil
+}
+
+// UnmarshalYAML merges the params of instances given in their object
+// form into Params. Inline params replace params of the same name
+// listed in meta.params.
+func (m *ResourceMeta) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ResourceMeta
+	if err := unmarshal((*plain)(m)); err != nil {
+		return err
+	}
+	var inline struct {
+		Instances []inlineInstance `yaml:"instances"`
+	}
+	if err := unmarshal(&inline); err != nil {
+		return err
+	}
+	m.sources.configured = make(map[string][]Param, len(m.Params))
+	for name, params := range m.Params {
+		m.sources.configured[name] = params
+	}
+	m.sources.inline = make(map[string][]Param, len(inline.Instances))
+	for _, instance := range inline.Instances {
+		if len(instance.Params) == 0 {
+			continue
+		}
+		m.sources.inline[instance.Name] = instance.Params
+		if m.Params == nil {
+			m.Params = make(map[string][]Param)
+		}
+		m.Params[instance.Name] = mergeParams(m.Params[instance.Name], instance.Params)
+	}
+	return nil
+}
+
+// mergeParams returns the params of base with those having the same
+// name and section as one of overlay replaced, followed by all other
+// params of overlay.
+func mergeParams(base []Param, overlay []Param) []Param {
+	result := append([]Param{}, base...)
+	for _, o := range overlay {
+		replaced := false
+		for idx, b := range result {
+			if b.Name == o.Name && b.Section == o.Section {
+				result[idx] = o
+				replaced = true
+			}
+		}
+		if !replaced {
+			result = append(result, o)
+		}
+	}
+	return result
+}
+
+// ResourceConfigHeader represents the header of a resource
+// file containing just the `meta`-section.
+type ResourceConfigHeader struct {
+	Meta ResourceMeta `yaml:"meta"`
+}
+
+// AllPipelines can be listed in meta.pipelines to include a template
+// in every pipeline including the default one.
+const AllPipelines = "*"
+
+func (r *ResourceConfigHeader) isRelevantForPipeline(pipeline string) bool {
+	if r.Meta.Pipelines == nil || len(r.Meta.Pipelines) == 0 {
+		return pipeline == ""
+	}
+	for _, p := range r.Meta.Pipelines {
+		if p == pipeline || p == AllPipelines {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ResourceConfigHeader) isRelevantForTeam(team string) bool {
+	if team == "" || len(r.Meta.Teams) == 0 {
+		return true
+	}
+	for _, t := range r.Meta.Teams {
+		if t == team {
+			return true
+		}
+	}
+	return false
+}
+
+// ResourceConfig is the content of a resource template file.
+type ResourceConfig struct {
+	Meta ResourceMeta           `yaml:"meta"`
+	Data map[string]interface{} `yaml:"data"`
+}
+
+// Resource is either a job, resource, etc. after the template
+// execution and YAML unmarshalling step.
+type Resource map[string]interface{}
+
+func (r Resource) String() string {
+	s, ok := r["name"].(string)
+	if !ok {
+		return fmt.Sprintf("<%v>", r["name"])
+	}
+	return s
+}
+
+// ResourceInstanceContext is the  context available during the
+// template-execution phase.
+type ResourceInstanceContext struct {
+	Instance string
+	// AllInstances lists all instances generated from the template
+	// including the current one.
+	AllInstances []string
+	Params       []Param
+	Pipeline     string
+	Args         map[string]interface{}
+	// SourcePath is the path of the template file being rendered.
+	SourcePath string
+	// Vars are the variables passed to piper, e.g. using --var.
+	Vars map[string]string
+
+	// paramSources are the params of the current instance by source
+	// in the order of their precedence.
+	paramSources [][]Param
+	// partials are the names of the partials currently being
+	// rendered with the innermost one being last.
+	partials []string
+	// allParams are the params of all instances of the template.
+	allParams map[string][]Param
+}
+
+func (rc *ResourceInstanceContext) Clone() ResourceInstanceContext {
+	params := make([]Param, 0, len(rc.Params))
+	for _, p := range rc.Params {
+		params = append(params, p)
+	}
+	return ResourceInstanceContext{
+		Pipeline:     rc.Pipeline,
+		Params:       params,
+		Instance:     rc.Instance,
+		AllInstances: rc.AllInstances,
+		SourcePath:   rc.SourcePath,
+		Vars:         rc.Vars,
+		partials:     append([]string{}, rc.partials...),
+		paramSources: rc.paramSources,
+		allParams:    rc.allParams,
+	}
+}
+
+// Pipeline is the data structure used for rendering out the
+// output document.
+type Pipeline struct {
+	Groups        []Resource `yaml:"groups"`
+	ResourceTypes []Resource `yaml:"resource_types"`
+	Resources     []Resource `yaml:"resources"`
+	Jobs          []Resource `yaml:"jobs"`
+	VarSources    []Resource `yaml:"var_sources,omitempty"`
+
+	// Origins records where each generated resource came from. It
+	// is not part of the generated output. Build indexes the origins
+	// for Origin, so IndexOrigins has to be called after modifying
+	// them.
+	Origins []Origin `yaml:"-"`
+
+	// originIndex maps the category and name of every origin to its
+	// last position within Origins.
+	originIndex map[string]map[string]int
+}
+
+// Origin describes the template a resource has been generated from.
+type Origin struct {
+	// Category is the folder the template was found in, e.g. "jobs".
+	Category string `yaml:"category"`
+	// Name is the name of the generated resource.
+	Name string `yaml:"name"`
+	// Path is the path of the template file.
+	Path string `yaml:"path"`
+	// Instance is the instance the resource was generated for.
+	Instance string `yaml:"instance"`
+	// Pipeline is the pipeline that was generated.
+	Pipeline string `yaml:"pipeline"`
+	// Meta is the rendered meta section of the template.
+	Meta ResourceMeta `yaml:"meta"`
+	// Inputs are glob patterns of further files the resource was
+	// generated from, e.g. the file of meta.instances_from or the
+	// pattern of meta.instances_glob.
+	Inputs []string `yaml:"inputs,omitempty"`
+
+	// duplicateOf is the origin of the entry whose name this entry
+	// shared before dedupNames renamed it.
+	duplicateOf *Origin
+}
+
+// IndexOrigins builds the index Origin uses to look up origins.
+func (p *Pipeline) IndexOrigins() {
+	p.originIndex = make(map[string]map[string]int)
+	for i, origin := range p.Origins {
+		names, ok := p.originIndex[origin.Category]
+		if !ok {
+			names = make(map[string]int)
+			p.originIndex[origin.Category] = names
+		}
+		names[origin.Name] = i
+	}
+}
+
+// Origin returns the origin of the resource with the given name
+// within the given category. If multiple resources share that name,
+// the origin of the last one is returned. Pipelines whose origins
+// haven't been indexed are searched linearly.
+func (p *Pipeline) Origin(category, name string) (Origin, bool) {
+	if p.originIndex != nil {
+		i, ok := p.originIndex[category][name]
+		if !ok || i >= len(p.Origins) {
+			return Origin{}, false
+		}
+		return p.Origins[i], true
+	}
+	for i := len(p.Origins) - 1; i >= 0; i-- {
+		if p.Origins[i].Category == category && p.Origins[i].Name == name {
+			return p.Origins[i], true
+		}
+	}
+	return Origin{}, false
+}
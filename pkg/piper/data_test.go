@@ -0,0 +1,231 @@
+package piper
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestResourceIsRelevantForPipeline(t *testing.T) {
+	tests := []struct {
+		resource ResourceConfigHeader
+		pipeline string
+		result   bool
+		message  string
+	}{
+		{
+			resource: ResourceConfigHeader{
+				Meta: ResourceMeta{
+					Pipelines: []string{},
+				},
+			},
+			pipeline: "",
+			result:   true,
+			message:  "If no pipeline is specified, a resource without any pipeline should match",
+		},
+		{
+			resource: ResourceConfigHeader{
+				Meta: ResourceMeta{
+					Pipelines: []string{},
+				},
+			},
+			pipeline: "p1",
+			result:   false,
+			message:  "If a pipeline is requested, a resource without any pipeline shouldn't match",
+		},
+		{
+			resource: ResourceConfigHeader{Meta: ResourceMeta{Pipelines: []string{"*"}}},
+			pipeline: "prod",
+			result:   true,
+			message:  "A resource for all pipelines should match prod",
+		},
+		{
+			resource: ResourceConfigHeader{Meta: ResourceMeta{Pipelines: []string{"*"}}},
+			pipeline: "staging",
+			result:   true,
+			message:  "A resource for all pipelines should match staging",
+		},
+		{
+			resource: ResourceConfigHeader{Meta: ResourceMeta{Pipelines: []string{"*"}}},
+			pipeline: "",
+			result:   true,
+			message:  "A resource for all pipelines should match if no pipeline is specified",
+		},
+		{
+			resource: ResourceConfigHeader{Meta: ResourceMeta{Pipelines: []string{"prod"}}},
+			pipeline: "",
+			result:   false,
+			message:  "A resource for a specific pipeline shouldn't match if no pipeline is specified",
+		},
+	}
+
+	for _, test := range tests {
+		result := test.resource.isRelevantForPipeline(test.pipeline)
+		if result != test.result {
+			t.Fatal(test.message)
+		}
+	}
+}
+
+func TestResourceIsRelevantForTeam(t *testing.T) {
+	tests := []struct {
+		teams  []string
+		team   string
+		result bool
+	}{
+		{teams: nil, team: "", result: true},
+		{teams: nil, team: "core", result: true},
+		{teams: []string{"core"}, team: "", result: true},
+		{teams: []string{"core", "web"}, team: "web", result: true},
+		{teams: []string{"core"}, team: "web", result: false},
+	}
+	for _, test := range tests {
+		header := ResourceConfigHeader{Meta: ResourceMeta{Teams: test.teams}}
+		require.Equal(t, test.result, header.isRelevantForTeam(test.team), "teams %v, team %q", test.teams, test.team)
+	}
+}
+
+func TestInlineInstanceParams(t *testing.T) {
+	var header ResourceConfigHeader
+	require.NoError(t, yaml.Unmarshal([]byte(`meta:
+  name_template: deploy-{{ .Instance }}
+  instances:
+  - plain
+  - name: inline
+    params:
+    - name: region
+      value: eu
+    - name: size
+      value: large
+  params:
+    plain:
+    - name: region
+      value: us
+    inline:
+    - name: region
+      value: us
+    - name: zone
+      value: a
+`), &header))
+	require.Equal(t, []string{"plain", "inline"}, header.Meta.AllInstances())
+	require.Equal(t, map[string][]Param{
+		"plain": {{Name: "region", Value: "us"}},
+		"inline": {
+			{Name: "region", Value: "eu"},
+			{Name: "zone", Value: "a"},
+			{Name: "size", Value: "large"},
+		},
+	}, header.Meta.Params)
+
+	require.Error(t, yaml.Unmarshal([]byte("meta:\n  instances:\n  - params: []\n"), &header))
+}
+
+func TestResourceMarshalIsDeterministic(t *testing.T) {
+	newResource := func() Resource {
+		return Resource{
+			"name": "source",
+			"type": "git",
+			"source": map[string]interface{}{
+				"uri":    "https://example.org/repo.git",
+				"branch": "master",
+				"nested": map[interface{}]interface{}{
+					"z": 1,
+					"a": []interface{}{
+						map[string]interface{}{"y": true, "b": false, "m": nil},
+					},
+					"k": map[string]interface{}{"3": "c", "1": "a", "2": "b"},
+				},
+			},
+			"check_every": "1m",
+		}
+	}
+	first, err := yaml.Marshal(newResource())
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		again, err := yaml.Marshal(newResource())
+		require.NoError(t, err)
+		require.Equal(t, string(first), string(again))
+	}
+	require.Equal(t, `check_every: 1m
+name: source
+source:
+  branch: master
+  nested:
+    a:
+    - b: false
+      m: null
+      "y": true
+    k:
+      "1": a
+      "2": b
+      "3": c
+    z: 1
+  uri: https://example.org/repo.git
+type: git
+`, string(first))
+}
+
+func TestResourceMarshalMatchesYAML(t *testing.T) {
+	r := Resource{
+		"name": "source",
+		"a10":  "ten",
+		"a2":   "two",
+		"params": map[interface{}]interface{}{
+			10:    "ten",
+			2:     "two",
+			"a10": map[string]interface{}{"b10": 1, "b2": 2},
+			"a2":  true,
+		},
+	}
+	expected, err := yaml.Marshal(map[string]interface{}(r))
+	require.NoError(t, err)
+	actual, err := yaml.Marshal(r)
+	require.NoError(t, err)
+	require.Equal(t, string(expected), string(actual))
+	require.True(t, strings.HasPrefix(string(actual), "a2: two\na10: ten\n"), string(actual))
+	require.Contains(t, string(actual), "  2: two\n  10: ten\n")
+
+	expected, err = yaml.Marshal([]map[string]interface{}{r})
+	require.NoError(t, err)
+	p := &Pipeline{Resources: []Resource{r}, Origins: []Origin{{Category: "resources", Name: "source", Meta: ResourceMeta{Comment: "Commented"}}}}
+	out, err := MarshalCategory(p, "resources", MarshalOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "resources:\n# Commented\n"+string(expected), string(out), "Marshalling keys one by one should keep yaml.v2's order")
+}
+
+func TestMergeParams(t *testing.T) {
+	base := []Param{
+		{Name: "branch", Value: "main", Section: "git"},
+		{Name: "branch", Value: "develop", Section: "docs"},
+		{Name: "replicas", Value: "1"},
+	}
+	overlay := []Param{
+		{Name: "branch", Value: "release", Section: "git"},
+		{Name: "replicas", Value: "3", Section: "deploy"},
+	}
+	require.Equal(t, []Param{
+		{Name: "branch", Value: "release", Section: "git"},
+		{Name: "branch", Value: "develop", Section: "docs"},
+		{Name: "replicas", Value: "1"},
+		{Name: "replicas", Value: "3", Section: "deploy"},
+	}, mergeParams(base, overlay))
+	require.Len(t, base, 3, "base should not be modified")
+	require.Equal(t, "main", base[0].Value)
+
+	var meta ResourceMeta
+	require.NoError(t, yaml.Unmarshal([]byte(`instances:
+- name: api
+  params:
+  - {name: branch, value: release, section: git}
+params:
+  api:
+  - {name: branch, value: main, section: git}
+  - {name: branch, value: develop, section: docs}
+`), &meta))
+	require.Equal(t, []Param{
+		{Name: "branch", Value: "release", Section: "git"},
+		{Name: "branch", Value: "develop", Section: "docs"},
+	}, meta.Params["api"], "Inline params should only replace params of the same section")
+}
@@ -0,0 +1,164 @@
+package piper
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// dedupNames renames entries of a category whose name is already used
+// by an earlier entry by appending "-2", "-3", etc. resources and
+// origins have to be aligned, i.e. origins[i] describes resources[i].
+// References to a renamed entry from entries generated by the same
+// template file are updated as well: the passed constraints of jobs
+// and the type of resource types. All other references keep pointing
+// to the first entry of that name, see checkDedupReferences.
+func dedupNames(log *logrus.Logger, category string, resources []Resource, origins []Origin) {
+	used := make(map[string]struct{}, len(resources))
+	for _, r := range resources {
+		used[r.String()] = struct{}{}
+	}
+	first := make(map[string]int, len(resources))
+	renamed := make(map[string]map[string]string)
+	for idx, r := range resources {
+		name := r.String()
+		firstIdx, exists := first[name]
+		if !exists {
+			first[name] = idx
+			continue
+		}
+		var newName string
+		for n := 2; ; n++ {
+			newName = fmt.Sprintf("%s-%d", name, n)
+			if _, exists := used[newName]; !exists {
+				break
+			}
+		}
+		used[newName] = struct{}{}
+		first[newName] = idx
+		r["name"] = newName
+		origins[idx].Name = newName
+		firstOrigin := origins[firstIdx]
+		origins[idx].duplicateOf = &firstOrigin
+		log.Warnf("Renamed %s %s generated from %s to %s as the name is already taken", category, name, origins[idx].Path, newName)
+		file := origins[idx].Path
+		if renamed[file] == nil {
+			renamed[file] = make(map[string]string)
+		}
+		renamed[file][name] = newName
+	}
+	if len(renamed) == 0 {
+		return
+	}
+	for idx, r := range resources {
+		names, ok := renamed[origins[idx].Path]
+		if !ok {
+			continue
+		}
+		switch category {
+		case "resource_types":
+			if t, ok := r["type"].(string); ok {
+				if newName, ok := names[t]; ok {
+					r["type"] = newName
+				}
+			}
+		case "jobs":
+			rewritePassed := func(s step) {
+				passed := stringList(s.get("passed"))
+				if passed == nil {
+					return
+				}
+				result := make([]interface{}, 0, len(passed))
+				for _, name := range passed {
+					if newName, ok := names[name]; ok {
+						name = newName
+					}
+					result = append(result, name)
+				}
+				s.set("passed", result)
+			}
+			visitSteps(r["plan"], rewritePassed)
+			for _, key := range jobHookKeys {
+				visitSteps(r[key], rewritePassed)
+			}
+		}
+	}
+}
+
+// reference is a reference from one entry of a pipeline to another.
+type reference struct {
+	category     string
+	name         string
+	fromCategory string
+	fromName     string
+}
+
+// pipelineReferences lists all references between the entries of the
+// pipeline: the type of resources and resource types, the resources
+// of get and put steps, the jobs of passed constraints, and the jobs,
+// resources, and resource types of groups.
+func pipelineReferences(p *Pipeline) []reference {
+	var result []reference
+	addType := func(category string, resources []Resource) {
+		for _, r := range resources {
+			if t, ok := r["type"].(string); ok {
+				result = append(result, reference{"resource_types", t, category, r.String()})
+			}
+		}
+	}
+	addType("resource_types", p.ResourceTypes)
+	addType("resources", p.Resources)
+	for _, job := range p.Jobs {
+		for _, key := range append([]string{"plan"}, jobHookKeys...) {
+			visitSteps(job[key], func(s step) {
+				for _, kind := range []string{"get", "put"} {
+					name, ok := s.get(kind).(string)
+					if !ok {
+						continue
+					}
+					if resource, ok := s.get("resource").(string); ok {
+						name = resource
+					}
+					result = append(result, reference{"resources", name, "jobs", job.String()})
+					for _, passed := range stringList(s.get("passed")) {
+						result = append(result, reference{"jobs", passed, "jobs", job.String()})
+					}
+				}
+			})
+		}
+	}
+	for _, group := range p.Groups {
+		for _, category := range []string{"jobs", "resources", "resource_types"} {
+			for _, name := range stringList(group[category]) {
+				result = append(result, reference{category, name, "groups", group.String()})
+			}
+		}
+	}
+	return result
+}
+
+// checkDedupReferences makes sure that no entry refers to the name an
+// entry renamed by dedupNames shared with another entry unless it was
+// generated by the same template file as one of them. Otherwise it is
+// unclear which of them the reference was meant for.
+func checkDedupReferences(p *Pipeline) error {
+	var errs Errors
+	references := pipelineReferences(p)
+	for _, origin := range p.Origins {
+		first := origin.duplicateOf
+		if first == nil {
+			continue
+		}
+		for _, ref := range references {
+			if ref.category != origin.Category || ref.name != first.Name {
+				continue
+			}
+			from, ok := p.Origin(ref.fromCategory, ref.fromName)
+			if !ok || from.Path == first.Path || from.Path == origin.Path {
+				continue
+			}
+			errs = append(errs, fmt.Errorf("%s %s generated from %s refers to %s %s, which is generated by both %s and %s (renamed to %s)", ref.fromCategory, ref.fromName, from.Path, ref.category, ref.name, first.Path, origin.Path, origin.Name))
+		}
+	}
+	return errs.orNil()
+}
@@ -0,0 +1,57 @@
+package piper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupNames(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/resources/source.yml", []byte("meta:\n  name: source\ndata:\n  type: git"), 0600)
+	afero.WriteFile(fs, "/jobs/a.yml", []byte("meta:\n  name: build\ndata:\n  plan: [{get: source}]\n---\nmeta:\n  name: deploy\ndata:\n  plan: [{get: source, passed: [build]}]"), 0600)
+	afero.WriteFile(fs, "/jobs/b.yml", []byte("meta:\n  name: build\ndata:\n  plan: [{get: source}]\n---\nmeta:\n  name: test\ndata:\n  plan: [{get: source, passed: [build]}]"), 0600)
+	afero.WriteFile(fs, "/jobs/c.yml", []byte("meta:\n  name: build-2\ndata:\n  serial: true"), 0600)
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	require.Error(t, Validate(result), "Without deduplication both jobs are called build")
+
+	result, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, DedupNames: true, Log: log})
+	require.NoError(t, err)
+	require.NoError(t, Validate(result))
+	names := make([]string, 0, len(result.Jobs))
+	for _, job := range result.Jobs {
+		names = append(names, job.String())
+	}
+	require.Equal(t, []string{"build", "deploy", "build-3", "test", "build-2"}, names)
+	require.Equal(t, []string{"build"}, ScanPlan(result.Jobs[1])[0].Passed)
+	require.Equal(t, []string{"build-3"}, ScanPlan(result.Jobs[3])[0].Passed)
+	origin, ok := result.Origin("jobs", "build-3")
+	require.True(t, ok)
+	require.Equal(t, "/jobs/b.yml", origin.Path)
+
+	// The type of resource types generated by the same file is
+	// rewritten as well.
+	afero.WriteFile(fs, "/resource_types/a.yml", []byte("meta:\n  name: base\ndata:\n  type: registry-image"), 0600)
+	afero.WriteFile(fs, "/resource_types/b.yml", []byte("meta:\n  name: base\ndata:\n  type: registry-image\n---\nmeta:\n  name: wrapper\ndata:\n  type: base"), 0600)
+	result, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, DedupNames: true, Log: log})
+	require.NoError(t, err)
+	require.Equal(t, []Resource{
+		{"name": "base", "type": "registry-image"},
+		{"name": "base-2", "type": "registry-image"},
+		{"name": "wrapper", "type": "base-2"},
+	}, result.ResourceTypes)
+
+	// References from other files can't tell the entries apart.
+	afero.WriteFile(fs, "/resources/other.yml", []byte("meta:\n  name: source\ndata:\n  type: git"), 0600)
+	_, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, DedupNames: true, Log: log})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "jobs build generated from /jobs/a.yml refers to resources source, which is generated by both /resources/other.yml and /resources/source.yml (renamed to source-2)")
+}
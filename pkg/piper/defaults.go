@@ -0,0 +1,47 @@
+package piper
+
+import (
+	"fmt"
+
+	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// LoadDefaults reads a YAML map of keys to be used as
+// Options.ResourceDefaults or Options.JobDefaults. As every entry has
+// its own name, the defaults may not contain one.
+func LoadDefaults(fs afero.Fs, path string) (Resource, error) {
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	var defaults Resource
+	if err := yaml.UnmarshalStrict(data, &defaults); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if _, ok := defaults["name"]; ok {
+		return nil, fmt.Errorf("failed to parse %s: defaults must not contain a name", path)
+	}
+	return defaults, nil
+}
+
+// applyDefaults adds every key of defaults that is missing from an
+// entry to it. Each entry gets its own copy of the default values so
+// that later modifications of one entry don't affect the others.
+func applyDefaults(entries []Resource, defaults Resource) error {
+	if len(defaults) == 0 {
+		return nil
+	}
+	for _, entry := range entries {
+		copied, err := copyResources([]Resource{defaults})
+		if err != nil {
+			return err
+		}
+		for key, value := range copied[0] {
+			if _, ok := entry[key]; !ok {
+				entry[key] = value
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package piper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaults(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/resources/source.yml", []byte("meta:\n  name: source\ndata:\n  type: git\n  check_every: 1m"), 0600)
+	afero.WriteFile(fs, "/resources/image.yml", []byte("meta:\n  name: image\ndata:\n  type: registry-image"), 0600)
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n  plan: [{get: source}]"), 0600)
+	afero.WriteFile(fs, "/defaults/resources.yml", []byte("check_every: 24h\nsource:\n  uri: https://example.com\n"), 0600)
+	afero.WriteFile(fs, "/defaults/jobs.yml", []byte("serial: true\nplan: []\n"), 0600)
+	afero.WriteFile(fs, "/defaults/named.yml", []byte("name: default\n"), 0600)
+
+	resourceDefaults, err := LoadDefaults(fs, "/defaults/resources.yml")
+	require.NoError(t, err)
+	jobDefaults, err := LoadDefaults(fs, "/defaults/jobs.yml")
+	require.NoError(t, err)
+	_, err = LoadDefaults(fs, "/defaults/named.yml")
+	require.EqualError(t, err, "failed to parse /defaults/named.yml: defaults must not contain a name")
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, ResourceDefaults: resourceDefaults, JobDefaults: jobDefaults, Log: log})
+	require.NoError(t, err)
+	require.Len(t, result.Resources, 2)
+	require.Equal(t, "24h", result.Resources[0]["check_every"], "image should get the default")
+	require.Equal(t, "1m", result.Resources[1]["check_every"], "source should keep its own value")
+	require.Equal(t, true, result.Jobs[0]["serial"])
+	require.Len(t, result.Jobs[0]["plan"], 1, "build should keep its own plan")
+
+	result.Resources[0]["source"].(map[interface{}]interface{})["uri"] = "changed"
+	require.Equal(t, "https://example.com", result.Resources[1]["source"].(map[interface{}]interface{})["uri"], "every resource should get its own copy of the defaults")
+}
@@ -0,0 +1,74 @@
+package piper
+
+import (
+	"bytes"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Change kinds reported by Diff.
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// Change describes an entry that differs between two pipelines.
+type Change struct {
+	// Kind is one of ChangeAdded, ChangeRemoved, or ChangeModified.
+	Kind     string
+	Category string
+	Name     string
+}
+
+// Diff compares the entries of both pipelines by name within every
+// category and returns those that only exist in one of them or whose
+// content differs. Added and modified entries are listed in the order
+// of updated, removed ones in the order of current.
+func Diff(current, updated *Pipeline) ([]Change, error) {
+	changes := make([]Change, 0, 5)
+	for _, category := range []string{"groups", "resource_types", "resources", "jobs", "var_sources"} {
+		before, _ := current.category(category)
+		after, _ := updated.category(category)
+		existing := make(map[string]Resource, len(before))
+		for _, r := range before {
+			existing[r.String()] = r
+		}
+		remaining := nameSet(after)
+		for _, r := range after {
+			old, ok := existing[r.String()]
+			if !ok {
+				changes = append(changes, Change{Kind: ChangeAdded, Category: category, Name: r.String()})
+				continue
+			}
+			equal, err := equalResources(old, r)
+			if err != nil {
+				return nil, err
+			}
+			if !equal {
+				changes = append(changes, Change{Kind: ChangeModified, Category: category, Name: r.String()})
+			}
+		}
+		for _, r := range before {
+			if _, ok := remaining[r.String()]; !ok {
+				changes = append(changes, Change{Kind: ChangeRemoved, Category: category, Name: r.String()})
+			}
+		}
+	}
+	return changes, nil
+}
+
+// equalResources compares both resources by their YAML representation
+// so that differences in the Go types used for the same values, e.g.
+// []string and []interface{}, don't count as change.
+func equalResources(a, b Resource) (bool, error) {
+	dataA, err := yaml.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	dataB, err := yaml.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(dataA, dataB), nil
+}
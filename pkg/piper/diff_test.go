@@ -0,0 +1,47 @@
+package piper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestDiff(t *testing.T) {
+	var current Pipeline
+	require.NoError(t, yaml.Unmarshal([]byte(`
+groups:
+- name: all
+  jobs: [build, test]
+resources:
+- name: source
+  type: git
+- name: old-image
+  type: registry-image
+jobs:
+- name: build
+  plan: [{get: source}]
+- name: test
+  plan: [{get: source, trigger: true}]
+`), &current))
+	updated := &Pipeline{
+		Groups:    []Resource{{"name": "all", "jobs": []string{"build", "test"}}},
+		Resources: []Resource{{"name": "source", "type": "git"}, {"name": "image", "type": "registry-image"}},
+		Jobs: []Resource{
+			{"name": "build", "plan": []interface{}{map[string]interface{}{"get": "source"}}},
+			{"name": "test", "plan": []interface{}{map[string]interface{}{"get": "source", "trigger": false}}},
+		},
+	}
+
+	changes, err := Diff(&current, updated)
+	require.NoError(t, err)
+	require.Equal(t, []Change{
+		{Kind: ChangeAdded, Category: "resources", Name: "image"},
+		{Kind: ChangeRemoved, Category: "resources", Name: "old-image"},
+		{Kind: ChangeModified, Category: "jobs", Name: "test"},
+	}, changes)
+
+	changes, err = Diff(updated, updated)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+}
@@ -0,0 +1,75 @@
+package piper
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Phase names the step of the generation in which an error occurred.
+type Phase string
+
+const (
+	// PhaseHeader is the parsing of a template's meta section.
+	PhaseHeader Phase = "header"
+	// PhaseParse is the parsing of a template.
+	PhaseParse Phase = "parse"
+	// PhaseRender is the execution of a template.
+	PhaseRender Phase = "render"
+	// PhaseUnmarshal is the unmarshalling of a rendered template.
+	PhaseUnmarshal Phase = "unmarshal"
+)
+
+// GenerationError is returned if a template file could not be turned
+// into resources.
+type GenerationError struct {
+	// Path is the path of the template file.
+	Path string
+	// Instance is the instance that was generated. It is empty for
+	// errors that are not specific to an instance.
+	Instance string
+	// Phase is the step in which the error occurred.
+	Phase Phase
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *GenerationError) Error() string {
+	if e.Instance == "" {
+		return fmt.Sprintf("%s: %s failed: %s", e.Path, e.Phase, e.Err.Error())
+	}
+	return fmt.Sprintf("%s (instance %s): %s failed: %s", e.Path, e.Instance, e.Phase, e.Err.Error())
+}
+
+// Unwrap returns the underlying error.
+func (e *GenerationError) Unwrap() error {
+	return e.Err
+}
+
+// Errors combines errors that occurred independently of each other,
+// e.g. while loading different categories.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// orNil returns nil if there are no errors and the only error if
+// there is just one. Otherwise the errors are returned sorted by
+// their message.
+func (e Errors) orNil() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	}
+	sort.Slice(e, func(i, j int) bool {
+		return e[i].Error() < e[j].Error()
+	})
+	return e
+}
@@ -0,0 +1,111 @@
+package piper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// stepFeatures maps keys of steps to the first Concourse version
+// supporting them.
+var stepFeatures = []struct {
+	key     string
+	version string
+}{
+	{"in_parallel", "5.3.0"},
+	{"set_pipeline", "5.8.0"},
+	{"load_var", "6.0.0"},
+	{"across", "6.5.0"},
+}
+
+// keyFeatures maps top-level keys of entries to the first Concourse
+// version supporting them.
+var keyFeatures = map[string][]struct {
+	key     string
+	version string
+}{
+	"resources": {{"icon", "5.0.0"}},
+}
+
+// varSourcesVersion is the first Concourse version supporting
+// var_sources.
+const varSourcesVersion = "5.8.0"
+
+// CheckConcourseVersion reports every feature used by the pipeline
+// that the given Concourse version doesn't support yet. All findings
+// are reported together. Only a small set of well-known features is
+// checked, so a pipeline passing this check might still be rejected.
+func CheckConcourseVersion(p *Pipeline, target ConcourseVersion) error {
+	unsupported := func(version string) bool {
+		v, _ := ParseConcourseVersion(version)
+		return target.compare(v) < 0
+	}
+	var errs Errors
+	if len(p.VarSources) > 0 && unsupported(varSourcesVersion) {
+		errs = append(errs, fmt.Errorf("var_sources require Concourse %s or newer", varSourcesVersion))
+	}
+	for category, features := range keyFeatures {
+		resources, _ := p.category(category)
+		for _, r := range resources {
+			for _, feature := range features {
+				if _, used := r[feature.key]; used && unsupported(feature.version) {
+					errs = append(errs, fmt.Errorf("%s: %s uses %s which requires Concourse %s or newer", category, r, feature.key, feature.version))
+				}
+			}
+		}
+	}
+	for _, job := range p.Jobs {
+		used := make(map[string]struct{})
+		collect := func(s step) {
+			for _, feature := range stepFeatures {
+				if s.get(feature.key) != nil {
+					used[feature.key] = struct{}{}
+				}
+			}
+		}
+		visitSteps(job["plan"], collect)
+		for _, key := range jobHookKeys {
+			visitSteps(job[key], collect)
+		}
+		for _, feature := range stepFeatures {
+			if _, ok := used[feature.key]; ok && unsupported(feature.version) {
+				errs = append(errs, fmt.Errorf("jobs: %s uses %s which requires Concourse %s or newer", job, feature.key, feature.version))
+			}
+		}
+	}
+	return errs.orNil()
+}
+
+// ConcourseVersion is the major, minor, and patch version of a
+// Concourse release.
+type ConcourseVersion [3]int
+
+// ParseConcourseVersion parses a version like 6.7.1. Missing minor or
+// patch versions are treated as 0.
+func ParseConcourseVersion(version string) (ConcourseVersion, error) {
+	var result ConcourseVersion
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) > 3 {
+		return result, fmt.Errorf("invalid version %s: expected X.Y.Z", version)
+	}
+	for idx, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return result, fmt.Errorf("invalid version %s: expected X.Y.Z", version)
+		}
+		result[idx] = n
+	}
+	return result, nil
+}
+
+func (v ConcourseVersion) compare(other ConcourseVersion) int {
+	for idx := range v {
+		switch {
+		case v[idx] < other[idx]:
+			return -1
+		case v[idx] > other[idx]:
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+package piper
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConcourseVersion(t *testing.T) {
+	p := &Pipeline{
+		Resources: []Resource{
+			{"name": "source", "type": "git", "icon": "github"},
+		},
+		Jobs: []Resource{
+			{"name": "build", "plan": []interface{}{
+				map[interface{}]interface{}{"in_parallel": []interface{}{
+					map[interface{}]interface{}{"get": "source"},
+					map[interface{}]interface{}{"task": "test", "across": []interface{}{}},
+				}},
+				map[interface{}]interface{}{"task": "lint", "across": []interface{}{}},
+			}},
+			{"name": "deploy", "plan": []interface{}{}, "ensure": map[interface{}]interface{}{"set_pipeline": "self"}},
+		},
+		VarSources: []Resource{
+			{"name": "vault", "type": "vault"},
+		},
+	}
+
+	require.NoError(t, CheckConcourseVersion(p, ConcourseVersion{7, 4, 0}))
+
+	err := CheckConcourseVersion(p, ConcourseVersion{5, 8, 0})
+	require.EqualError(t, err, "jobs: build uses across which requires Concourse 6.5.0 or newer")
+
+	err = CheckConcourseVersion(p, ConcourseVersion{4, 2, 1})
+	var errs Errors
+	require.True(t, errors.As(err, &errs))
+	require.Equal(t, []string{
+		"jobs: build uses across which requires Concourse 6.5.0 or newer",
+		"jobs: build uses in_parallel which requires Concourse 5.3.0 or newer",
+		"jobs: deploy uses set_pipeline which requires Concourse 5.8.0 or newer",
+		"resources: source uses icon which requires Concourse 5.0.0 or newer",
+		"var_sources require Concourse 5.8.0 or newer",
+	}, errorMessages(errs))
+}
+
+func TestParseConcourseVersion(t *testing.T) {
+	for input, expected := range map[string]ConcourseVersion{
+		"6.7.1":  {6, 7, 1},
+		"v7.4.0": {7, 4, 0},
+		"5.8":    {5, 8, 0},
+		"7":      {7, 0, 0},
+	} {
+		v, err := ParseConcourseVersion(input)
+		require.NoError(t, err)
+		require.Equal(t, expected, v)
+	}
+	for _, input := range []string{"", "latest", "1.2.3.4", "6.x", "6.-1"} {
+		_, err := ParseConcourseVersion(input)
+		require.Error(t, err, input)
+	}
+}
+
+func errorMessages(errs Errors) []string {
+	result := make([]string, 0, len(errs))
+	for _, err := range errs {
+		result = append(result, err.Error())
+	}
+	return result
+}
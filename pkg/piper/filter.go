@@ -0,0 +1,148 @@
+package piper
+
+import (
+	"fmt"
+	"path"
+)
+
+// filterNames removes all groups, resource types, resources, jobs, and
+// var sources whose name doesn't match the given glob pattern together
+// with their origins. References to removed entries are kept unless
+// prune is set, in which case they are removed as well: get and put
+// steps of removed resources, passed constraints on removed jobs, and
+// the names of removed entries within groups. Var sources are only
+// referenced from within ((var)) placeholders, which are never
+// removed.
+func filterNames(p *Pipeline, pattern string, prune bool) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid name filter %s: %w", pattern, err)
+	}
+	keep := func(resources []Resource) []Resource {
+		result := make([]Resource, 0, len(resources))
+		for _, r := range resources {
+			if matched, _ := path.Match(pattern, r.String()); matched {
+				result = append(result, r)
+			}
+		}
+		return result
+	}
+	p.Groups = keep(p.Groups)
+	p.ResourceTypes = keep(p.ResourceTypes)
+	p.Resources = keep(p.Resources)
+	p.Jobs = keep(p.Jobs)
+	if p.VarSources != nil {
+		// var_sources are left out entirely unless there are any.
+		if p.VarSources = keep(p.VarSources); len(p.VarSources) == 0 {
+			p.VarSources = nil
+		}
+	}
+
+	remaining := map[string]map[string]struct{}{
+		"groups":         nameSet(p.Groups),
+		"jobs":           nameSet(p.Jobs),
+		"resources":      nameSet(p.Resources),
+		"resource_types": nameSet(p.ResourceTypes),
+		"var_sources":    nameSet(p.VarSources),
+	}
+	origins := make([]Origin, 0, len(p.Origins))
+	for _, origin := range p.Origins {
+		if _, ok := remaining[origin.Category][origin.Name]; ok {
+			origins = append(origins, origin)
+		}
+	}
+	p.Origins = origins
+	p.IndexOrigins()
+	if !prune {
+		return nil
+	}
+
+	for _, group := range p.Groups {
+		for _, key := range []string{"jobs", "resources", "resource_types"} {
+			names := remaining[key]
+			if value, ok := group[key]; ok {
+				group[key] = pruneNames(value, names)
+			}
+		}
+	}
+	for _, job := range p.Jobs {
+		for _, key := range append([]string{"plan"}, jobHookKeys...) {
+			value, ok := job[key]
+			if !ok {
+				continue
+			}
+			if pruned, keep := pruneSteps(value, remaining["resources"], remaining["jobs"]); keep {
+				job[key] = pruned
+			} else {
+				delete(job, key)
+			}
+		}
+	}
+	return nil
+}
+
+// pruneNames returns the names of the given list that are part of
+// names. Values that are not a list of names are returned unchanged.
+func pruneNames(value interface{}, names map[string]struct{}) interface{} {
+	list := stringList(value)
+	if list == nil {
+		return value
+	}
+	result := make([]interface{}, 0, len(list))
+	for _, name := range list {
+		if _, ok := names[name]; ok {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// pruneSteps removes all get and put steps from node that operate on
+// resources not part of resources and removes jobs not part of jobs
+// from passed constraints. The second return value is false if node
+// itself is a step that has to be removed.
+func pruneSteps(node interface{}, resources, jobs map[string]struct{}) (interface{}, bool) {
+	var s step
+	switch n := node.(type) {
+	case []interface{}:
+		result := make([]interface{}, 0, len(n))
+		for _, item := range n {
+			if pruned, keep := pruneSteps(item, resources, jobs); keep {
+				result = append(result, pruned)
+			}
+		}
+		return result, true
+	case map[string]interface{}:
+		s = step{m: n}
+	case map[interface{}]interface{}:
+		s = step{im: n}
+	default:
+		return node, true
+	}
+	for _, kind := range []string{"get", "put"} {
+		name, ok := s.get(kind).(string)
+		if !ok {
+			continue
+		}
+		if resource, ok := s.get("resource").(string); ok {
+			name = resource
+		}
+		if _, exists := resources[name]; !exists {
+			return nil, false
+		}
+		if passed := s.get("passed"); passed != nil {
+			s.set("passed", pruneNames(passed, jobs))
+		}
+	}
+	for _, key := range nestedStepKeys {
+		nested := s.get(key)
+		if nested == nil {
+			continue
+		}
+		if pruned, keep := pruneSteps(nested, resources, jobs); keep {
+			s.set(key, pruned)
+		} else {
+			s.delete(key)
+		}
+	}
+	return node, true
+}
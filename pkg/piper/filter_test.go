@@ -0,0 +1,97 @@
+package piper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const filterTestPipeline = `
+groups:
+- name: api
+  jobs: [api-build, web-build]
+  resources: [api-source, web-source]
+resource_types:
+- name: slack
+resources:
+- name: api-source
+- name: web-source
+- name: api-image
+jobs:
+- name: api-build
+  plan:
+  - in_parallel:
+    - get: api-source
+    - get: web-source
+      passed: [web-build]
+  - put: api-image
+  on_failure:
+    put: web-source
+- name: web-build
+  plan:
+  - get: web-source
+var_sources:
+- name: api-vault
+- name: web-vault
+`
+
+func entryNames(resources []Resource) []string {
+	result := make([]string, 0, len(resources))
+	for _, r := range resources {
+		result = append(result, r.String())
+	}
+	return result
+}
+
+func TestFilterNames(t *testing.T) {
+	var p Pipeline
+	require.NoError(t, yaml.Unmarshal([]byte(filterTestPipeline), &p))
+	p.Origins = []Origin{
+		{Category: "jobs", Name: "api-build"},
+		{Category: "jobs", Name: "web-build"},
+		{Category: "resources", Name: "api-source"},
+		{Category: "var_sources", Name: "api-vault"},
+		{Category: "var_sources", Name: "web-vault"},
+	}
+	require.NoError(t, filterNames(&p, "api*", false))
+	require.Equal(t, []string{"api"}, entryNames(p.Groups))
+	require.Equal(t, []string{"api-vault"}, entryNames(p.VarSources))
+	require.Equal(t, []Origin{
+		{Category: "jobs", Name: "api-build"},
+		{Category: "resources", Name: "api-source"},
+		{Category: "var_sources", Name: "api-vault"},
+	}, p.Origins)
+	_, ok := p.Origin("jobs", "web-build")
+	require.False(t, ok, "Origins of removed entries are dropped")
+	require.Empty(t, p.ResourceTypes)
+	require.Equal(t, []string{"api-source", "api-image"}, entryNames(p.Resources))
+	require.Equal(t, []string{"api-build"}, entryNames(p.Jobs))
+	require.Equal(t, []interface{}{"api-build", "web-build"}, p.Groups[0]["jobs"], "References are kept by default")
+	require.Len(t, ScanPlan(p.Jobs[0]), 3)
+
+	p = Pipeline{}
+	require.NoError(t, yaml.Unmarshal([]byte(filterTestPipeline), &p))
+	require.NoError(t, filterNames(&p, "*-build", false))
+	require.Empty(t, p.Groups)
+	require.Empty(t, p.Resources)
+	require.Equal(t, []string{"api-build", "web-build"}, entryNames(p.Jobs))
+	require.Nil(t, p.VarSources, "var_sources are left out if none remain")
+
+	require.Error(t, filterNames(&p, "[", false))
+}
+
+func TestFilterNamesPrune(t *testing.T) {
+	var p Pipeline
+	require.NoError(t, yaml.Unmarshal([]byte(filterTestPipeline), &p))
+	require.NoError(t, filterNames(&p, "api*", true))
+	require.Equal(t, []interface{}{"api-build"}, p.Groups[0]["jobs"])
+	require.Equal(t, []interface{}{"api-source"}, p.Groups[0]["resources"])
+	require.Equal(t, []PlanStep{
+		{Kind: "get", Name: "api-source", Resource: "api-source"},
+		{Kind: "put", Name: "api-image", Resource: "api-image"},
+	}, ScanPlan(p.Jobs[0]))
+	_, ok := p.Jobs[0]["on_failure"]
+	require.False(t, ok, "Hooks consisting of a removed step are removed")
+	require.NoError(t, Validate(&p))
+}
@@ -0,0 +1,478 @@
+package piper
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func indent(data string, offset int) string {
+	lines := make([]string, 0, 5)
+	for idx, line := range strings.Split(data, "\n") {
+		if idx == 0 {
+			lines = append(lines, line)
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s%s", strings.Repeat(" ", offset), line))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// nindent prepends a newline to data and indents all of its lines by
+// offset spaces, so that a block starts on its own line.
+func nindent(offset int, data string) string {
+	return "\n" + strings.Repeat(" ", offset) + indent(data, offset)
+}
+
+func ite(condition bool, trueValue interface{}, falseValue interface{}) interface{} {
+	if condition {
+		return trueValue
+	}
+	return falseValue
+}
+
+// replace replaces all occurrences of old within s with new.
+func replace(old, new, s string) string {
+	return strings.Replace(s, old, new, -1)
+}
+
+// regexReplace replaces all matches of pattern within s with repl.
+// repl may reference submatches using $1 etc.
+func regexReplace(pattern, repl, s string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(s, repl), nil
+}
+
+// squote wraps s in single quotes so that it is treated as string
+// scalar by YAML.
+func squote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// trunc shortens s to its first n characters. A negative n keeps the
+// last -n characters instead.
+func trunc(n int, s string) string {
+	runes := []rune(s)
+	switch {
+	case n >= 0 && n < len(runes):
+		return string(runes[:n])
+	case n < 0 && -n < len(runes):
+		return string(runes[len(runes)+n:])
+	}
+	return s
+}
+
+func b64enc(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// b64dec decodes the given base64 string. Invalid input results in
+// an error instead of partially decoded data.
+func b64dec(s string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("b64dec: %w", err)
+	}
+	return string(data), nil
+}
+
+// isEmpty reports whether value is nil, false, a numeric zero, or a
+// string, slice, map, or array of length zero.
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// defaultValue returns def if value is empty as defined by isEmpty.
+func defaultValue(def interface{}, value interface{}) interface{} {
+	if isEmpty(value) {
+		return def
+	}
+	return value
+}
+
+// coalesce returns the first value that is not empty as defined by
+// isEmpty or nil if all of them are empty.
+func coalesce(values ...interface{}) interface{} {
+	for _, v := range values {
+		if !isEmpty(v) {
+			return v
+		}
+	}
+	return nil
+}
+
+// uniq returns the distinct elements of the given list in the order
+// they are first seen in.
+func uniq(list interface{}) (interface{}, error) {
+	switch l := list.(type) {
+	case []string:
+		result := make([]string, 0, len(l))
+		seen := make(map[string]struct{}, len(l))
+		for _, item := range l {
+			if _, exists := seen[item]; exists {
+				continue
+			}
+			seen[item] = struct{}{}
+			result = append(result, item)
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, 0, len(l))
+		for _, item := range l {
+			duplicate := false
+			for _, existing := range result {
+				if reflect.DeepEqual(existing, item) {
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				result = append(result, item)
+			}
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("uniq expects a list but got %T", list)
+}
+
+// toList converts any kind of slice or array into a list of
+// interfaces. nil is treated as an empty list.
+func toList(value interface{}) ([]interface{}, error) {
+	if value == nil {
+		return []interface{}{}, nil
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expected a list but got %T", value)
+	}
+	result := make([]interface{}, 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		result = append(result, v.Index(i).Interface())
+	}
+	return result, nil
+}
+
+// appendList returns a new list consisting of all elements of list
+// followed by items.
+func appendList(list interface{}, items ...interface{}) ([]interface{}, error) {
+	result, err := toList(list)
+	if err != nil {
+		return nil, err
+	}
+	return append(result, items...), nil
+}
+
+// concat returns a new list containing the elements of all given
+// lists.
+func concat(lists ...interface{}) ([]interface{}, error) {
+	result := make([]interface{}, 0, len(lists))
+	for _, list := range lists {
+		items, err := toList(list)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, items...)
+	}
+	return result, nil
+}
+
+// merge returns a new map containing all keys of base and overlay.
+// Keys present in both maps get the value of overlay.
+func merge(base, overlay map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(base)+len(overlay))
+	for k, v := range base {
+		result[k] = v
+	}
+	for k, v := range overlay {
+		result[k] = v
+	}
+	return result
+}
+
+// mergeDeep works like merge but recursively merges values that are
+// maps in both base and overlay. Neither input is modified.
+func mergeDeep(base, overlay map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(base)+len(overlay))
+	for k, v := range base {
+		result[k] = v
+	}
+	for k, v := range overlay {
+		baseMap, baseIsMap := toStringMap(result[k])
+		overlayMap, overlayIsMap := toStringMap(v)
+		if baseIsMap && overlayIsMap {
+			result[k] = mergeDeep(baseMap, overlayMap)
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// dict builds a map from alternating keys and values, e.g.
+// dict "uri" $uri "branch" "main".
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("dict expects pairs of keys and values but got %d arguments", len(pairs))
+	}
+	result := make(map[string]interface{}, len(pairs)/2)
+	for idx := 0; idx < len(pairs); idx += 2 {
+		key, ok := pairs[idx].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict expects string keys but got %T", pairs[idx])
+		}
+		result[key] = pairs[idx+1]
+	}
+	return result, nil
+}
+
+// toYaml renders value as YAML without the trailing newline so that
+// it can be combined with indent or nindent.
+func toYaml(value interface{}) (string, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// dig looks up a value within nested maps. The first argument is the
+// default returned if any of the keys is missing, the last one the
+// map to start at, and all arguments in between the keys to follow.
+func dig(args ...interface{}) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("dig expects a default and a map but got %d arguments", len(args))
+	}
+	def := args[0]
+	current := args[len(args)-1]
+	for _, arg := range args[1 : len(args)-1] {
+		key, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("dig expects string keys but got %T", arg)
+		}
+		m, ok := toStringMap(current)
+		if !ok {
+			return def, nil
+		}
+		current, ok = m[key]
+		if !ok {
+			return def, nil
+		}
+	}
+	return current, nil
+}
+
+// toStringMap returns the given value as map with string keys if it
+// is any kind of map produced by templates or the YAML decoder.
+func toStringMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case Resource:
+		return v, true
+	case map[interface{}]interface{}:
+		return stringMap(v), true
+	}
+	return nil, false
+}
+
+func generateFuncMap(context ResourceInstanceContext, partials *template.Template, opts Options) template.FuncMap {
+	funcs := template.FuncMap{}
+	funcs["sourcePath"] = func() string {
+		return context.SourcePath
+	}
+	funcs["countParams"] = func() int {
+		return len(context.Params)
+	}
+	funcs["countInstances"] = func() int {
+		return len(context.AllInstances)
+	}
+	funcs["getParam"] = func(name, def string) string {
+		for _, p := range context.Params {
+			if p.Name == name {
+				return p.Value
+			}
+		}
+		return def
+	}
+	funcs["getParamOr"] = func(args ...string) (string, error) {
+		if len(args) < 2 {
+			return "", fmt.Errorf("getParamOr expects at least one name and a default but got %d arguments", len(args))
+		}
+		names, def := args[:len(args)-1], args[len(args)-1]
+		if len(names) == 1 {
+			return funcs["getParam"].(func(string, string) string)(names[0], def), nil
+		}
+		for _, name := range names {
+			for _, p := range context.Params {
+				if p.Name == name && p.Value != "" {
+					return p.Value, nil
+				}
+			}
+		}
+		return def, nil
+	}
+	funcs["param"] = func(name string, def ...string) (string, error) {
+		if len(def) > 1 {
+			return "", fmt.Errorf("param expects a name and an optional default but got %d arguments", len(def)+1)
+		}
+		for _, params := range context.paramSources {
+			for _, p := range params {
+				if p.Name == name {
+					return p.Value, nil
+				}
+			}
+		}
+		if value, ok := context.Vars[name]; ok {
+			return value, nil
+		}
+		if len(def) == 1 {
+			return def[0], nil
+		}
+		return "", fmt.Errorf("param: %s is neither a param of instance %s nor a var and has no default", name, context.Instance)
+	}
+	funcs["hasParam"] = func(name string) bool {
+		for _, p := range context.Params {
+			if p.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+	funcs["paramsOf"] = func(instance, name string) (string, error) {
+		known := false
+		for _, i := range context.AllInstances {
+			known = known || i == instance
+		}
+		if !known {
+			return "", fmt.Errorf("paramsOf: unknown instance %s", instance)
+		}
+		for _, p := range context.allParams[instance] {
+			if p.Name == name {
+				return p.Value, nil
+			}
+		}
+		return "", fmt.Errorf("paramsOf: instance %s has no param %s", instance, name)
+	}
+	funcs["sectionMap"] = func(section string) map[string]string {
+		result := make(map[string]string)
+		for _, p := range context.Params {
+			if p.Section == section {
+				result[p.Name] = p.Value
+			}
+		}
+		return result
+	}
+	funcs["list"] = func(elems ...interface{}) []interface{} {
+		return elems
+	}
+	funcs["dict"] = dict
+	funcs["toYaml"] = toYaml
+	funcs["ite"] = ite
+	funcs["indent"] = indent
+	funcs["nindent"] = nindent
+	funcs["trimSpace"] = strings.TrimSpace
+	funcs["trimPrefix"] = func(prefix, s string) string {
+		return strings.TrimPrefix(s, prefix)
+	}
+	funcs["trimSuffix"] = func(suffix, s string) string {
+		return strings.TrimSuffix(s, suffix)
+	}
+	funcs["replace"] = replace
+	funcs["regexReplace"] = regexReplace
+	funcs["upper"] = strings.ToUpper
+	funcs["lower"] = strings.ToLower
+	funcs["title"] = strings.Title
+	funcs["quote"] = strconv.Quote
+	funcs["squote"] = squote
+	funcs["trunc"] = trunc
+	funcs["b64enc"] = b64enc
+	funcs["b64dec"] = b64dec
+	funcs["default"] = defaultValue
+	funcs["coalesce"] = coalesce
+	funcs["uniq"] = uniq
+	funcs["append"] = appendList
+	funcs["concat"] = concat
+	funcs["merge"] = merge
+	funcs["mergeDeep"] = mergeDeep
+	funcs["dig"] = dig
+	funcs["renderResource"] = func(path string) (map[string]interface{}, error) {
+		return renderResource(opts, partials, context.SourcePath, path)
+	}
+	funcs["partial"] = func(name string, indentation int, context ResourceInstanceContext, kwargs ...interface{}) (string, error) {
+		if _, err := resolvePath("partials", name); err != nil {
+			return "", err
+		}
+		for idx, active := range context.partials {
+			if active == name {
+				chain := append(append([]string{}, context.partials[idx:]...), name)
+				return "", fmt.Errorf("partial %s includes itself: %s", name, strings.Join(chain, " -> "))
+			}
+		}
+		var out bytes.Buffer
+		argsMap := make(map[string]interface{})
+		key := ""
+		for idx, arg := range kwargs {
+			if idx%2 == 0 {
+				key = arg.(string)
+			} else {
+				argsMap[key] = arg
+			}
+		}
+		localContext := context.Clone()
+		localContext.Args = argsMap
+		localContext.partials = append(localContext.partials, name)
+		innerFuncMap := template.FuncMap{}
+		for k, v := range funcs {
+			innerFuncMap[k] = v
+		}
+		tmpls, err := partials.Clone()
+		if err != nil {
+			return "", err
+		}
+		if err := tmpls.Funcs(innerFuncMap).ExecuteTemplate(&out, name, localContext); err != nil {
+			return "", err
+		}
+		return indent(out.String(), indentation), nil
+	}
+	mergeFuncs(funcs, opts.Funcs, opts.OverrideFuncs)
+	return funcs
+}
+
+// mergeFuncs adds all extra functions to funcs. Functions already
+// present in funcs are only replaced if override is true.
+func mergeFuncs(funcs template.FuncMap, extra template.FuncMap, override bool) {
+	for k, v := range extra {
+		if _, exists := funcs[k]; exists && !override {
+			continue
+		}
+		funcs[k] = v
+	}
+}
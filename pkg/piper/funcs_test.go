@@ -0,0 +1,483 @@
+package piper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// renderInstance renders the given template for a single instance
+// with the given params and returns the resulting data section.
+func renderInstance(t *testing.T, tmpl string, params ...Param) map[string]interface{} {
+	partials, err := loadPartials(Options{Fs: afero.NewMemMapFs()}, "/")
+	require.NoError(t, err)
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	header := ResourceConfigHeader{Meta: ResourceMeta{Params: map[string][]Param{"instance": params}}}
+	var out ResourceConfig
+	require.NoError(t, generateInstance(&out, "instance", "test.yml", []byte(tmpl), header, partials, Options{Log: logger}))
+	return out.Data
+}
+
+func TestMerge(t *testing.T) {
+	base := map[string]interface{}{
+		"uri":    "https://example.org/repo.git",
+		"branch": "master",
+		"nested": map[string]interface{}{"a": 1, "b": 2},
+	}
+	overlay := map[string]interface{}{
+		"branch": "develop",
+		"nested": map[string]interface{}{"b": 3},
+	}
+	result := merge(base, overlay)
+	require.Equal(t, map[string]interface{}{
+		"uri":    "https://example.org/repo.git",
+		"branch": "develop",
+		"nested": map[string]interface{}{"b": 3},
+	}, result)
+	require.Equal(t, "master", base["branch"], "merge must not modify its inputs")
+}
+
+func TestMergeDeep(t *testing.T) {
+	base := map[string]interface{}{
+		"branch": "master",
+		"nested": map[string]interface{}{"a": 1, "b": 2},
+		"yaml":   map[interface{}]interface{}{"x": "y"},
+	}
+	overlay := map[string]interface{}{
+		"branch": "develop",
+		"nested": map[string]interface{}{"b": 3},
+		"yaml":   map[string]interface{}{"z": "w"},
+	}
+	result := mergeDeep(base, overlay)
+	require.Equal(t, map[string]interface{}{
+		"branch": "develop",
+		"nested": map[string]interface{}{"a": 1, "b": 3},
+		"yaml":   map[string]interface{}{"x": "y", "z": "w"},
+	}, result)
+	require.Equal(t, map[string]interface{}{"a": 1, "b": 2}, base["nested"], "mergeDeep must not modify its inputs")
+}
+
+func TestTrimFuncs(t *testing.T) {
+	data := renderInstance(t, `data:
+  name: "{{ getParam "name" "" | trimSpace }}"
+  branch: {{ getParam "branch" "" | trimPrefix "refs/heads/" }}
+  file: {{ getParam "file" "" | trimSuffix ".yml" }}`,
+		Param{Name: "name", Value: "  service \n"},
+		Param{Name: "branch", Value: "refs/heads/develop"},
+		Param{Name: "file", Value: "task.yml"},
+	)
+	require.Equal(t, "service", data["name"])
+	require.Equal(t, "develop", data["branch"])
+	require.Equal(t, "task", data["file"])
+}
+
+func TestDefault(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		result interface{}
+	}{
+		{value: nil, result: "def"},
+		{value: "", result: "def"},
+		{value: []interface{}{}, result: "def"},
+		{value: map[string]interface{}{}, result: "def"},
+		{value: false, result: "def"},
+		{value: 0, result: "def"},
+		{value: 0.0, result: "def"},
+		{value: "value", result: "value"},
+		{value: []interface{}{"a"}, result: []interface{}{"a"}},
+		{value: map[string]interface{}{"a": 1}, result: map[string]interface{}{"a": 1}},
+		{value: true, result: true},
+		{value: 42, result: 42},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.result, defaultValue("def", test.value), "%#v", test.value)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	require.Equal(t, "b", coalesce(nil, "", []interface{}{}, map[string]interface{}{}, "b", "c"))
+	require.Equal(t, 1, coalesce(0, 1))
+	require.Nil(t, coalesce())
+	require.Nil(t, coalesce(nil, ""))
+
+	data := renderInstance(t, `data:
+  region: {{ coalesce (getParam "region" "") (getParam "fallback" "") "eu-west-1" }}
+  tags: {{ default "[latest]" (getParam "tags" "") }}`,
+		Param{Name: "fallback", Value: "us-east-1"},
+	)
+	require.Equal(t, "us-east-1", data["region"])
+	require.Equal(t, []interface{}{"latest"}, data["tags"])
+}
+
+func TestUniq(t *testing.T) {
+	result, err := uniq([]string{"b", "a", "b", "c", "a"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "a", "c"}, result)
+
+	_, err = uniq("not a list")
+	require.Error(t, err)
+
+	data := renderInstance(t, `data:
+  tags: {{ range uniq (list "web" "eu" "web" 1 "eu" 1) }}
+  - {{ . }}{{ end }}`)
+	require.Equal(t, []interface{}{"web", "eu", 1}, data["tags"])
+}
+
+func TestAppend(t *testing.T) {
+	base := []interface{}{"a"}
+	result, err := appendList(base, "b", "c")
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"a", "b", "c"}, result)
+	require.Equal(t, []interface{}{"a"}, base)
+
+	result, err = appendList([]string{"x"}, "y")
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"x", "y"}, result)
+
+	_, err = appendList("not a list", "y")
+	require.Error(t, err)
+
+	data := renderInstance(t, `data:
+  {{- $plan := list "get-source" }}
+  {{- if getParam "publish" "" }}{{ $plan = append $plan "put-release" }}{{ end }}
+  plan: {{ range $plan }}
+  - {{ . }}{{ end }}`, Param{Name: "publish", Value: "true"})
+	require.Equal(t, []interface{}{"get-source", "put-release"}, data["plan"])
+}
+
+func TestConcat(t *testing.T) {
+	result, err := concat([]interface{}{"a"}, []string{"b", "c"}, nil, []interface{}{})
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"a", "b", "c"}, result)
+
+	_, err = concat([]interface{}{"a"}, 1)
+	require.Error(t, err)
+
+	data := renderInstance(t, `data:
+  tags: {{ range concat (list "a" "b") (list "c") }}
+  - {{ . }}{{ end }}`)
+	require.Equal(t, []interface{}{"a", "b", "c"}, data["tags"])
+}
+
+func TestDict(t *testing.T) {
+	result, err := dict("uri", "https://example.org", "depth", 1)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"uri": "https://example.org", "depth": 1}, result)
+
+	_, err = dict("uri")
+	require.Error(t, err)
+	_, err = dict(1, "value")
+	require.Error(t, err)
+
+	data := renderInstance(t, `data:
+  {{- $source := dict "uri" (getParam "uri" "") "paths" (list "src" "go.mod") }}
+  {{- $plan := list (dict "get" "source" "params" (dict "depth" 1)) (dict "task" "test") }}
+  source: {{ toYaml $source | nindent 4 }}
+  plan: {{ toYaml $plan | nindent 2 }}`, Param{Name: "uri", Value: "https://example.org/repo.git"})
+	require.Equal(t, map[interface{}]interface{}{
+		"uri":   "https://example.org/repo.git",
+		"paths": []interface{}{"src", "go.mod"},
+	}, data["source"])
+	require.Equal(t, []interface{}{
+		map[interface{}]interface{}{"get": "source", "params": map[interface{}]interface{}{"depth": 1}},
+		map[interface{}]interface{}{"task": "test"},
+	}, data["plan"])
+}
+
+func TestToYaml(t *testing.T) {
+	out, err := toYaml(map[string]interface{}{"b": []interface{}{1, 2}, "a": "x"})
+	require.NoError(t, err)
+	require.Equal(t, "a: x\nb:\n- 1\n- 2", out)
+}
+
+func TestCaseFuncs(t *testing.T) {
+	data := renderInstance(t, `data:
+  name: git-{{ getParam "branch" "" | lower }}
+  env: {{ getParam "env" "" | upper }}
+  label: {{ getParam "label" "" | title }}`,
+		Param{Name: "branch", Value: "Feature-ABC"},
+		Param{Name: "env", Value: "prod"},
+		Param{Name: "label", Value: "nightly build"},
+	)
+	require.Equal(t, "git-feature-abc", data["name"])
+	require.Equal(t, "PROD", data["env"])
+	require.Equal(t, "Nightly Build", data["label"])
+}
+
+func TestReplaceFuncs(t *testing.T) {
+	data := renderInstance(t, `data:
+  name: {{ getParam "branch" "" | replace "/" "-" }}
+  version: {{ getParam "tag" "" | regexReplace "^v([0-9]+)\\..*$" "$1" }}`,
+		Param{Name: "branch", Value: "feature/abc/def"},
+		Param{Name: "tag", Value: "v12.3.4"},
+	)
+	require.Equal(t, "feature-abc-def", data["name"])
+	require.Equal(t, 12, data["version"])
+
+	_, err := regexReplace("([", "", "value")
+	require.Error(t, err)
+}
+
+func TestNindent(t *testing.T) {
+	require.Equal(t, "\n  a: 1\n  b: 2", nindent(2, "a: 1\nb: 2"))
+
+	data := renderInstance(t, `data:
+  source:{{ nindent 4 "uri: git@example.com\nbranch: master" }}`)
+	require.Equal(t, map[interface{}]interface{}{"uri": "git@example.com", "branch": "master"}, data["source"])
+}
+
+func TestPartialPathTraversal(t *testing.T) {
+	partials, err := loadPartials(Options{Fs: afero.NewMemMapFs()}, "/")
+	require.NoError(t, err)
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	var out ResourceConfig
+	err = generateInstance(&out, "instance", "test.yml", []byte(`{{ partial "../../etc/passwd" 0 . }}`), ResourceConfigHeader{}, partials, Options{Log: logger})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "path ../../etc/passwd is not allowed")
+}
+
+func TestSourcePath(t *testing.T) {
+	data := renderInstance(t, `data:
+  func: {{ sourcePath }}
+  field: {{ .SourcePath }}`)
+	require.Equal(t, map[string]interface{}{
+		"func":  "test.yml",
+		"field": "test.yml",
+	}, data)
+}
+
+func TestSourcePathOfDocuments(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	resources, err := Render(Options{Fs: afero.NewMemMapFs(), Vars: map[string]string{"env": "prod"}, Log: logger}, "/jobs/deploy.yml", []byte(`meta:
+  name: first
+data:
+  path: {{ .SourcePath }}
+---
+meta:
+  name: '{{ .Vars.env }}:{{ .SourcePath }}'
+data:
+  path: {{ sourcePath }}`))
+	require.NoError(t, err)
+	require.Equal(t, []Resource{
+		{"name": "first", "path": "/jobs/deploy.yml"},
+		{"name": "prod:/jobs/deploy.yml", "path": "/jobs/deploy.yml"},
+	}, resources)
+	require.Equal(t, "/jobs/a#b.yml", sourcePath("/jobs/a#b.yml"))
+}
+
+func TestBase64Funcs(t *testing.T) {
+	data := renderInstance(t, `data:
+  encoded: {{ getParam "cert" "" | b64enc }}
+  decoded: {{ getParam "cert" "" | b64enc | b64dec }}`,
+		Param{Name: "cert", Value: "-----BEGIN CERTIFICATE-----"},
+	)
+	require.Equal(t, "LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0t", data["encoded"])
+	require.Equal(t, "-----BEGIN CERTIFICATE-----", data["decoded"])
+
+	_, err := b64dec("not base64!")
+	require.Error(t, err)
+}
+
+func TestCountFuncs(t *testing.T) {
+	partials, err := loadPartials(Options{Fs: afero.NewMemMapFs()}, "/")
+	require.NoError(t, err)
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	header := ResourceConfigHeader{Meta: ResourceMeta{
+		Instances: []string{"a", "b", "c"},
+		Params: map[string][]Param{
+			"a": {{Name: "x", Value: "1"}, {Name: "y", Value: "2"}},
+		},
+	}}
+	tmpl := `data:
+  params: {{ countParams }}
+  len: {{ len .Params }}
+  instances: {{ countInstances }}
+  multiple: {{ gt countInstances 1 }}`
+	var out ResourceConfig
+	require.NoError(t, generateInstance(&out, "a", "test.yml", []byte(tmpl), header, partials, Options{Log: logger}))
+	require.Equal(t, map[string]interface{}{"params": 2, "len": 2, "instances": 3, "multiple": true}, out.Data)
+
+	out = ResourceConfig{}
+	require.NoError(t, generateInstance(&out, "b", "test.yml", []byte(tmpl), header, partials, Options{Log: logger}))
+	require.Equal(t, map[string]interface{}{"params": 0, "len": 0, "instances": 3, "multiple": true}, out.Data)
+}
+
+func TestQuoteFuncs(t *testing.T) {
+	data := renderInstance(t, `data:
+  unquoted: {{ getParam "version" "" }}
+  quoted: {{ getParam "version" "" | quote }}
+  squoted: {{ getParam "version" "" | squote }}
+  flag: {{ getParam "flag" "" | quote }}
+  message: {{ getParam "message" "" | quote }}
+  smessage: {{ getParam "message" "" | squote }}`,
+		Param{Name: "version", Value: "1.10"},
+		Param{Name: "flag", Value: "yes"},
+		Param{Name: "message", Value: `it's "quoted"`},
+	)
+	require.Equal(t, 1.1, data["unquoted"])
+	require.Equal(t, "1.10", data["quoted"])
+	require.Equal(t, "1.10", data["squoted"])
+	require.Equal(t, "yes", data["flag"])
+	require.Equal(t, `it's "quoted"`, data["message"])
+	require.Equal(t, `it's "quoted"`, data["smessage"])
+}
+
+func TestTrunc(t *testing.T) {
+	require.Equal(t, "abc", trunc(3, "abcdef"))
+	require.Equal(t, "abcdef", trunc(6, "abcdef"))
+	require.Equal(t, "abcdef", trunc(63, "abcdef"))
+	require.Equal(t, "", trunc(0, "abcdef"))
+	require.Equal(t, "def", trunc(-3, "abcdef"))
+	require.Equal(t, "abcdef", trunc(-10, "abcdef"))
+	require.Equal(t, "äö", trunc(2, "äöü"))
+
+	data := renderInstance(t, `data:
+  name: {{ printf "%s-%s" "pipeline" (getParam "branch" "") | trunc 15 }}`,
+		Param{Name: "branch", Value: "feature/very-long-branch"},
+	)
+	require.Equal(t, "pipeline-featur", data["name"])
+}
+
+func TestGetParamOr(t *testing.T) {
+	data := renderInstance(t, `data:
+  branch: {{ getParamOr "branch" "default_branch" "main" }}
+  tag: {{ getParamOr "tag" "version" "latest" }}
+  image: {{ getParamOr "image" "base_image" "alpine" }}
+  single: "{{ getParamOr "version" "latest" }}"`,
+		Param{Name: "branch", Value: ""},
+		Param{Name: "default_branch", Value: "develop"},
+		Param{Name: "tag", Value: "v1"},
+		Param{Name: "version", Value: ""},
+	)
+	require.Equal(t, "develop", data["branch"], "Empty params are skipped")
+	require.Equal(t, "v1", data["tag"], "The first name wins")
+	require.Equal(t, "alpine", data["image"], "The default is used if no param is set")
+	require.Equal(t, "", data["single"], "A single name behaves like getParam")
+
+	partials, err := loadPartials(Options{Fs: afero.NewMemMapFs()}, "/")
+	require.NoError(t, err)
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	var out ResourceConfig
+	err = generateInstance(&out, "instance", "test.yml", []byte(`data:
+  value: {{ getParamOr "default" }}`), ResourceConfigHeader{}, partials, Options{Log: logger})
+	require.Error(t, err)
+}
+
+func TestParam(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.FatalLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/services.csv", []byte("name,b,c,e\nweb,file,file,file\n"), 0600)
+	afero.WriteFile(fs, "/jobs/deploy.yml", []byte(`meta:
+  name_template: deploy-{{ .Instance }}
+  instances:
+    - name: api
+      params:
+        - {name: a, value: inline}
+        - {name: s, value: inline, section: env}
+  instances_from: services.csv
+  params:
+    api:
+      - {name: a, value: params}
+      - {name: b, value: params}
+      - {name: s, value: params}
+    web:
+      - {name: b, value: params}
+      - {name: e, value: params, section: env}
+data:
+  a: {{ param "a" "default" }}
+  b: {{ param "b" "default" }}
+  c: {{ param "c" "default" }}
+  e: {{ param "e" "default" }}
+  s: {{ param "s" "default" }}
+  v: {{ param "v" "default" }}
+  d: {{ param "d" "default" }}`), 0600)
+
+	p, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Vars: map[string]string{"b": "var", "c": "var", "v": "var"}, Log: log})
+	require.NoError(t, err)
+	require.Len(t, p.Jobs, 2)
+	api, web := p.Jobs[0], p.Jobs[1]
+	require.Equal(t, "inline", api["a"], "Inline params win over meta.params")
+	require.Equal(t, "inline", api["s"], "Inline params win over meta.params even within a section")
+	require.Equal(t, "params", api["b"], "meta.params win over vars")
+	require.Equal(t, "params", web["b"], "meta.params win over instances_from")
+	require.Equal(t, "params", web["e"], "meta.params win over instances_from even within a section")
+	require.Equal(t, "file", web["c"], "instances_from wins over vars")
+	require.Equal(t, "var", api["c"], "Vars win over the default")
+	require.Equal(t, "var", api["v"])
+	require.Equal(t, "default", api["d"], "The default is used if nothing defines the name")
+	require.Equal(t, "default", web["a"])
+
+	_, err = Render(Options{Fs: fs, Folders: []string{"/"}, Log: log}, "test.yml", []byte("meta:\n  name: test\ndata:\n  value: {{ param \"missing\" }}"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "param: missing is neither a param of instance test nor a var and has no default")
+	_, err = Render(Options{Fs: fs, Folders: []string{"/"}, Log: log}, "test.yml", []byte("meta:\n  name: test\ndata:\n  value: {{ param \"a\" \"b\" \"c\" }}"))
+	require.Error(t, err)
+}
+
+func TestHasParam(t *testing.T) {
+	tmpl := `data:
+  has: {{ hasParam "region" }}
+  value: {{ getParam "region" "" | quote }}`
+	require.Equal(t, map[string]interface{}{"has": false, "value": ""}, renderInstance(t, tmpl))
+	require.Equal(t, map[string]interface{}{"has": true, "value": ""}, renderInstance(t, tmpl, Param{Name: "region", Value: ""}))
+	require.Equal(t, map[string]interface{}{"has": true, "value": "eu"}, renderInstance(t, tmpl, Param{Name: "region", Value: "eu"}))
+}
+
+func TestSectionMap(t *testing.T) {
+	data := renderInstance(t, `data:
+  env:{{ range $name, $value := sectionMap "env" }}
+    {{ $name }}: {{ $value }}{{ end }}
+  empty: {{ len (sectionMap "unknown") }}`,
+		Param{Name: "DEBUG", Value: "false", Section: "env"},
+		Param{Name: "branch", Value: "master"},
+		Param{Name: "REGION", Value: "eu", Section: "env"},
+		Param{Name: "DEBUG", Value: "true", Section: "env"},
+	)
+	require.Equal(t, map[interface{}]interface{}{"DEBUG": true, "REGION": "eu"}, data["env"])
+	require.Equal(t, 0, data["empty"])
+}
+
+func TestDig(t *testing.T) {
+	config := map[string]interface{}{
+		"region": map[interface{}]interface{}{
+			"cloud": "eu",
+			"zones": []interface{}{"a", "b"},
+		},
+		"name": "service",
+	}
+	tests := []struct {
+		args   []interface{}
+		result interface{}
+	}{
+		{args: []interface{}{"us", "region", "cloud", config}, result: "eu"},
+		{args: []interface{}{"us", "region", "missing", config}, result: "us"},
+		{args: []interface{}{"us", "missing", "cloud", config}, result: "us"},
+		{args: []interface{}{"us", "name", "cloud", config}, result: "us"},
+		{args: []interface{}{"us", "region", "zones", config}, result: []interface{}{"a", "b"}},
+		{args: []interface{}{"us", config}, result: config},
+		{args: []interface{}{"us", "region", nil}, result: "us"},
+	}
+	for _, test := range tests {
+		result, err := dig(test.args...)
+		require.NoError(t, err)
+		require.Equal(t, test.result, result)
+	}
+	_, err := dig(config)
+	require.Error(t, err)
+	_, err = dig("us", 1, config)
+	require.Error(t, err)
+
+	data := renderInstance(t, `data:
+  cloud: {{ dig "us" "region" "cloud" (merge .Args .Args) }}`)
+	require.Equal(t, "us", data["cloud"])
+}
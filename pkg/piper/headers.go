@@ -0,0 +1,60 @@
+package piper
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// categories lists all folders templates are loaded from.
+var categories = []string{"resource_types", "resources", "jobs", "groups", "var_sources"}
+
+// templateHeader is the parsed header of a single template document.
+type templateHeader struct {
+	Category string
+	// Path is the path of the template file. Documents of files
+	// containing multiple documents are suffixed with #<index>.
+	Path   string
+	Header ResourceConfigHeader
+}
+
+// scanHeaders parses the headers of all template documents found
+// within opts.Folders without rendering their instances.
+func scanHeaders(opts Options) ([]templateHeader, error) {
+	opts = opts.withDefaults()
+	partials, err := loadFolderPartials(opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse partial templates: %s", err.Error())
+	}
+	headers := make([]templateHeader, 0, 10)
+	for _, folder := range opts.Folders {
+		for _, category := range categories {
+			root := filepath.Join(folder, category)
+			files, err := templateFiles(opts, root)
+			if err != nil {
+				return nil, fmt.Errorf("failed to process paths: %s: %w", root, err)
+			}
+			for _, p := range files {
+				data, err := loadTemplateFile(opts, p)
+				if err != nil {
+					return nil, fmt.Errorf("failed to process paths: %s: %w", root, err)
+				}
+				documents := [][]byte{data}
+				if !isJSONFile(p) {
+					documents = splitDocuments(data)
+				}
+				for idx, document := range documents {
+					name := p
+					if len(documents) > 1 {
+						name = fmt.Sprintf("%s#%d", p, idx+1)
+					}
+					var rc ResourceConfigHeader
+					if err := parseTemplateHeader(opts, partials, name, &rc, document); err != nil {
+						return nil, &GenerationError{Path: name, Phase: PhaseHeader, Err: err}
+					}
+					headers = append(headers, templateHeader{Category: category, Path: name, Header: rc})
+				}
+			}
+		}
+	}
+	return headers, nil
+}
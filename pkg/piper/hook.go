@@ -0,0 +1,41 @@
+package piper
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// loadTemplateFile reads the given template file and passes it
+// through opts.PreHook if configured.
+func loadTemplateFile(opts Options, path string) ([]byte, error) {
+	data, err := readTemplateFile(opts, path)
+	if err != nil {
+		return nil, err
+	}
+	if opts.PreHook == "" {
+		return data, nil
+	}
+	return runPreHook(opts.PreHook, path, data)
+}
+
+// runPreHook executes the given shell command with data as stdin and
+// returns its stdout. The path of the template is available to the
+// command as PIPER_TEMPLATE environment variable.
+func runPreHook(command string, path string, data []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), "PIPER_TEMPLATE="+path)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("pre-hook failed for %s: %w: %s", path, err, msg)
+		}
+		return nil, fmt.Errorf("pre-hook failed for %s: %w", path, err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,28 @@
+package piper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreHook(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.FatalLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/resources/source.yml", []byte("meta:\n  name: source\ndata:\n  type: git\n  source:\n    private_key: SECRET"), 0600)
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, PreHook: `sed "s|SECRET|$PIPER_TEMPLATE|"`, Log: log})
+	require.NoError(t, err)
+	require.Equal(t, []Resource{
+		{"name": "source", "type": "git", "source": map[interface{}]interface{}{"private_key": "/resources/source.yml"}},
+	}, result.Resources)
+
+	_, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, PreHook: "echo vault unavailable >&2; exit 3", Log: log})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "pre-hook failed for /resources/source.yml: exit status 3: vault unavailable")
+}
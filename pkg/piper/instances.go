@@ -0,0 +1,190 @@
+package piper
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// expandInstancesFrom adds the instances listed in the CSV or TSV file
+// referenced by meta.instances_from to meta. The file is resolved
+// relative to the template's folder. Its first row names the params,
+// every other row defines an instance: the first column is the name
+// of the instance and all others are its params. Params configured
+// within meta.params replace params of the same name read from the
+// file.
+func expandInstancesFrom(opts Options, path string, meta *ResourceMeta) error {
+	if meta.InstancesFrom == "" {
+		return nil
+	}
+	file, err := resolvePath(filepath.Dir(path), meta.InstancesFrom)
+	if err != nil {
+		return fmt.Errorf("instances_from: %w", err)
+	}
+	meta.inputs = append(meta.inputs, escapeGlob(file))
+	data, err := readTemplateFile(opts, file)
+	if err != nil {
+		return fmt.Errorf("instances_from: %w", err)
+	}
+	reader := csv.NewReader(bytes.NewReader(data))
+	if strings.HasSuffix(file, ".tsv") {
+		reader.Comma = '\t'
+	}
+	records, err := reader.ReadAll()
+	if err != nil {
+		return fmt.Errorf("instances_from: %s: %w", meta.InstancesFrom, err)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	header := records[0]
+	known := make(map[string]struct{}, len(meta.Instances)+len(records))
+	for _, instance := range meta.Instances {
+		known[instance] = struct{}{}
+	}
+	for idx, record := range records[1:] {
+		name := strings.TrimSpace(record[0])
+		if name == "" {
+			return fmt.Errorf("instances_from: %s: row %d has no instance name", meta.InstancesFrom, idx+2)
+		}
+		if _, exists := known[name]; exists {
+			return fmt.Errorf("instances_from: %s: instance %s is defined more than once", meta.InstancesFrom, name)
+		}
+		known[name] = struct{}{}
+		meta.Instances = append(meta.Instances, name)
+		params := make([]Param, 0, len(header)-1)
+		for col := 1; col < len(header); col++ {
+			params = append(params, Param{Name: header[col], Value: record[col]})
+		}
+		meta.addFileParams(name, params)
+	}
+	return nil
+}
+
+// expandInstancesGlob adds an instance for every file matching the
+// glob pattern of meta.instances_glob to meta. The pattern is resolved
+// relative to the input folder containing the template. The instance
+// is named after the file without extension and every top-level key
+// of the file becomes one of its params. Params configured within
+// meta.params replace params of the same name read from the file.
+func expandInstancesGlob(opts Options, path string, meta *ResourceMeta) error {
+	if meta.InstancesGlob == "" {
+		return nil
+	}
+	root, err := sourceRoot(opts, documentPath(path))
+	if err != nil {
+		return fmt.Errorf("instances_glob: %w", err)
+	}
+	pattern, err := resolvePath(root, meta.InstancesGlob)
+	if err != nil {
+		return fmt.Errorf("instances_glob: %w", err)
+	}
+	// The pattern itself is recorded so that files added later are
+	// covered as well.
+	meta.inputs = append(meta.inputs, pattern)
+	matches, err := afero.Glob(opts.Fs, pattern)
+	if err != nil {
+		return fmt.Errorf("instances_glob: %s: %w", meta.InstancesGlob, err)
+	}
+	known := make(map[string]string, len(meta.Instances)+len(matches))
+	for _, instance := range meta.Instances {
+		known[instance] = ""
+	}
+	for _, file := range matches {
+		if info, err := opts.Fs.Stat(file); err != nil {
+			return fmt.Errorf("instances_glob: %w", err)
+		} else if info.IsDir() {
+			continue
+		}
+		base := filepath.Base(file)
+		name := strings.TrimSuffix(base, filepath.Ext(base))
+		if other, exists := known[name]; exists {
+			if other == "" {
+				return fmt.Errorf("instances_glob: instance %s of %s is defined more than once", name, file)
+			}
+			return fmt.Errorf("instances_glob: %s and %s both define instance %s", other, file, name)
+		}
+		known[name] = file
+		params, err := readInstanceParams(opts, file)
+		if err != nil {
+			return fmt.Errorf("instances_glob: %w", err)
+		}
+		meta.Instances = append(meta.Instances, name)
+		meta.addFileParams(name, params)
+	}
+	return nil
+}
+
+// readInstanceParams reads a YAML or JSON file containing a map and
+// returns a param for every top-level key sorted by name. Values that
+// are neither strings nor numbers nor booleans are given as YAML.
+func readInstanceParams(opts Options, file string) ([]Param, error) {
+	data, err := readTemplateFile(opts, file)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := make([]Param, 0, len(names))
+	for _, name := range names {
+		var value string
+		switch v := values[name].(type) {
+		case nil:
+		case string, int, float64, bool:
+			value = fmt.Sprint(v)
+		default:
+			out, err := yaml.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert %s of %s: %w", name, file, err)
+			}
+			value = strings.TrimSuffix(string(out), "\n")
+		}
+		params = append(params, Param{Name: name, Value: value})
+	}
+	return params, nil
+}
+
+// escapeGlob escapes all characters of path with a special meaning
+// within glob patterns.
+func escapeGlob(path string) string {
+	var b strings.Builder
+	for _, c := range path {
+		if strings.ContainsRune(`*?[\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// sourceRoot returns the input folder containing the given template.
+// If the folders are nested, the innermost one is returned.
+func sourceRoot(opts Options, path string) (string, error) {
+	root := ""
+	for _, folder := range opts.Folders {
+		rel, err := filepath.Rel(folder, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if root == "" || len(filepath.Clean(folder)) > len(filepath.Clean(root)) {
+			root = folder
+		}
+	}
+	if root == "" {
+		return "", fmt.Errorf("%s is not within any of the input folders", path)
+	}
+	return root, nil
+}
@@ -0,0 +1,131 @@
+package piper
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstancesFrom(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/services.csv", []byte("service,branch,replicas\napi,main,3\nweb,\"develop, v2\",1\n"), 0600)
+	afero.WriteFile(fs, "/jobs/deploy.yml", []byte(`meta:
+  name_template: deploy-{{ .Instance }}
+  instances: [worker]
+  instances_from: services.csv
+  params:
+    web:
+    - name: replicas
+      value: "2"
+data:
+  branch: {{ getParam "branch" "none" | quote }}
+  replicas: {{ getParam "replicas" "0" }}`), 0600)
+
+	p, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	require.Equal(t, []Resource{
+		{"name": "deploy-worker", "branch": "none", "replicas": 0},
+		{"name": "deploy-api", "branch": "main", "replicas": 3},
+		{"name": "deploy-web", "branch": "develop, v2", "replicas": 2},
+	}, p.Jobs)
+
+	afero.WriteFile(fs, "/jobs/services.tsv", []byte("service\tbranch\nbatch\tmain\n"), 0600)
+	resources, err := Render(Options{Fs: fs, Log: log}, "/jobs/batch.yml", []byte(`meta:
+  name_template: deploy-{{ .Instance }}
+  instances_from: services.tsv
+data:
+  branch: {{ getParam "branch" "none" }}`))
+	require.NoError(t, err)
+	require.Equal(t, []Resource{{"name": "deploy-batch", "branch": "main"}}, resources)
+
+	for from, message := range map[string]string{
+		"../secrets.csv": "escapes",
+		"missing.csv":    "file does not exist",
+		"duplicate.csv":  "instance api is defined more than once",
+	} {
+		afero.WriteFile(fs, "/jobs/duplicate.csv", []byte("service\napi\napi\n"), 0600)
+		_, err := Render(Options{Fs: fs, Log: log}, "/jobs/broken.yml", []byte("meta:\n  name_template: x-{{ .Instance }}\n  instances_from: "+from+"\ndata:\n  a: b"))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), message)
+	}
+}
+
+func TestInstancesGlob(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/ci/services/api.yml", []byte("repository: example/api\nreplicas: 3\nports: [80, 443]\n"), 0600)
+	afero.WriteFile(fs, "/ci/services/web.yml", []byte("repository: example/web\nreplicas: 1\n"), 0600)
+	afero.WriteFile(fs, "/ci/resources/images.yml", []byte(`meta:
+  name_template: image-{{ .Instance }}
+  instances_glob: services/*.yml
+  params:
+    web:
+    - name: replicas
+      value: "2"
+data:
+  type: registry-image
+  source:
+    repository: {{ param "repository" }}
+  replicas: {{ param "replicas" }}
+  {{- if hasParam "ports" }}
+  ports:{{ param "ports" | nindent 2 }}
+  {{- end }}`), 0600)
+
+	p, err := Build(ctx, Options{Fs: fs, Folders: []string{"/ci"}, Log: log})
+	require.NoError(t, err)
+	require.Len(t, p.Resources, 2)
+	require.Equal(t, Resource{
+		"name":     "image-api",
+		"type":     "registry-image",
+		"source":   map[interface{}]interface{}{"repository": "example/api"},
+		"replicas": 3,
+		"ports":    []interface{}{80, 443},
+	}, p.Resources[0])
+	require.Equal(t, "image-web", p.Resources[1].String())
+	require.Equal(t, 2, p.Resources[1]["replicas"], "meta.params should win over the file's content")
+
+	afero.WriteFile(fs, "/ci/resources/escape.yml", []byte("meta:\n  name_template: x-{{ .Instance }}\n  instances_glob: ../*.yml\ndata:\n  type: git"), 0600)
+	_, err = Build(ctx, Options{Fs: fs, Folders: []string{"/ci"}, Log: log})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "instances_glob: path ../*.yml is not allowed")
+	fs.Remove("/ci/resources/escape.yml")
+
+	afero.WriteFile(fs, "/ci/resources/duplicate.yml", []byte("meta:\n  name_template: x-{{ .Instance }}\n  instances: [api]\n  instances_glob: services/*.yml\ndata:\n  type: git"), 0600)
+	_, err = Build(ctx, Options{Fs: fs, Folders: []string{"/ci"}, Log: log})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "instances_glob: instance api of /ci/services/api.yml is defined more than once")
+}
+
+func TestStrictInstances(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.FatalLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/deploy.yml", []byte("meta:\n  name_template: deploy\n  instances: [staging, prod]\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/jobs/test.yml", []byte("meta:\n  name_template: test-{{ .Instance }}\n  instances: [unit, e2e]\ndata:\n  serial: true"), 0600)
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	require.Len(t, result.Jobs, 4)
+
+	_, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, StrictInstances: true, Log: log})
+	require.Error(t, err)
+	var genErr *GenerationError
+	require.True(t, errors.As(err, &genErr))
+	require.Equal(t, "/jobs/deploy.yml", genErr.Path)
+	require.Contains(t, err.Error(), `instances staging and prod are both named deploy: name_template has to render a distinct name for every instance`)
+
+	require.NoError(t, afero.WriteFile(fs, "/jobs/deploy.yml", []byte("meta:\n  name_template: deploy-{{ .Instance }}\n  instances: [staging, prod]\ndata:\n  serial: true"), 0600))
+	result, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, StrictInstances: true, Log: log})
+	require.NoError(t, err)
+	require.Len(t, result.Jobs, 4)
+}
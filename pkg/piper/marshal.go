@@ -0,0 +1,277 @@
+package piper
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// MarshalOptions configure how a pipeline is rendered as YAML.
+type MarshalOptions struct {
+	// OmitEmpty leaves out categories without any entries instead of
+	// rendering them as empty lists.
+	OmitEmpty bool
+	// Template, if set, is executed with an OutputContext and its
+	// result is returned by Marshal instead of the plain pipeline.
+	Template *template.Template
+	// Indent is the number of spaces used per indentation level. It
+	// defaults to 2.
+	Indent int
+	// Annotations are comments added above every entry whose name is
+	// used as key, independent of its category.
+	Annotations map[string]string
+}
+
+// LoadAnnotations reads a YAML file mapping names of entries to
+// comments to be used as MarshalOptions.Annotations.
+func LoadAnnotations(fs afero.Fs, path string) (map[string]string, error) {
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	var annotations map[string]string
+	if err := yaml.UnmarshalStrict(data, &annotations); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return annotations, nil
+}
+
+// Marshal renders the pipeline as YAML document. Comments configured
+// using meta.comment and meta.comments as well as opts.Annotations are
+// added to the generated entries. If opts.Template is set, the document is wrapped using it.
+func Marshal(p *Pipeline, opts MarshalOptions) ([]byte, error) {
+	data, err := marshalPipeline(p, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Template != nil {
+		return executeOutputTemplate(opts.Template, p, data)
+	}
+	return data, nil
+}
+
+// MarshalTo writes the same document as Marshal to w. Unless
+// opts.Template is set, the document is written entry by entry instead
+// of being rendered as a whole first, which keeps the memory usage low
+// for huge pipelines. With an Indent other than 2 every category is
+// still rendered as a whole before being written.
+func MarshalTo(w io.Writer, p *Pipeline, opts MarshalOptions) error {
+	if opts.Template != nil {
+		data, err := Marshal(p, opts)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	return writePipeline(w, p, opts)
+}
+
+func marshalPipeline(p *Pipeline, opts MarshalOptions) ([]byte, error) {
+	var out bytes.Buffer
+	if err := writePipeline(&out, p, opts); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// writePipeline writes the categories of the pipeline to w one after
+// another. If nothing was written, an empty map is written instead so
+// that the document remains valid.
+func writePipeline(w io.Writer, p *Pipeline, opts MarshalOptions) error {
+	written := false
+	for _, category := range []string{"groups", "resource_types", "resources", "jobs", "var_sources"} {
+		resources, err := p.category(category)
+		if err != nil {
+			return err
+		}
+		if len(resources) == 0 || (opts.Indent != 0 && opts.Indent != 2) {
+			data, err := MarshalCategory(p, category, opts)
+			if err != nil {
+				return err
+			}
+			if len(data) == 0 {
+				continue
+			}
+			if _, err := w.Write(data); err != nil {
+				return err
+			}
+			written = true
+			continue
+		}
+		if err := writeCategory(w, p, category, resources, opts); err != nil {
+			return err
+		}
+		written = true
+	}
+	if !written {
+		_, err := w.Write([]byte("{}\n"))
+		return err
+	}
+	return nil
+}
+
+// MarshalCategory renders a YAML document containing only the given
+// category of the pipeline as top-level key. If the category is empty
+// and opts.OmitEmpty is set, nothing is returned. Empty var_sources
+// are always omitted as they are optional in Concourse.
+func MarshalCategory(p *Pipeline, category string, opts MarshalOptions) ([]byte, error) {
+	resources, err := p.category(category)
+	if err != nil {
+		return nil, err
+	}
+	if len(resources) == 0 && (opts.OmitEmpty || category == "var_sources") {
+		return nil, nil
+	}
+	if len(resources) == 0 {
+		return yaml.Marshal(map[string][]Resource{category: resources})
+	}
+	var out bytes.Buffer
+	if err := writeCategory(&out, p, category, resources, opts); err != nil {
+		return nil, err
+	}
+	return reindent(out.Bytes(), opts.Indent)
+}
+
+// writeCategory writes the category's top-level key followed by its
+// resources to w, one resource at a time.
+func writeCategory(w io.Writer, p *Pipeline, category string, resources []Resource, opts MarshalOptions) error {
+	if _, err := fmt.Fprintf(w, "%s:\n", category); err != nil {
+		return err
+	}
+	for _, r := range resources {
+		data, err := marshalResource(p, category, r, opts.Annotations[r.String()])
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindent re-encodes the given YAML document using indent spaces
+// per indentation level. yaml.v2 always indents by 2 spaces, so the
+// document is passed through yaml.v3 which keeps the order of keys
+// and comments but also indents block sequences below their key.
+func reindent(data []byte, indent int) ([]byte, error) {
+	if indent == 0 || indent == 2 {
+		return data, nil
+	}
+	if indent < 2 || indent > 9 {
+		return nil, fmt.Errorf("indent must be between 2 and 9 but is %d", indent)
+	}
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	enc := yamlv3.NewEncoder(&out)
+	enc.SetIndent(indent)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (p *Pipeline) category(category string) ([]Resource, error) {
+	switch category {
+	case "groups":
+		return p.Groups, nil
+	case "resource_types":
+		return p.ResourceTypes, nil
+	case "resources":
+		return p.Resources, nil
+	case "jobs":
+		return p.Jobs, nil
+	case "var_sources":
+		return p.VarSources, nil
+	}
+	return nil, fmt.Errorf("unknown category %s", category)
+}
+
+// marshalResource renders a single resource as list item. If the
+// resource has an annotation or its template has comments configured,
+// every key is marshalled separately so that the comments can be
+// placed right above it.
+func marshalResource(p *Pipeline, category string, r Resource, annotation string) ([]byte, error) {
+	origin, _ := p.Origin(category, r.String())
+	if annotation == "" && origin.Meta.Comment == "" && len(origin.Meta.Comments) == 0 {
+		return yaml.Marshal([]Resource{r})
+	}
+	var out bytes.Buffer
+	writeComment(&out, "", annotation)
+	writeComment(&out, "", origin.Meta.Comment)
+	keys, err := keyOrder(r)
+	if err != nil {
+		return nil, err
+	}
+	for idx, key := range keys {
+		item := yaml.MapItem{Key: key, Value: r[key]}
+		data, err := yaml.Marshal(yaml.MapSlice{item})
+		if err != nil {
+			return nil, err
+		}
+		prefix := "  "
+		if idx == 0 {
+			// The first key shares its line with the list item's
+			// dash, so its comment is placed above the item.
+			writeComment(&out, "", origin.Meta.Comments[fmt.Sprint(item.Key)])
+			prefix = "- "
+		} else {
+			writeComment(&out, "  ", origin.Meta.Comments[fmt.Sprint(item.Key)])
+		}
+		for _, line := range strings.SplitAfter(string(data), "\n") {
+			if line == "" {
+				continue
+			}
+			if line == "\n" {
+				out.WriteString(line)
+				continue
+			}
+			out.WriteString(prefix)
+			out.WriteString(line)
+			prefix = "  "
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// keyOrder returns the keys of the resource in the order yaml.v2
+// marshals them in, so that marshalling the keys one by one produces
+// the same output as marshalling the resource as a whole.
+func keyOrder(r Resource) ([]string, error) {
+	data, err := yaml.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	var items yaml.MapSlice
+	if err := yaml.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, fmt.Sprint(item.Key))
+	}
+	return keys, nil
+}
+
+func writeComment(out *bytes.Buffer, indentation string, comment string) {
+	if comment == "" {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimRight(comment, "\n"), "\n") {
+		out.WriteString(strings.TrimRight(indentation+"# "+line, " "))
+		out.WriteString("\n")
+	}
+}
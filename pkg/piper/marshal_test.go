@@ -0,0 +1,265 @@
+package piper
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestMarshal(t *testing.T) {
+	p := &Pipeline{
+		Resources: []Resource{
+			{"name": "source", "type": "git", "source": map[string]interface{}{"uri": "https://example.org/repo.git"}},
+		},
+		Jobs: []Resource{
+			{"name": "build", "serial": true, "plan": []interface{}{
+				map[string]interface{}{"get": "source"},
+				map[string]interface{}{"task": "test", "config": map[string]interface{}{"run": "line 1\n\nline 2\n"}},
+			}},
+		},
+	}
+	expected, err := yaml.Marshal(p)
+	require.NoError(t, err)
+	out, err := Marshal(p, MarshalOptions{})
+	require.NoError(t, err)
+	require.Equal(t, string(expected), string(out), "Without comments the output should not change")
+
+	p.Origins = []Origin{
+		{Category: "jobs", Name: "build", Meta: ResourceMeta{
+			Comment:  "Builds the project.\nGenerated from jobs/build.yml",
+			Comments: map[string]string{"name": "Keep in sync with docs", "serial": "Only one build at a time"},
+		}},
+	}
+	out, err = Marshal(p, MarshalOptions{})
+	require.NoError(t, err)
+	require.Equal(t, `groups: []
+resource_types: []
+resources:
+- name: source
+  source:
+    uri: https://example.org/repo.git
+  type: git
+jobs:
+# Builds the project.
+# Generated from jobs/build.yml
+# Keep in sync with docs
+- name: build
+  plan:
+  - get: source
+  - config:
+      run: |
+        line 1
+
+        line 2
+    task: test
+  # Only one build at a time
+  serial: true
+`, string(out))
+
+	var parsed Pipeline
+	require.NoError(t, yaml.Unmarshal(out, &parsed))
+	require.Len(t, parsed.Jobs, 1)
+	require.Equal(t, true, parsed.Jobs[0]["serial"])
+}
+
+func TestMarshalOmitEmpty(t *testing.T) {
+	p := &Pipeline{
+		Groups:    []Resource{},
+		Resources: []Resource{{"name": "source", "type": "git"}},
+	}
+	out, err := Marshal(p, MarshalOptions{OmitEmpty: true})
+	require.NoError(t, err)
+	require.Equal(t, "resources:\n- name: source\n  type: git\n", string(out))
+
+	out, err = MarshalCategory(p, "groups", MarshalOptions{OmitEmpty: true})
+	require.NoError(t, err)
+	require.Empty(t, out)
+
+	out, err = Marshal(&Pipeline{}, MarshalOptions{OmitEmpty: true})
+	require.NoError(t, err)
+	require.Equal(t, "{}\n", string(out))
+}
+
+func TestMarshalAnnotations(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/annotations.yml", []byte(`source: |-
+  Owned by team platform.
+  See https://example.org/runbooks/source
+build: Rebuilds nightly`), 0600)
+	annotations, err := LoadAnnotations(fs, "/annotations.yml")
+	require.NoError(t, err)
+
+	p := &Pipeline{
+		Resources: []Resource{{"name": "source", "type": "git"}, {"name": "image", "type": "registry-image"}},
+		Jobs:      []Resource{{"name": "build", "plan": []interface{}{}}},
+		Origins:   []Origin{{Category: "jobs", Name: "build", Meta: ResourceMeta{Comment: "From jobs/build.yml"}}},
+	}
+	out, err := Marshal(p, MarshalOptions{OmitEmpty: true, Annotations: annotations})
+	require.NoError(t, err)
+	require.Equal(t, `resources:
+# Owned by team platform.
+# See https://example.org/runbooks/source
+- name: source
+  type: git
+- name: image
+  type: registry-image
+jobs:
+# Rebuilds nightly
+# From jobs/build.yml
+- name: build
+  plan: []
+`, string(out))
+
+	afero.WriteFile(fs, "/invalid.yml", []byte("source: [a, b]"), 0600)
+	_, err = LoadAnnotations(fs, "/invalid.yml")
+	require.Error(t, err)
+}
+
+func TestMarshalTemplate(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/templates/partials/metadata.yml", []byte(`{{ partial "name.yml" 0 . "name" .Args.name }}`), 0600)
+	afero.WriteFile(fs, "/templates/partials/name.yml", []byte(`name: {{ .Args.name }}`), 0600)
+	afero.WriteFile(fs, "/wrapper.yml", []byte(`kind: ConfigMap
+metadata:
+  {{ partial "metadata.yml" 2 . "name" "pipeline" }}
+data:
+  jobs: "{{ len .Pipeline.Jobs }}"
+  pipeline.yml: |{{ nindent 4 .YAML }}`), 0600)
+	tmpl, err := LoadOutputTemplate(Options{Fs: fs, Folders: []string{"/templates"}}, "/wrapper.yml")
+	require.NoError(t, err)
+
+	p := &Pipeline{Jobs: []Resource{{"name": "build"}}}
+	out, err := Marshal(p, MarshalOptions{OmitEmpty: true, Template: tmpl})
+	require.NoError(t, err)
+	require.Equal(t, `kind: ConfigMap
+metadata:
+  name: pipeline
+data:
+  jobs: "1"
+  pipeline.yml: |
+    jobs:
+    - name: build
+    `, string(out))
+
+	afero.WriteFile(fs, "/broken.yml", []byte("{{ .Unknown }}"), 0600)
+	tmpl, err = LoadOutputTemplate(Options{Fs: fs}, "/broken.yml")
+	require.NoError(t, err)
+	_, err = Marshal(p, MarshalOptions{Template: tmpl})
+	require.Error(t, err)
+}
+
+func TestMarshalIndent(t *testing.T) {
+	p := &Pipeline{
+		Jobs: []Resource{
+			{"name": "build", "plan": []interface{}{
+				map[string]interface{}{"task": "test", "config": map[string]interface{}{"run": "line 1\n  line 2\n"}},
+			}},
+		},
+		Origins: []Origin{
+			{Category: "jobs", Name: "build", Meta: ResourceMeta{Comment: "Builds the project."}},
+		},
+	}
+	out, err := Marshal(p, MarshalOptions{OmitEmpty: true, Indent: 4})
+	require.NoError(t, err)
+	require.Equal(t, `jobs:
+    # Builds the project.
+    - name: build
+      plan:
+        - config:
+            run: |
+                line 1
+                  line 2
+          task: test
+`, string(out))
+
+	out, err = Marshal(p, MarshalOptions{OmitEmpty: true, Indent: 2})
+	require.NoError(t, err)
+	require.Contains(t, string(out), "jobs:\n# Builds the project.\n- name: build\n  plan:\n  - config:\n")
+
+	_, err = Marshal(p, MarshalOptions{Indent: 1})
+	require.Error(t, err)
+}
+
+func TestMarshalTo(t *testing.T) {
+	p := largePipeline(20)
+	p.Origins = []Origin{{Category: "jobs", Name: "job-3", Meta: ResourceMeta{Comment: "Third job"}}}
+	for _, opts := range []MarshalOptions{
+		{},
+		{OmitEmpty: true},
+		{Indent: 4},
+		{Annotations: map[string]string{"resource-1": "First resource"}},
+	} {
+		expected, err := Marshal(p, opts)
+		require.NoError(t, err)
+		var out bytes.Buffer
+		require.NoError(t, MarshalTo(&out, p, opts))
+		require.Equal(t, string(expected), out.String())
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, MarshalTo(&out, &Pipeline{}, MarshalOptions{OmitEmpty: true}))
+	require.Equal(t, "{}\n", out.String())
+}
+
+func TestMarshalToMemory(t *testing.T) {
+	p := largePipeline(2000)
+	allocated := func(f func()) uint64 {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		f()
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+	var size int
+	buffered := allocated(func() {
+		data, err := Marshal(p, MarshalOptions{})
+		require.NoError(t, err)
+		size = len(data)
+	})
+	streamed := allocated(func() {
+		require.NoError(t, MarshalTo(ioutil.Discard, p, MarshalOptions{}))
+	})
+	require.True(t, streamed+uint64(size) < buffered, "Streaming should not allocate the whole document (%d bytes streamed, %d bytes buffered)", streamed, buffered)
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	p := largePipeline(5000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Marshal(p, MarshalOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalTo(b *testing.B) {
+	p := largePipeline(5000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := MarshalTo(ioutil.Discard, p, MarshalOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// largePipeline generates a pipeline with n resources and n jobs each
+// getting one of the resources.
+func largePipeline(n int) *Pipeline {
+	p := &Pipeline{}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("resource-%d", i)
+		p.Resources = append(p.Resources, Resource{"name": name, "type": "git", "source": map[string]interface{}{"uri": "https://example.org/" + name + ".git", "branch": "main"}})
+		p.Jobs = append(p.Jobs, Resource{"name": fmt.Sprintf("job-%d", i), "plan": []interface{}{
+			map[string]interface{}{"get": name, "trigger": true},
+			map[string]interface{}{"task": "test", "file": name + "/ci/test.yml"},
+		}})
+	}
+	return p
+}
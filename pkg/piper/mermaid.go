@@ -0,0 +1,52 @@
+package piper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteMermaid renders a Mermaid flowchart of the pipeline's jobs and
+// resources into w. Jobs are rendered as rectangles while resources
+// are rendered as stadium-shaped nodes. Edges point from a resource
+// to every job getting it and from a job to every resource it puts.
+func WriteMermaid(w io.Writer, p *Pipeline) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "flowchart LR")
+	resourceIDs := make(map[string]string, len(p.Resources))
+	for idx, r := range p.Resources {
+		id := fmt.Sprintf("r%d", idx)
+		resourceIDs[r.String()] = id
+		fmt.Fprintf(out, "    %s([\"%s\"])\n", id, mermaidLabel(r.String()))
+	}
+	edges := make([]string, 0, len(p.Jobs))
+	seen := make(map[string]struct{})
+	for idx, j := range p.Jobs {
+		id := fmt.Sprintf("j%d", idx)
+		fmt.Fprintf(out, "    %s[\"%s\"]\n", id, mermaidLabel(j.String()))
+		for _, step := range ScanPlan(j) {
+			resourceID, ok := resourceIDs[step.Resource]
+			if !ok {
+				continue
+			}
+			edge := fmt.Sprintf("%s --> %s", resourceID, id)
+			if step.Kind == "put" {
+				edge = fmt.Sprintf("%s --> %s", id, resourceID)
+			}
+			if _, exists := seen[edge]; exists {
+				continue
+			}
+			seen[edge] = struct{}{}
+			edges = append(edges, edge)
+		}
+	}
+	for _, edge := range edges {
+		fmt.Fprintf(out, "    %s\n", edge)
+	}
+	return out.Flush()
+}
+
+func mermaidLabel(name string) string {
+	return strings.Replace(name, `"`, "#quot;", -1)
+}
@@ -0,0 +1,64 @@
+package piper
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestScanPlan(t *testing.T) {
+	var job Resource
+	require.NoError(t, yaml.Unmarshal([]byte(`
+name: deploy
+plan:
+- in_parallel:
+  - get: source
+    passed: [build]
+    trigger: true
+  - get: image
+    resource: docker-image
+- do:
+  - task: deploy
+    on_failure:
+      put: notify
+- put: release
+`), &job))
+	require.Equal(t, []PlanStep{
+		{Kind: "get", Name: "source", Resource: "source", Passed: []string{"build"}},
+		{Kind: "get", Name: "image", Resource: "docker-image"},
+		{Kind: "put", Name: "notify", Resource: "notify"},
+		{Kind: "put", Name: "release", Resource: "release"},
+	}, ScanPlan(job))
+}
+
+func TestWriteMermaid(t *testing.T) {
+	var p Pipeline
+	require.NoError(t, yaml.Unmarshal([]byte(`
+resources:
+- name: source
+- name: release
+jobs:
+- name: build
+  plan:
+  - get: source
+  - get: source
+  - put: release
+- name: "say \"hi\""
+  plan:
+  - get: release
+  - get: unknown
+`), &p))
+	var out bytes.Buffer
+	require.NoError(t, WriteMermaid(&out, &p))
+	require.Equal(t, `flowchart LR
+    r0(["source"])
+    r1(["release"])
+    j0["build"]
+    j1["say #quot;hi#quot;"]
+    r0 --> j0
+    j0 --> r1
+    r1 --> j1
+`, out.String())
+}
@@ -0,0 +1,85 @@
+package piper
+
+import "strconv"
+
+// normalizeRule lists the fields of an entry or step whose values are
+// canonicalized by normalize.
+type normalizeRule struct {
+	// bools are fields that are converted from strings like "true"
+	// to booleans.
+	bools []string
+	// ints are fields that are converted from numeric strings to
+	// integers.
+	ints []string
+	// lists are fields that are converted from a single string to a
+	// list containing just that string.
+	lists []string
+}
+
+// normalizeRules are the rules for the entries of every category.
+var normalizeRules = map[string]normalizeRule{
+	"jobs": {
+		bools: []string{"serial", "public", "disable_manual_trigger", "interruptible"},
+		ints:  []string{"max_in_flight", "build_logs_to_retain"},
+		lists: []string{"serial_groups"},
+	},
+	"resources": {
+		bools: []string{"public", "expose_build_created_by"},
+		lists: []string{"tags"},
+	},
+	"resource_types": {
+		bools: []string{"privileged", "unique_version_history"},
+		lists: []string{"tags"},
+	},
+	"groups": {
+		lists: []string{"jobs", "resources", "resource_types"},
+	},
+}
+
+// stepNormalizeRule is the rule for every step within a job's plan.
+var stepNormalizeRule = normalizeRule{
+	bools: []string{"trigger", "privileged"},
+	ints:  []string{"attempts"},
+	lists: []string{"passed", "tags"},
+}
+
+func (rule normalizeRule) apply(s step) {
+	for _, key := range rule.bools {
+		if value, ok := s.get(key).(string); ok {
+			if b, err := strconv.ParseBool(value); err == nil {
+				s.set(key, b)
+			}
+		}
+	}
+	for _, key := range rule.ints {
+		if value, ok := s.get(key).(string); ok {
+			if i, err := strconv.Atoi(value); err == nil {
+				s.set(key, i)
+			}
+		}
+	}
+	for _, key := range rule.lists {
+		if value, ok := s.get(key).(string); ok {
+			s.set(key, []interface{}{value})
+		}
+	}
+}
+
+// normalize canonicalizes values of well-known fields that can be
+// written in different ways, e.g. "true" instead of true or a single
+// name instead of a list of names, so that logically equal pipelines
+// also look the same.
+func normalize(p *Pipeline) {
+	for category, rule := range normalizeRules {
+		resources, _ := p.category(category)
+		for _, r := range resources {
+			rule.apply(step{m: r})
+		}
+	}
+	for _, job := range p.Jobs {
+		visitSteps(job["plan"], stepNormalizeRule.apply)
+		for _, key := range jobHookKeys {
+			visitSteps(job[key], stepNormalizeRule.apply)
+		}
+	}
+}
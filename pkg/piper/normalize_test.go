@@ -0,0 +1,70 @@
+package piper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestNormalize(t *testing.T) {
+	var p Pipeline
+	require.NoError(t, yaml.Unmarshal([]byte(`
+groups:
+- name: all
+  jobs: build
+resource_types:
+- name: slack
+  privileged: "true"
+resources:
+- name: source
+  public: "false"
+  tags: worker
+jobs:
+- name: build
+  serial: "yes"
+  max_in_flight: "2"
+  serial_groups: deploy
+  plan:
+  - in_parallel:
+    - get: source
+      trigger: "true"
+      passed: test
+  - task: build
+    attempts: "3"
+  on_failure:
+    put: source
+    tags: [worker]
+`), &p))
+	normalize(&p)
+
+	var expected Pipeline
+	require.NoError(t, yaml.Unmarshal([]byte(`
+groups:
+- name: all
+  jobs: [build]
+resource_types:
+- name: slack
+  privileged: true
+resources:
+- name: source
+  public: false
+  tags: [worker]
+jobs:
+- name: build
+  serial: "yes"
+  max_in_flight: 2
+  serial_groups: [deploy]
+  plan:
+  - in_parallel:
+    - get: source
+      trigger: true
+      passed: [test]
+  - task: build
+    attempts: 3
+  on_failure:
+    put: source
+    tags: [worker]
+`), &expected))
+	require.Equal(t, expected, p)
+}
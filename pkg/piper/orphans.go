@@ -0,0 +1,64 @@
+package piper
+
+import (
+	"sort"
+)
+
+// Orphan is a template listing a pipeline in its meta section that no
+// other template is part of, or a template that is not part of the
+// selected pipeline. Both usually indicate a typo in the pipeline's
+// name.
+type Orphan struct {
+	// Path is the path of the template.
+	Path string
+	// Pipeline is the pipeline only this template is part of or, if
+	// Unselected is set, the selected pipeline the template is not
+	// part of.
+	Pipeline string
+	// Unselected is set if the template is not part of the selected
+	// pipeline.
+	Unselected bool
+}
+
+// FindOrphans parses the headers of all templates within opts.Folders
+// and returns every template that is the only one being part of one
+// of its pipelines as well as every template that is not part of
+// opts.Pipeline, which is the default pipeline if none is selected.
+// Templates are not rendered and abstract templates are ignored.
+func FindOrphans(opts Options) ([]Orphan, error) {
+	headers, err := scanHeaders(opts)
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[string][]string)
+	orphans := make([]Orphan, 0, 5)
+	for _, h := range headers {
+		if h.Header.Meta.Abstract {
+			continue
+		}
+		if !h.Header.isRelevantForPipeline(opts.Pipeline) {
+			orphans = append(orphans, Orphan{Path: h.Path, Pipeline: opts.Pipeline, Unselected: true})
+		}
+		for _, pipeline := range h.Header.Meta.Pipelines {
+			if pipeline == AllPipelines {
+				continue
+			}
+			paths[pipeline] = append(paths[pipeline], h.Path)
+		}
+	}
+	for pipeline, templates := range paths {
+		if len(templates) == 1 {
+			orphans = append(orphans, Orphan{Path: templates[0], Pipeline: pipeline})
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		if orphans[i].Path != orphans[j].Path {
+			return orphans[i].Path < orphans[j].Path
+		}
+		if orphans[i].Pipeline != orphans[j].Pipeline {
+			return orphans[i].Pipeline < orphans[j].Pipeline
+		}
+		return !orphans[i].Unselected && orphans[j].Unselected
+	})
+	return orphans, nil
+}
@@ -0,0 +1,48 @@
+package piper
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindOrphans(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\n  pipelines: [prod, staging]\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/jobs/deploy.yml", []byte("meta:\n  name: deploy\n  pipelines: [prod, stagign]\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/resources/source.yml", []byte(`meta:
+  name: source
+  pipelines: [staging]
+data:
+  type: git
+---
+meta:
+  name: notify
+  pipelines: ["*"]
+data:
+  type: slack
+`), 0600)
+	afero.WriteFile(fs, "/resources/default.yml", []byte("meta:\n  name: default\ndata:\n  type: git"), 0600)
+
+	orphans, err := FindOrphans(Options{Fs: fs, Folders: []string{"/"}, Pipeline: "prod"})
+	require.NoError(t, err)
+	require.Equal(t, []Orphan{
+		{Path: "/jobs/deploy.yml", Pipeline: "stagign"},
+		{Path: "/resources/default.yml", Pipeline: "prod", Unselected: true},
+		{Path: "/resources/source.yml#1", Pipeline: "prod", Unselected: true},
+	}, orphans)
+
+	orphans, err = FindOrphans(Options{Fs: fs, Folders: []string{"/"}})
+	require.NoError(t, err)
+	require.Equal(t, []Orphan{
+		{Path: "/jobs/build.yml", Pipeline: "", Unselected: true},
+		{Path: "/jobs/deploy.yml", Pipeline: "", Unselected: true},
+		{Path: "/jobs/deploy.yml", Pipeline: "stagign"},
+		{Path: "/resources/source.yml#1", Pipeline: "", Unselected: true},
+	}, orphans)
+
+	afero.WriteFile(fs, "/groups/broken.yml", []byte("meta: [\ndata:\n  jobs: []"), 0600)
+	_, err = FindOrphans(Options{Fs: fs, Folders: []string{"/"}})
+	require.Error(t, err)
+}
@@ -0,0 +1,55 @@
+package piper
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+// OutputContext is the context output templates are executed with.
+type OutputContext struct {
+	Pipeline *Pipeline
+	// YAML is the pipeline rendered as YAML document.
+	YAML string
+}
+
+// LoadOutputTemplate parses the output template at the given path.
+// Output templates wrap the generated pipeline, e.g. to embed it into
+// a larger document, and have access to the same functions and
+// partials as the templates of the pipeline itself.
+func LoadOutputTemplate(opts Options, path string) (*template.Template, error) {
+	opts = opts.withDefaults()
+	data, err := readTemplateFile(opts, path)
+	if err != nil {
+		return nil, err
+	}
+	partials, err := loadFolderPartials(opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse partial templates: %w", err)
+	}
+	context := ResourceInstanceContext{Params: []Param{}, Pipeline: opts.Pipeline, Vars: opts.Vars}
+	funcs := generateFuncMap(context, partials, opts)
+	// The output context isn't an instance context, so partials
+	// called with it are executed with an empty one instead.
+	if partial, ok := funcs["partial"].(func(string, int, ResourceInstanceContext, ...interface{}) (string, error)); ok {
+		funcs["partial"] = func(name string, indentation int, data interface{}, kwargs ...interface{}) (string, error) {
+			if instanceContext, ok := data.(ResourceInstanceContext); ok {
+				return partial(name, indentation, instanceContext, kwargs...)
+			}
+			return partial(name, indentation, context, kwargs...)
+		}
+	}
+	tmpl, err := template.New(path).Funcs(funcs).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse output template: %w", err)
+	}
+	return tmpl, nil
+}
+
+func executeOutputTemplate(tmpl *template.Template, p *Pipeline, data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, OutputContext{Pipeline: p, YAML: string(data)}); err != nil {
+		return nil, fmt.Errorf("failed to render output template: %w", err)
+	}
+	return out.Bytes(), nil
+}
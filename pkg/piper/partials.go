@@ -0,0 +1,78 @@
+package piper
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/afero"
+)
+
+// PartialKind describes how a partial became available under its
+// name.
+type PartialKind string
+
+const (
+	// PartialFile is a partial available under its filename.
+	PartialFile PartialKind = "file"
+	// PartialAlias is a partial available under its filename without
+	// extension.
+	PartialAlias PartialKind = "alias"
+	// PartialBlock is a block defined within a partial using
+	// {{ define }}.
+	PartialBlock PartialKind = "block"
+)
+
+// PartialInfo is a name templates can pass to partial and the file
+// the partial is loaded from.
+type PartialInfo struct {
+	Name string
+	Kind PartialKind
+	Path string
+}
+
+// ListPartials loads the partials of all configured folders and
+// returns every name they are available under sorted by name. If a
+// partial of a later folder replaces one of an earlier folder, only
+// the later one is returned.
+func ListPartials(opts Options) ([]PartialInfo, error) {
+	opts = opts.withDefaults()
+	partials, err := loadFolderPartials(opts)
+	if err != nil {
+		return nil, err
+	}
+	files, err := partialFiles(opts.Fs, partialFolders(opts)...)
+	if err != nil {
+		return nil, err
+	}
+	infos := make(map[string]PartialInfo)
+	for _, filename := range files {
+		fn := filepath.Base(filename)
+		infos[fn] = PartialInfo{Name: fn, Kind: PartialFile, Path: filename}
+		if alias := strings.TrimSuffix(fn, filepath.Ext(fn)); alias != fn {
+			infos[alias] = PartialInfo{Name: alias, Kind: PartialAlias, Path: filename}
+		}
+		data, err := afero.ReadFile(opts.Fs, filename)
+		if err != nil {
+			return nil, err
+		}
+		standalone, err := template.New(fn).Funcs(generateFuncMap(ResourceInstanceContext{Params: []Param{}}, partials, opts)).Parse(string(data))
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range standalone.Templates() {
+			if name := block.Name(); name != fn {
+				infos[name] = PartialInfo{Name: name, Kind: PartialBlock, Path: filename}
+			}
+		}
+	}
+	result := make([]PartialInfo, 0, len(infos))
+	for _, info := range infos {
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
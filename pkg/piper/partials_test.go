@@ -0,0 +1,31 @@
+package piper
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListPartials(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/base/partials/source.yml", []byte("type: git"), 0600)
+	afero.WriteFile(fs, "/base/partials/helpers.tmpl", []byte(`{{ define "notify" }}put: slack{{ end }}`), 0600)
+	afero.WriteFile(fs, "/team/partials/source.yml", []byte("type: hg"), 0600)
+	afero.WriteFile(fs, "/team/partials/README", []byte("docs"), 0600)
+
+	partials, err := ListPartials(Options{Fs: fs, Folders: []string{"/base", "/team"}})
+	require.NoError(t, err)
+	require.Equal(t, []PartialInfo{
+		{Name: "README", Kind: PartialFile, Path: "/team/partials/README"},
+		{Name: "helpers", Kind: PartialAlias, Path: "/base/partials/helpers.tmpl"},
+		{Name: "helpers.tmpl", Kind: PartialFile, Path: "/base/partials/helpers.tmpl"},
+		{Name: "notify", Kind: PartialBlock, Path: "/base/partials/helpers.tmpl"},
+		{Name: "source", Kind: PartialAlias, Path: "/team/partials/source.yml"},
+		{Name: "source.yml", Kind: PartialFile, Path: "/team/partials/source.yml"},
+	}, partials)
+
+	afero.WriteFile(fs, "/team/partials/notify.yml", []byte("put: mail"), 0600)
+	_, err = ListPartials(Options{Fs: fs, Folders: []string{"/base", "/team"}})
+	require.Error(t, err)
+}
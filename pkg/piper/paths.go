@@ -0,0 +1,23 @@
+package piper
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// resolvePath joins path to root. Templates must not be able to read
+// arbitrary files, so absolute paths and paths escaping root, e.g.
+// using "..", are rejected. Every function reading files on behalf of
+// a template has to resolve them using this function.
+func resolvePath(root string, path string) (string, error) {
+	if filepath.IsAbs(path) {
+		return "", fmt.Errorf("path %s is not allowed: absolute paths are not supported", path)
+	}
+	joined := filepath.Join(root, path)
+	rel, err := filepath.Rel(filepath.Clean(root), joined)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s is not allowed: it escapes %s", path, root)
+	}
+	return joined, nil
+}
@@ -0,0 +1,34 @@
+package piper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolvePath(t *testing.T) {
+	tests := []struct {
+		root   string
+		path   string
+		result string
+		valid  bool
+	}{
+		{root: "/src", path: "data.csv", result: "/src/data.csv", valid: true},
+		{root: "/src", path: "sub/../data.csv", result: "/src/data.csv", valid: true},
+		{root: "src", path: "./sub/data.csv", result: "src/sub/data.csv", valid: true},
+		{root: "/src", path: "../../etc/passwd", valid: false},
+		{root: "/src", path: "sub/../../etc/passwd", valid: false},
+		{root: "/src", path: "..", valid: false},
+		{root: "/src", path: "/etc/passwd", valid: false},
+	}
+	for _, test := range tests {
+		result, err := resolvePath(test.root, test.path)
+		if !test.valid {
+			require.Error(t, err, test.path)
+			require.Contains(t, err.Error(), test.path)
+			continue
+		}
+		require.NoError(t, err, test.path)
+		require.Equal(t, test.result, result)
+	}
+}
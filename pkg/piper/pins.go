@@ -0,0 +1,76 @@
+package piper
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Pin is the image version a resource type is pinned to.
+type Pin struct {
+	// Tag replaces the source.tag of the resource type.
+	Tag string `yaml:"tag"`
+	// Digest replaces the source.digest of the resource type.
+	Digest string `yaml:"digest"`
+}
+
+// LoadPins reads a YAML file mapping names of resource types to the
+// version they are pinned to, to be used as Options.Pins.
+func LoadPins(fs afero.Fs, path string) (map[string]Pin, error) {
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	var pins map[string]Pin
+	if err := yaml.UnmarshalStrict(data, &pins); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for name, pin := range pins {
+		if pin.Tag == "" && pin.Digest == "" {
+			return nil, fmt.Errorf("failed to parse %s: pin of %s has neither a tag nor a digest", path, name)
+		}
+	}
+	return pins, nil
+}
+
+// pinResourceTypes sets the tag and digest of every resource type
+// having a pin. Pins not matching any resource type are reported as
+// warning as they are most likely outdated or misspelled.
+func pinResourceTypes(log *logrus.Logger, resourceTypes []Resource, pins map[string]Pin) {
+	used := make(map[string]struct{}, len(pins))
+	for _, r := range resourceTypes {
+		pin, ok := pins[r.String()]
+		if !ok {
+			continue
+		}
+		used[r.String()] = struct{}{}
+		set := func(key string, value string) {
+			if value == "" {
+				return
+			}
+			switch source := r["source"].(type) {
+			case map[interface{}]interface{}:
+				source[key] = value
+			case map[string]interface{}:
+				source[key] = value
+			case nil:
+				r["source"] = map[interface{}]interface{}{key: value}
+			}
+		}
+		set("tag", pin.Tag)
+		set("digest", pin.Digest)
+	}
+	unused := make([]string, 0, len(pins))
+	for name := range pins {
+		if _, ok := used[name]; !ok {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	for _, name := range unused {
+		log.Warnf("Pin of %s doesn't match any resource type", name)
+	}
+}
@@ -0,0 +1,51 @@
+package piper
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPins(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.WarnLevel)
+	log.Out = ioutil.Discard
+	hook := &captureHook{}
+	log.Hooks.Add(hook)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/resource_types/slack.yml", []byte("meta:\n  name: slack\ndata:\n  type: registry-image\n  source:\n    repository: cfcommunity/slack-notification-resource\n    tag: latest"), 0600)
+	afero.WriteFile(fs, "/resource_types/git.yml", []byte("meta:\n  name: git\ndata:\n  type: registry-image"), 0600)
+	afero.WriteFile(fs, "/resource_types/mock.yml", []byte("meta:\n  name: mock\ndata:\n  type: registry-image\n  source:\n    repository: concourse/mock-resource\n    tag: \"0.11\""), 0600)
+	afero.WriteFile(fs, "/pins.yml", []byte("slack:\n  tag: v1.5.0\ngit:\n  digest: sha256:abc\nsemver:\n  tag: \"1.6\"\n"), 0600)
+	afero.WriteFile(fs, "/empty-pin.yml", []byte("slack: {}\n"), 0600)
+
+	_, err := LoadPins(fs, "/empty-pin.yml")
+	require.EqualError(t, err, "failed to parse /empty-pin.yml: pin of slack has neither a tag nor a digest")
+	pins, err := LoadPins(fs, "/pins.yml")
+	require.NoError(t, err)
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Pins: pins, Log: log})
+	require.NoError(t, err)
+	sources := make(map[string]interface{})
+	for _, r := range result.ResourceTypes {
+		sources[r.String()] = r["source"]
+	}
+	require.Equal(t, map[string]interface{}{
+		"slack": map[interface{}]interface{}{"repository": "cfcommunity/slack-notification-resource", "tag": "v1.5.0"},
+		"git":   map[interface{}]interface{}{"digest": "sha256:abc"},
+		"mock":  map[interface{}]interface{}{"repository": "concourse/mock-resource", "tag": "0.11"},
+	}, sources)
+
+	var warnings []string
+	for _, entry := range hook.entries {
+		if entry.Level == logrus.WarnLevel {
+			warnings = append(warnings, entry.Message)
+		}
+	}
+	require.Equal(t, []string{"Pin of semver doesn't match any resource type"}, warnings)
+}
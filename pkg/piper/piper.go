@@ -0,0 +1,1313 @@
+// Package piper generates Concourse pipelines out of folders of
+// templated jobs, resources, resource types, and groups.
+package piper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// DefaultWorldGroupName is used for the world group if no other
+// name has been configured.
+const DefaultWorldGroupName = "WORLD"
+
+// DefaultPipelineGroupName is the name of the group generated by
+// GroupPerPipeline if no pipeline is selected.
+const DefaultPipelineGroupName = "default"
+
+// Options configure how a pipeline is built.
+type Options struct {
+	// Fs is the filesystem the templates are read from. If nil, the
+	// OS filesystem is used.
+	Fs afero.Fs
+	// Folders are the root folders containing the jobs, resources,
+	// resource_types, groups, and partials folders. They are
+	// processed in order with resources of later folders replacing
+	// resources of earlier folders that have the same name. Defaults
+	// to the current working directory.
+	Folders []string
+	// Pipeline is the name of the pipeline that should be generated.
+	Pipeline string
+	// Vars are made available to all templates as .Vars, including
+	// their meta sections.
+	Vars map[string]string
+	// Env, if set, enables environment-specific category folders:
+	// templates within e.g. jobs.<Env> replace templates with the
+	// same relative path within jobs.
+	Env string
+	// Team limits the generation to templates owned by the given
+	// team. Templates without any teams belong to all teams.
+	Team string
+	// WorldGroup enables the generation of a group containing all
+	// jobs and resources.
+	WorldGroup bool
+	// WorldGroupName is the name of the world group.
+	WorldGroupName string
+	// WorldGroupResourceTypes adds the names of all resource types to
+	// the world group.
+	WorldGroupResourceTypes bool
+	// WorldGroupExclude lists names of jobs, resources, and resource
+	// types that should not be part of the world group.
+	WorldGroupExclude []string
+	// GroupPerPipeline enables the generation of a group for the
+	// selected pipeline named after it (or DefaultPipelineGroupName if
+	// none is selected). Just like the world group, it respects
+	// WorldGroupResourceTypes and WorldGroupExclude.
+	GroupPerPipeline bool
+	// ImageRegistry, if set, is prepended to the source.repository of
+	// every resource type not already pointing to that registry.
+	ImageRegistry string
+	// ResourceDefaults are added to every generated resource that
+	// doesn't set the respective key itself.
+	ResourceDefaults Resource
+	// JobDefaults are added to every generated job that doesn't set
+	// the respective key itself.
+	JobDefaults Resource
+	// Pins maps names of resource types to the tag and digest their
+	// source is set to. Pins not matching any resource type are
+	// logged as warning.
+	Pins map[string]Pin
+	// Base, if set, is the pipeline the generated entries are added
+	// to. Generated entries replace entries of the base pipeline that
+	// have the same name.
+	Base *Pipeline
+	// NameFilter, if set, is a glob pattern all groups, resource
+	// types, resources, jobs, and var sources have to match. Entries not matching
+	// it are removed from the pipeline. The pattern is applied before
+	// NamePrefix.
+	NameFilter string
+	// PruneNameFilter additionally removes all references to entries
+	// removed due to NameFilter.
+	PruneNameFilter bool
+	// NamePrefix, if set, is prepended to the name of every generated
+	// entry. References between them are updated accordingly.
+	NamePrefix string
+	// Normalize canonicalizes the values of well-known fields, e.g.
+	// "true" becomes true and a single passed job becomes a list, so
+	// that equivalent templates produce identical output.
+	Normalize bool
+	// DedupNames renames entries whose name is already used by an
+	// earlier entry of the same category and folder instead of
+	// leaving the duplicate for Validate to report. See dedupNames
+	// for which references are updated.
+	DedupNames bool
+	// StrictInstances rejects templates with multiple instances whose
+	// name_template renders the same name for different instances,
+	// e.g. because it doesn't use .Instance.
+	StrictInstances bool
+	// PrintContext logs the context every instance is rendered with
+	// at debug level.
+	PrintContext bool
+	// Funcs are additional functions made available to all
+	// templates. They are merged into the built-in functions, which
+	// win on name collisions unless OverrideFuncs is set.
+	Funcs template.FuncMap
+	// OverrideFuncs lets functions in Funcs replace built-in
+	// functions of the same name.
+	OverrideFuncs bool
+	// FailFast stops the generation of all categories as soon as one
+	// of them fails. Otherwise every category is loaded completely and
+	// all errors are reported together.
+	FailFast bool
+	// Sequential loads the categories one after another (resource
+	// types, resources, jobs, groups, var sources) instead of
+	// concurrently. The result is the same but log messages appear in
+	// a stable order.
+	Sequential bool
+	// MaxFileSize is the maximum size in bytes a template file may
+	// have. Larger files are rejected before being read. A value of 0
+	// disables the limit.
+	MaxFileSize int64
+	// MaxInstances is the maximum number of instances a single
+	// template may define as well as the maximum number of entries the
+	// whole pipeline may consist of. A value of 0 disables the limit.
+	MaxInstances int
+	// ReadRetries is the number of times reading a template file is
+	// retried after a failure other than the file not existing, e.g.
+	// due to a flaky network filesystem. The delay between attempts
+	// doubles with every retry.
+	ReadRetries int
+	// PreHook, if set, is a shell command every template file is
+	// piped through before its header is parsed and it is rendered.
+	// The command's stdout replaces the content of the template.
+	PreHook string
+	// Cache, if set, is used to skip rendering template files that
+	// haven't changed since the cache was last updated.
+	Cache *Cache
+	// Log is used for all logging output. If nil, the standard
+	// logger of logrus is used.
+	Log *logrus.Logger
+
+	// rendering lists the templates currently being rendered through
+	// renderResource with the innermost one being last.
+	rendering []string
+	// inputs, if set, collects glob patterns of the files besides the
+	// template itself the generated resources depend on, e.g. those
+	// rendered through renderResource, so that they aren't cached.
+	inputs *[]string
+}
+
+func (o Options) withDefaults() Options {
+	if o.Fs == nil {
+		o.Fs = afero.NewOsFs()
+	}
+	if len(o.Folders) == 0 {
+		o.Folders = []string{"."}
+	}
+	if o.WorldGroupName == "" {
+		o.WorldGroupName = DefaultWorldGroupName
+	}
+	if o.Log == nil {
+		o.Log = logrus.StandardLogger()
+	}
+	return o
+}
+
+func findHeader(data []byte) ([]byte, error) {
+	idx := bytes.Index(data, []byte("data:\n"))
+	if idx == -1 {
+		return nil, fmt.Errorf("could not find header")
+	}
+	return data[0 : idx-1], nil
+}
+
+// Build generates a pipeline out of the templates found inside
+// opts.Folders.
+func Build(ctx context.Context, opts Options) (*Pipeline, error) {
+	opts = opts.withDefaults()
+	p := Pipeline{}
+
+	partials, err := loadFolderPartials(opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse partial templates: %s", err.Error())
+	}
+	if opts.Cache != nil {
+		key, err := cacheKey(opts)
+		if err != nil {
+			return nil, fmt.Errorf("could not compute cache key: %s", err.Error())
+		}
+		opts.Cache.reset(key)
+	}
+
+	var resourceOrigins, jobOrigins, resourceTypeOrigins, groupOrigins, varSourceOrigins []Origin
+	wg := sync.WaitGroup{}
+	errorWg := sync.WaitGroup{}
+	errorWg.Add(1)
+	cancelContext, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errChan := make(chan error, 5)
+	var errs Errors
+	go func() {
+		defer errorWg.Done()
+		for e := range errChan {
+			if opts.FailFast && len(errs) > 0 {
+				continue
+			}
+			errs = append(errs, e)
+			if opts.FailFast {
+				cancel()
+			}
+		}
+	}()
+
+	// The categories are listed in the order they are loaded in when
+	// opts.Sequential is set.
+	loaders := []struct {
+		category string
+		store    func(resources []Resource, origins []Origin)
+	}{
+		{"resource_types", func(resources []Resource, origins []Origin) {
+			p.ResourceTypes = resources
+			resourceTypeOrigins = origins
+		}},
+		{"resources", func(resources []Resource, origins []Origin) {
+			p.Resources = resources
+			resourceOrigins = origins
+		}},
+		{"jobs", func(resources []Resource, origins []Origin) {
+			p.Jobs = resources
+			jobOrigins = origins
+		}},
+		{"groups", func(resources []Resource, origins []Origin) {
+			p.Groups = resources
+			groupOrigins = origins
+		}},
+		{"var_sources", func(resources []Resource, origins []Origin) {
+			// var_sources are optional, so they are left out entirely
+			// unless there are any.
+			if len(resources) > 0 {
+				p.VarSources = resources
+			}
+			varSourceOrigins = origins
+		}},
+	}
+	load := func(category string, store func([]Resource, []Origin)) error {
+		resources, origins, e := loadCategory(cancelContext, opts, category, partials)
+		if e != nil {
+			return fmt.Errorf("failed to load %s: %w", category, e)
+		}
+		store(resources, origins)
+		return nil
+	}
+	if opts.Sequential {
+		for _, loader := range loaders {
+			if e := load(loader.category, loader.store); e != nil {
+				errChan <- e
+				if opts.FailFast {
+					break
+				}
+			}
+		}
+	} else {
+		wg.Add(len(loaders))
+		for _, loader := range loaders {
+			loader := loader
+			go func() {
+				defer wg.Done()
+				if e := load(loader.category, loader.store); e != nil {
+					errChan <- e
+				}
+			}()
+		}
+	}
+
+	wg.Wait()
+	close(errChan)
+	errorWg.Wait()
+	err = errs.orNil()
+	p.Origins = make([]Origin, 0, len(resourceTypeOrigins)+len(resourceOrigins)+len(jobOrigins)+len(groupOrigins)+len(varSourceOrigins))
+	p.Origins = append(p.Origins, resourceTypeOrigins...)
+	p.Origins = append(p.Origins, resourceOrigins...)
+	p.Origins = append(p.Origins, jobOrigins...)
+	p.Origins = append(p.Origins, groupOrigins...)
+	p.Origins = append(p.Origins, varSourceOrigins...)
+	p.IndexOrigins()
+	if opts.DedupNames && err == nil {
+		if e := checkDedupReferences(&p); e != nil {
+			return &p, fmt.Errorf("ambiguous references to renamed entries: %w", e)
+		}
+	}
+
+	if e := applyDefaults(p.Resources, opts.ResourceDefaults); e != nil {
+		return &p, fmt.Errorf("failed to apply resource defaults: %w", e)
+	}
+	if e := applyDefaults(p.Jobs, opts.JobDefaults); e != nil {
+		return &p, fmt.Errorf("failed to apply job defaults: %w", e)
+	}
+	if opts.Base != nil {
+		mergeBase(opts.Log, opts.Base, &p)
+	}
+	if count := len(p.Groups) + len(p.ResourceTypes) + len(p.Resources) + len(p.Jobs) + len(p.VarSources); err == nil && opts.MaxInstances > 0 && count > opts.MaxInstances {
+		return &p, fmt.Errorf("the pipeline consists of %d entries exceeding the maximum of %d", count, opts.MaxInstances)
+	}
+	if e := sortResourceTypes(opts.Log, &p); e != nil {
+		return &p, e
+	}
+	if opts.ImageRegistry != "" {
+		rewriteImageRegistry(p.ResourceTypes, opts.ImageRegistry)
+	}
+	if len(opts.Pins) > 0 {
+		pinResourceTypes(opts.Log, p.ResourceTypes, opts.Pins)
+	}
+	if opts.Normalize {
+		normalize(&p)
+	}
+	if opts.WorldGroup {
+		worldGroup, e := generateWorldGroup(opts, &p)
+		if e != nil {
+			return &p, fmt.Errorf("failed to generate world group: %w", e)
+		}
+		p.Groups = append([]Resource{worldGroup}, p.Groups...)
+	}
+	if opts.GroupPerPipeline {
+		groups, e := generatePipelineGroups(opts, &p)
+		if e != nil {
+			return &p, fmt.Errorf("failed to generate pipeline groups: %w", e)
+		}
+		p.Groups = append(p.Groups, groups...)
+	}
+	metaGroups, e := generateMetaGroups(&p)
+	if e != nil {
+		return &p, fmt.Errorf("failed to generate groups from meta.groups: %w", e)
+	}
+	p.Groups = append(p.Groups, metaGroups...)
+	if opts.NameFilter != "" {
+		if e := filterNames(&p, opts.NameFilter, opts.PruneNameFilter); e != nil {
+			return &p, e
+		}
+	}
+	if opts.NamePrefix != "" {
+		applyNamePrefix(&p, opts.NamePrefix)
+	}
+
+	return &p, err
+}
+
+// Render generates the resources of a single template file that
+// doesn't have to be located inside any of the configured folders.
+// The partials of all configured folders are available to the
+// template. name is used for error reporting.
+func Render(opts Options, name string, data []byte) ([]Resource, error) {
+	opts = opts.withDefaults()
+	partials, err := loadFolderPartials(opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse partial templates: %s", err.Error())
+	}
+	resources, _, err := generateFileResources(name, data, partials, opts)
+	return resources, err
+}
+
+// loadFolderPartials loads the partials of all configured folders.
+func loadFolderPartials(opts Options) (*template.Template, error) {
+	return loadPartials(opts, partialFolders(opts)...)
+}
+
+func partialFolders(opts Options) []string {
+	result := make([]string, 0, len(opts.Folders))
+	for _, folder := range opts.Folders {
+		result = append(result, filepath.Join(folder, "partials"))
+	}
+	return result
+}
+
+func generateWorldGroup(opts Options, p *Pipeline) (Resource, error) {
+	return generateGroup(opts, p, opts.WorldGroupName, func(string, string) bool {
+		return true
+	})
+}
+
+// generatePipelineGroups generates a group for the selected pipeline
+// containing the generated jobs, resources, and resource types of
+// templates relevant for it. Entries without an origin, like those of
+// a base pipeline, are left out. If no pipeline is selected, the
+// group is named DefaultPipelineGroupName.
+func generatePipelineGroups(opts Options, p *Pipeline) ([]Resource, error) {
+	name := opts.Pipeline
+	if name == "" {
+		name = DefaultPipelineGroupName
+	}
+	group, err := generateGroup(opts, p, name, func(category string, name string) bool {
+		origin, found := p.Origin(category, name)
+		if !found {
+			return false
+		}
+		header := ResourceConfigHeader{Meta: origin.Meta}
+		return header.isRelevantForPipeline(opts.Pipeline)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []Resource{group}, nil
+}
+
+// generateMetaGroups generates a group for every name listed in the
+// meta.groups of any template. Each group contains the jobs,
+// resources, and resource types generated from the templates listing
+// it; resource types are only included if there are any. Groups are
+// sorted by name.
+func generateMetaGroups(p *Pipeline) ([]Resource, error) {
+	var groupNames []string
+	seen := make(map[string]struct{})
+	for _, origin := range p.Origins {
+		if origin.Category == "groups" {
+			continue
+		}
+		for _, name := range origin.Meta.Groups {
+			if _, exists := seen[name]; !exists {
+				seen[name] = struct{}{}
+				groupNames = append(groupNames, name)
+			}
+		}
+	}
+	sort.Strings(groupNames)
+	groups := make([]Resource, 0, len(groupNames))
+	for _, groupName := range groupNames {
+		group := Resource{"name": groupName}
+		for _, category := range []string{"jobs", "resources", "resource_types"} {
+			resources, _ := p.category(category)
+			names := make([]string, 0, len(resources))
+			for _, r := range resources {
+				origin, found := p.Origin(category, r.String())
+				if !found || !containsString(origin.Meta.Groups, groupName) {
+					continue
+				}
+				name, err := resourceName(p, category, r)
+				if err != nil {
+					return nil, err
+				}
+				names = append(names, name)
+			}
+			if len(names) > 0 || category != "resource_types" {
+				group[category] = names
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// generateGroup generates a group with the given name containing all
+// jobs and resources (and resource types if configured) accepted by
+// include and not excluded through opts.WorldGroupExclude.
+func generateGroup(opts Options, p *Pipeline, groupName string, include func(category string, name string) bool) (Resource, error) {
+	excluded := make(map[string]struct{}, len(opts.WorldGroupExclude))
+	for _, name := range opts.WorldGroupExclude {
+		excluded[name] = struct{}{}
+	}
+	names := func(category string, resources []Resource) ([]string, error) {
+		result := make([]string, 0, len(resources))
+		for _, r := range resources {
+			name, err := resourceName(p, category, r)
+			if err != nil {
+				return nil, err
+			}
+			if _, skip := excluded[name]; skip {
+				continue
+			}
+			if !include(category, name) {
+				continue
+			}
+			result = append(result, name)
+		}
+		return result, nil
+	}
+	var err error
+	r := Resource{}
+	r["name"] = groupName
+	if r["jobs"], err = names("jobs", p.Jobs); err != nil {
+		return nil, err
+	}
+	if r["resources"], err = names("resources", p.Resources); err != nil {
+		return nil, err
+	}
+	if opts.WorldGroupResourceTypes {
+		if r["resource_types"], err = names("resource_types", p.ResourceTypes); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// rewriteImageRegistry prefixes the source.repository of all given
+// resource types with the given registry host. Tags and digests are
+// part of separate fields and therefore left untouched.
+func rewriteImageRegistry(resourceTypes []Resource, registry string) {
+	prefix := strings.TrimSuffix(registry, "/") + "/"
+	for _, r := range resourceTypes {
+		switch source := r["source"].(type) {
+		case map[interface{}]interface{}:
+			if repository, ok := source["repository"].(string); ok && !strings.HasPrefix(repository, prefix) {
+				source["repository"] = prefix + repository
+			}
+		case map[string]interface{}:
+			if repository, ok := source["repository"].(string); ok && !strings.HasPrefix(repository, prefix) {
+				source["repository"] = prefix + repository
+			}
+		}
+	}
+}
+
+// resourceName returns the name of the given resource or an error
+// naming the resource's template if it doesn't have a string name.
+func resourceName(p *Pipeline, category string, r Resource) (string, error) {
+	name, ok := r["name"].(string)
+	if ok {
+		return name, nil
+	}
+	if origin, found := p.Origin(category, r.String()); found {
+		return "", fmt.Errorf("%s entry %s generated from %s has no string name", category, r, origin.Path)
+	}
+	return "", fmt.Errorf("%s entry %s has no string name", category, r)
+}
+
+// loadCategory loads the resources of the given category from all
+// configured folders. Resources of later folders replace resources of
+// earlier folders with the same name.
+func loadCategory(ctx context.Context, opts Options, category string, partials *template.Template) ([]Resource, []Origin, error) {
+	var result []Resource
+	var origins []Origin
+	for idx, folder := range opts.Folders {
+		resources, folderOrigins, err := loadResources(ctx, opts, filepath.Join(folder, category), partials)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range folderOrigins {
+			folderOrigins[i].Category = category
+		}
+		if opts.DedupNames {
+			dedupNames(opts.Log, category, resources, folderOrigins)
+		}
+		origins = append(origins, folderOrigins...)
+		if idx == 0 {
+			result = resources
+			continue
+		}
+		result = overlayResources(opts.Log, folder, result, resources)
+	}
+	return result, origins, nil
+}
+
+// LoadPipeline reads an existing pipeline from the given path, e.g.
+// to be used as Options.Base.
+func LoadPipeline(fs afero.Fs, path string) (*Pipeline, error) {
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	var p Pipeline
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// mergeBase adds all entries of the base pipeline to p that don't
+// have a generated counterpart of the same name. Base entries keep
+// their order and come before all new generated entries.
+func mergeBase(log *logrus.Logger, base *Pipeline, p *Pipeline) {
+	merge := func(base []Resource, generated []Resource) []Resource {
+		result := make([]Resource, 0, len(base)+len(generated))
+		positions := make(map[string]int, len(base))
+		for _, r := range base {
+			positions[r.String()] = len(result)
+			result = append(result, r)
+		}
+		for _, r := range generated {
+			if idx, exists := positions[r.String()]; exists {
+				log.Debugf("%s replaces the definition of the base pipeline", r)
+				result[idx] = r
+				continue
+			}
+			result = append(result, r)
+		}
+		return result
+	}
+	p.Groups = merge(base.Groups, p.Groups)
+	p.ResourceTypes = merge(base.ResourceTypes, p.ResourceTypes)
+	p.Resources = merge(base.Resources, p.Resources)
+	p.Jobs = merge(base.Jobs, p.Jobs)
+	p.VarSources = merge(base.VarSources, p.VarSources)
+}
+
+// sortResourceTypes orders the resource types of the pipeline so that
+// every resource type comes after the resource types listed in its
+// meta.requires. Apart from that the original order is kept.
+func sortResourceTypes(log *logrus.Logger, p *Pipeline) error {
+	if len(p.ResourceTypes) == 0 {
+		return nil
+	}
+	positions := make(map[string]int, len(p.ResourceTypes))
+	for idx, r := range p.ResourceTypes {
+		positions[r.String()] = idx
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(p.ResourceTypes))
+	sorted := make([]Resource, 0, len(p.ResourceTypes))
+	var chain []string
+	var visit func(idx int) error
+	visit = func(idx int) error {
+		r := p.ResourceTypes[idx]
+		switch state[idx] {
+		case visited:
+			return nil
+		case visiting:
+			start := 0
+			for i, name := range chain {
+				if name == r.String() {
+					start = i
+				}
+			}
+			cycle := append(append([]string{}, chain[start:]...), r.String())
+			return fmt.Errorf("resource types require each other: %s", strings.Join(cycle, " -> "))
+		}
+		state[idx] = visiting
+		chain = append(chain, r.String())
+		origin, _ := p.Origin("resource_types", r.String())
+		for _, required := range origin.Meta.Requires {
+			requiredIdx, exists := positions[required]
+			if !exists {
+				log.Warnf("%s requires unknown resource type %s", r, required)
+				continue
+			}
+			if err := visit(requiredIdx); err != nil {
+				return err
+			}
+		}
+		chain = chain[:len(chain)-1]
+		state[idx] = visited
+		sorted = append(sorted, r)
+		return nil
+	}
+	for idx := range p.ResourceTypes {
+		if err := visit(idx); err != nil {
+			return err
+		}
+	}
+	p.ResourceTypes = sorted
+	return nil
+}
+
+// overlayResources adds all overlay resources to base. Resources
+// with a name already present in base replace the original entry
+// while all others are appended.
+func overlayResources(log *logrus.Logger, folder string, base []Resource, overlay []Resource) []Resource {
+	positions := make(map[string]int, len(base))
+	for idx, r := range base {
+		positions[r.String()] = idx
+	}
+	for _, r := range overlay {
+		if idx, exists := positions[r.String()]; exists {
+			log.Warnf("%s from %s overrides a previous definition", r, folder)
+			base[idx] = r
+			continue
+		}
+		positions[r.String()] = len(base)
+		base = append(base, r)
+	}
+	return base
+}
+
+// templateSuffixes lists all file extensions that are processed as
+// templates.
+var templateSuffixes = []string{".yml", ".yaml", ".yml.tmpl", ".yaml.tmpl", ".json"}
+
+func isTemplateFile(path string) bool {
+	for _, suffix := range templateSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// templateFiles returns the paths of all template files within the
+// given category folder in lexical order. If opts.Env is set, files
+// of the folder's environment-specific counterpart (e.g. jobs.prod)
+// replace files with the same relative path and are added otherwise.
+func templateFiles(opts Options, path string) ([]string, error) {
+	files := make(map[string]string)
+	roots := []string{path}
+	if opts.Env != "" {
+		roots = append(roots, path+"."+opts.Env)
+	}
+	for _, root := range roots {
+		err := afero.Walk(opts.Fs, root, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !isTemplateFile(p) {
+				return nil
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			if existing, exists := files[rel]; exists {
+				opts.Log.Debugf("%s replaces %s", p, existing)
+			}
+			files[rel] = p
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	rels := make([]string, 0, len(files))
+	for rel := range files {
+		rels = append(rels, rel)
+	}
+	// Sort component-wise to keep the order of afero.Walk, which
+	// e.g. processes a/b.yml before a-b.yml.
+	sort.Slice(rels, func(i, j int) bool {
+		a := strings.Split(rels[i], string(filepath.Separator))
+		b := strings.Split(rels[j], string(filepath.Separator))
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	result := make([]string, 0, len(rels))
+	for _, rel := range rels {
+		result = append(result, files[rel])
+	}
+	return result, nil
+}
+
+func loadResources(ctx context.Context, opts Options, path string, partials *template.Template) ([]Resource, []Origin, error) {
+	log := opts.Log
+	resources := make([]Resource, 0, 10)
+	origins := make([]Origin, 0, 10)
+	files, err := templateFiles(opts, path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to process paths: %s: %w", path, err)
+	}
+	for _, p := range files {
+		select {
+		case <-ctx.Done():
+			return nil, nil, fmt.Errorf("failed to process paths: %s: %w", path, ctx.Err())
+		default:
+		}
+		log.Infof("Processing %s", p)
+		data, err := loadTemplateFile(opts, p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to process paths: %s: %w", path, err)
+		}
+		var hash string
+		if opts.Cache != nil {
+			hash = hashData(data)
+			if entry, ok := opts.Cache.get(p, hash); ok {
+				log.Debugf("Using cached result for %s", p)
+				resources = append(resources, entry.Resources...)
+				origins = append(origins, entry.Origins...)
+				continue
+			}
+		}
+		var inputs []string
+		fileOpts := opts
+		fileOpts.inputs = &inputs
+		generated, generatedOrigins, err := generateFileResources(p, data, partials, fileOpts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to process paths: %s: %w", path, err)
+		}
+		if opts.Cache != nil && len(inputs) > 0 {
+			// Changes to the other inputs wouldn't be detected.
+			log.Debugf("Not caching %s as it depends on %s", p, strings.Join(inputs, ", "))
+		} else if opts.Cache != nil {
+			if err := opts.Cache.put(p, CacheEntry{Hash: hash, Resources: generated, Origins: generatedOrigins}); err != nil {
+				return nil, nil, fmt.Errorf("failed to process paths: %s: %w", path, err)
+			}
+		}
+		resources = append(resources, generated...)
+		origins = append(origins, generatedOrigins...)
+	}
+	return resources, origins, nil
+}
+
+// readTemplateFile reads the given template file after making sure
+// that it doesn't exceed opts.MaxFileSize.
+func readTemplateFile(opts Options, path string) ([]byte, error) {
+	if opts.MaxFileSize > 0 {
+		info, err := opts.Fs.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() > opts.MaxFileSize {
+			return nil, fmt.Errorf("%s exceeds the maximum file size of %d bytes (%d bytes)", path, opts.MaxFileSize, info.Size())
+		}
+	}
+	data, err := afero.ReadFile(opts.Fs, path)
+	delay := readRetryDelay
+	for attempt := 1; attempt <= opts.ReadRetries && err != nil && !os.IsNotExist(err); attempt++ {
+		opts.Log.WithError(err).Warnf("Failed to read %s, retrying in %s (%d/%d)", path, delay, attempt, opts.ReadRetries)
+		time.Sleep(delay)
+		delay *= 2
+		data, err = afero.ReadFile(opts.Fs, path)
+	}
+	return data, err
+}
+
+// readRetryDelay is the delay before the first retry of a failed
+// read.
+var readRetryDelay = 100 * time.Millisecond
+
+// generateFileResources renders all documents within a template
+// file.
+func generateFileResources(path string, data []byte, partials *template.Template, opts Options) ([]Resource, []Origin, error) {
+	resources := make([]Resource, 0, 1)
+	origins := make([]Origin, 0, 1)
+	documents := [][]byte{data}
+	if !isJSONFile(path) {
+		documents = splitDocuments(data)
+	}
+	for idx, document := range documents {
+		name := path
+		if len(documents) > 1 {
+			name = fmt.Sprintf("%s#%d", path, idx+1)
+		}
+		generated, generatedOrigins, err := generateResources(name, document, partials, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i := range generatedOrigins {
+			generatedOrigins[i].Path = path
+		}
+		resources = append(resources, generated...)
+		origins = append(origins, generatedOrigins...)
+	}
+	return resources, origins, nil
+}
+
+// sourcePath strips the #N suffix generateFileResources adds to the
+// path of every document of a multi-document template file.
+func sourcePath(name string) string {
+	idx := strings.LastIndex(name, "#")
+	if idx < 0 || idx == len(name)-1 {
+		return name
+	}
+	if _, err := strconv.Atoi(name[idx+1:]); err != nil {
+		return name
+	}
+	return name[:idx]
+}
+
+// generateResources renders all instances of a single template
+// document that are relevant for the selected pipeline. Next to the
+// resources their origins are returned.
+func generateResources(path string, data []byte, partials *template.Template, opts Options) ([]Resource, []Origin, error) {
+	var rc ResourceConfigHeader
+	if err := parseTemplateHeader(opts, partials, path, &rc, data); err != nil {
+		return nil, nil, &GenerationError{Path: path, Phase: PhaseHeader, Err: err}
+	}
+	if opts.inputs != nil {
+		*opts.inputs = append(*opts.inputs, rc.Meta.inputs...)
+	}
+	if rc.Meta.Abstract {
+		opts.Log.Debugf("Skipping %s as it is abstract", path)
+		return nil, nil, nil
+	}
+	if !rc.isRelevantForPipeline(opts.Pipeline) || !rc.isRelevantForTeam(opts.Team) {
+		return nil, nil, nil
+	}
+	if count := len(rc.Meta.AllInstances()); opts.MaxInstances > 0 && count > opts.MaxInstances {
+		return nil, nil, &GenerationError{Path: path, Phase: PhaseHeader, Err: fmt.Errorf("%d instances exceed the maximum of %d", count, opts.MaxInstances)}
+	}
+	resources := make([]Resource, 0, len(rc.Meta.AllInstances()))
+	origins := make([]Origin, 0, len(rc.Meta.AllInstances()))
+	instancesByName := make(map[string]string)
+	for _, instance := range rc.Meta.AllInstances() {
+		var instanceRC ResourceConfig
+		if err := generateInstance(&instanceRC, instance, path, data, rc, partials, opts); err != nil {
+			return nil, nil, err
+		}
+		if len(instanceRC.Data) == 0 && hasBody(data) {
+			opts.Log.Debugf("Skipping instance %s of %s as its data section rendered empty", instance, path)
+			continue
+		}
+		resource := convertToResource(instanceRC, rc.Meta.Singleton())
+		if opts.StrictInstances && !rc.Meta.Singleton() {
+			if other, ok := instancesByName[resource.String()]; ok {
+				return nil, nil, &GenerationError{Path: path, Phase: PhaseRender, Err: fmt.Errorf("instances %s and %s are both named %s: name_template has to render a distinct name for every instance, e.g. using .Instance", other, instance, resource)}
+			}
+			instancesByName[resource.String()] = instance
+		}
+		resources = append(resources, resource)
+		origins = append(origins, Origin{
+			Name:     resource.String(),
+			Path:     path,
+			Instance: instance,
+			Pipeline: opts.Pipeline,
+			Meta:     instanceRC.Meta,
+			Inputs:   rc.Meta.inputs,
+		})
+	}
+	return resources, origins, nil
+}
+
+// blockScalarPattern matches lines whose value is a literal or
+// folded block scalar, e.g. "script: |" or "- >-".
+var blockScalarPattern = regexp.MustCompile(`(?:^|:|-)\s+[|>][1-9+-]{0,2}\s*(?:#.*)?$`)
+
+// splitDocuments splits the content of a file into its YAML
+// documents separated by "---" lines. Only lines starting in the
+// first column outside of block scalars separate documents, so a
+// literal block may contain "---" as well. Empty documents are
+// dropped.
+func splitDocuments(data []byte) [][]byte {
+	documents := make([][]byte, 0, 1)
+	var current []byte
+	// blockIndent is the indentation of the line introducing the
+	// current block scalar or -1 outside of block scalars.
+	blockIndent := -1
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+		indent := len(trimmed) - len(bytes.TrimLeft(trimmed, " "))
+		if blockIndent >= 0 && (len(trimmed) == 0 || indent > blockIndent) {
+			current = append(current, line...)
+			continue
+		}
+		blockIndent = -1
+		if string(trimmed) == "---" {
+			documents = append(documents, current)
+			current = nil
+			continue
+		}
+		if !bytes.HasPrefix(bytes.TrimSpace(trimmed), []byte("#")) && blockScalarPattern.Match(trimmed) {
+			blockIndent = indent
+		}
+		current = append(current, line...)
+	}
+	documents = append(documents, current)
+	result := make([][]byte, 0, len(documents))
+	for _, document := range documents {
+		if len(bytes.TrimSpace(document)) > 0 {
+			result = append(result, document)
+		}
+	}
+	return result
+}
+
+func generateInstance(output *ResourceConfig, instance string, path string, data []byte, input ResourceConfigHeader, partials *template.Template, opts Options) error {
+	var buf bytes.Buffer
+	log := opts.Log
+	params, ok := input.Meta.Params[instance]
+	if !ok {
+		params = make([]Param, 0)
+	}
+	log.WithField("instance", instance).Debugf("Params: %v", params)
+	instanceContext := ResourceInstanceContext{
+		Instance:     instance,
+		AllInstances: input.Meta.AllInstances(),
+		Params:       params,
+		Pipeline:     opts.Pipeline,
+		SourcePath:   sourcePath(path),
+		Vars:         opts.Vars,
+		paramSources: input.Meta.paramsBySource(instance),
+		allParams:    input.Meta.Params,
+	}
+	if opts.PrintContext {
+		logContext(log, instanceContext)
+	}
+	funcs := generateFuncMap(instanceContext, partials, opts)
+	// The template is named after its path so that errors reported by
+	// the template engine point to the actual source file.
+	tmpl, err := template.New(path).Funcs(funcs).Parse(string(data))
+	if err != nil {
+		log.Error(string(data))
+		return &GenerationError{Path: path, Instance: instance, Phase: PhaseParse, Err: err}
+	}
+	if err := tmpl.Execute(&buf, instanceContext); err != nil {
+		return &GenerationError{Path: path, Instance: instance, Phase: PhaseRender, Err: err}
+	}
+	// Only copy the rendered template if it is actually logged.
+	if log.Level >= logrus.DebugLevel {
+		log.WithField("path", path).WithField("instance", instance).Debugf("Rendered template:\n%s", buf.String())
+	}
+	if err := yaml.Unmarshal(buf.Bytes(), output); err != nil {
+		log.Error(buf.String())
+		return &GenerationError{Path: path, Instance: instance, Phase: PhaseUnmarshal, Err: err}
+	}
+	return nil
+}
+
+// logContext logs the given context as YAML at debug level.
+func logContext(log *logrus.Logger, context ResourceInstanceContext) {
+	data, err := yaml.Marshal(yaml.MapSlice{
+		{Key: "Instance", Value: context.Instance},
+		{Key: "AllInstances", Value: context.AllInstances},
+		{Key: "Pipeline", Value: context.Pipeline},
+		{Key: "SourcePath", Value: context.SourcePath},
+		{Key: "Params", Value: context.Params},
+		{Key: "Vars", Value: context.Vars},
+		{Key: "Args", Value: context.Args},
+	})
+	if err != nil {
+		log.WithError(err).Warnf("Failed to print the context of %s", context.SourcePath)
+		return
+	}
+	log.WithField("path", context.SourcePath).WithField("instance", context.Instance).Debugf("Context:\n%s", data)
+}
+
+func convertToResource(rc ResourceConfig, singleton bool) Resource {
+	resource := Resource{}
+	resource["name"] = rc.Meta.NameTemplate
+	if singleton {
+		resource["name"] = rc.Meta.Name
+	}
+	for k, v := range rc.Data {
+		resource[k] = v
+	}
+	return resource
+}
+
+// hasBody returns true if the data section of the given template
+// contains anything before rendering. Templates with a body that
+// renders to an empty data section are skipped entirely while
+// templates with an empty body still produce a resource consisting
+// of just the name.
+func hasBody(data []byte) bool {
+	idx := bytes.Index(data, []byte("data:\n"))
+	if idx == -1 {
+		return false
+	}
+	return len(bytes.TrimSpace(data[idx+len("data:\n"):])) > 0
+}
+
+// parseTemplateHeader parses the header of the given template using
+// the format matching the template's path.
+func parseTemplateHeader(opts Options, partials *template.Template, path string, rc *ResourceConfigHeader, data []byte) error {
+	header, err := renderHeader(opts, partials, path, data)
+	if err != nil {
+		return err
+	}
+	if isJSONFile(path) {
+		err = yaml.Unmarshal(header, &rc.Meta)
+	} else {
+		err = yaml.Unmarshal(header, &rc)
+	}
+	if err != nil {
+		return err
+	}
+	if err := expandInstancesFrom(opts, path, &rc.Meta); err != nil {
+		return err
+	}
+	return expandInstancesGlob(opts, path, &rc.Meta)
+}
+
+func isJSONFile(path string) bool {
+	return strings.HasSuffix(path, ".json")
+}
+
+// findJSONHeader returns the meta section of a JSON template. Only the
+// JSON up to the meta section has to be valid before rendering, so
+// the meta section should come first.
+func findJSONHeader(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		if tok == "meta" {
+			return value, nil
+		}
+	}
+	return nil, fmt.Errorf("could not find header")
+}
+
+// findTemplateHeader returns the header of the given template using
+// the format matching the template's path.
+func findTemplateHeader(path string, data []byte) ([]byte, error) {
+	if isJSONFile(path) {
+		return findJSONHeader(data)
+	}
+	return findHeader(data)
+}
+
+// renderHeader returns the header of a template after rendering it
+// once so that e.g. meta.instances can be computed from opts.Vars.
+// Only headers referring to .Vars are rendered, all others are
+// returned as they are. Actions like a name_template using param can
+// only be rendered once the instance is known. If rendering fails, the
+// raw header is returned as well.
+//
+// The header is rendered with the same functions and partials as the
+// instances of the template. As no instance exists at this point,
+// .Instance, .Params, and .Args are empty and .AllInstances is only
+// available if the instances don't depend on it. To allow blocks
+// spanning the header and the data section, the whole template is
+// rendered and errors raised after the header has been rendered
+// completely are ignored since the data section is rendered again
+// for every instance afterwards. If the whole template can't be
+// rendered that way, e.g. because of a syntax error within the data
+// section, only the header is rendered.
+func renderHeader(opts Options, partials *template.Template, path string, data []byte) ([]byte, error) {
+	header, err := findTemplateHeader(path, data)
+	if err == nil && !bytes.Contains(header, []byte(".Vars")) {
+		return header, nil
+	}
+	if err != nil && !bytes.Contains(data, []byte(".Vars")) {
+		return nil, err
+	}
+	context := ResourceInstanceContext{
+		Params:     []Param{},
+		Pipeline:   opts.Pipeline,
+		SourcePath: sourcePath(path),
+		Vars:       opts.Vars,
+	}
+	rendered, err := executeHeader(opts, partials, path, data, header, context)
+	if err != nil {
+		if header == nil {
+			return nil, err
+		}
+		opts.Log.WithError(err).Debugf("Using the header of %s as it is as it could not be rendered", path)
+		return header, nil
+	}
+	if !bytes.Contains(data, []byte(".AllInstances")) {
+		return rendered, nil
+	}
+	// Render the header again now that the instances are known.
+	var rc ResourceConfigHeader
+	if isJSONFile(path) {
+		err = yaml.Unmarshal(rendered, &rc.Meta)
+	} else {
+		err = yaml.Unmarshal(rendered, &rc)
+	}
+	if err != nil {
+		return rendered, nil
+	}
+	context.AllInstances = rc.Meta.AllInstances()
+	if again, err := executeHeader(opts, partials, path, data, header, context); err == nil {
+		return again, nil
+	}
+	return rendered, nil
+}
+
+// executeHeader renders the given template with the given context and
+// returns the resulting header. If that fails, only the given header
+// is rendered.
+func executeHeader(opts Options, partials *template.Template, path string, data []byte, header []byte, context ResourceInstanceContext) ([]byte, error) {
+	rendered, err := executeTemplate(opts, partials, path, data, context)
+	if rendered, headerErr := findTemplateHeader(path, rendered); headerErr == nil {
+		if err != nil {
+			opts.Log.WithError(err).Debugf("Ignoring error after the header of %s", path)
+		}
+		return rendered, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("could not find header after rendering")
+	}
+	if header == nil {
+		return nil, err
+	}
+	rendered, headerErr := executeTemplate(opts, partials, path, header, context)
+	if headerErr != nil {
+		return nil, err
+	}
+	return rendered, nil
+}
+
+func executeTemplate(opts Options, partials *template.Template, path string, data []byte, context ResourceInstanceContext) ([]byte, error) {
+	funcs := generateFuncMap(context, partials, opts)
+	tmpl, err := template.New(path).Funcs(funcs).Parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, context)
+	return out.Bytes(), err
+}
+
+// loadPartials optionally loads partial templates from the given
+// "partials" folders. Partials of later folders replace partials of
+// earlier folders with the same name.
+func loadPartials(opts Options, paths ...string) (*template.Template, error) {
+	fs := opts.Fs
+	tmpl := template.New("PARTIALS")
+	funcs := generateFuncMap(ResourceInstanceContext{Params: []Param{}}, tmpl, opts)
+	tmpl.Funcs(funcs)
+	files, err := partialFiles(fs, paths...)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return tmpl, nil
+	}
+	// Every partial is available under its filename and, as long as
+	// that is unambiguous, also under its name without extension.
+	aliases := make(map[string]string)
+	for _, filename := range files {
+		fn := filepath.Base(filename)
+		alias := strings.TrimSuffix(fn, filepath.Ext(fn))
+		if alias == fn {
+			continue
+		}
+		if other, exists := aliases[alias]; exists && other != fn {
+			return nil, fmt.Errorf("partial name %s is ambiguous: %s and %s", alias, other, fn)
+		}
+		aliases[alias] = fn
+	}
+	partialNames := make(map[string]struct{}, len(files))
+	for _, filename := range files {
+		partialNames[filepath.Base(filename)] = struct{}{}
+	}
+	// Blocks defined within a partial using {{ define }} are available
+	// under their own name. To keep lookups unambiguous, a block may
+	// neither share its name with a partial nor be defined by two
+	// different partials.
+	blocks := make(map[string]string)
+	var data []byte
+	var standalone *template.Template
+	for _, filename := range files {
+		fn := filepath.Base(filename)
+		if other, exists := aliases[fn]; exists {
+			return nil, fmt.Errorf("partial name %s is ambiguous: %s and %s", fn, other, fn)
+		}
+		data, err = afero.ReadFile(fs, filename)
+		if err != nil {
+			return nil, err
+		}
+		standalone, err = template.New(fn).Funcs(funcs).Parse(string(data))
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range standalone.Templates() {
+			name := block.Name()
+			if name == fn {
+				continue
+			}
+			if _, exists := partialNames[name]; exists {
+				return nil, fmt.Errorf("block %s defined in partial %s is ambiguous: a partial has the same name", name, fn)
+			}
+			if other, exists := aliases[name]; exists {
+				return nil, fmt.Errorf("block %s defined in partial %s is ambiguous: partial %s has the same name", name, fn, other)
+			}
+			if other, exists := blocks[name]; exists && other != fn {
+				return nil, fmt.Errorf("block %s is defined in both partials %s and %s", name, other, fn)
+			}
+			blocks[name] = fn
+		}
+		_, err = tmpl.New(fn).Parse(string(data))
+		if err != nil {
+			return nil, err
+		}
+		if alias := strings.TrimSuffix(fn, filepath.Ext(fn)); alias != fn {
+			_, err = tmpl.New(alias).Parse(string(data))
+		}
+	}
+	return tmpl, err
+}
+
+// partialFiles returns the files within the given partials folders in
+// the order they are loaded.
+func partialFiles(fs afero.Fs, paths ...string) ([]string, error) {
+	files := make([]string, 0, 10)
+	for _, path := range paths {
+		matches, err := afero.Glob(fs, filepath.Join(path, "*"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
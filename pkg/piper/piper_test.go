@@ -0,0 +1,1438 @@
+package piper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type testInfo struct {
+	Title       string   `yaml:"title"`
+	Details     string   `yaml:"details"`
+	ExpectError bool     `yaml:"expectError"`
+	Result      Pipeline `yaml:"result"`
+}
+
+func loadTestInfo(path string) (*testInfo, error) {
+	var info testInfo
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func TestFindHeader(t *testing.T) {
+	tests := []struct {
+		input    string
+		header   []byte
+		hasError bool
+		message  string
+	}{
+		{
+			input:    `nothing`,
+			header:   nil,
+			hasError: true,
+			message:  `If no data: section can be found then an error should be returned.`,
+		},
+		{
+			input:    "something\ndata:\nbody",
+			header:   []byte(`something`),
+			hasError: false,
+			message:  `The header section should have been found.`,
+		},
+	}
+	for _, test := range tests {
+		header, err := findHeader([]byte(test.input))
+		if string(header) != string(test.header) || (err != nil && !test.hasError) || (err == nil && test.hasError) {
+			t.Logf("Found header: %s", header)
+			t.Logf("Error: %v", err)
+			t.Fatal(test.message)
+		}
+	}
+}
+
+func TestSplitDocuments(t *testing.T) {
+	data := []byte(`meta:
+  name: notes
+data:
+  text: |
+    first
+    ---
+    second
+  steps:
+  - >-
+    ---
+
+    folded
+---
+meta:
+  name: other
+data:
+  text: |-
+    ---
+`)
+	documents := splitDocuments(data)
+	require.Len(t, documents, 2)
+	var first ResourceConfig
+	require.NoError(t, yaml.Unmarshal(documents[0], &first))
+	require.Equal(t, "first\n---\nsecond\n", first.Data["text"])
+	require.Equal(t, []interface{}{"---\nfolded"}, first.Data["steps"])
+	var second ResourceConfig
+	require.NoError(t, yaml.Unmarshal(documents[1], &second))
+	require.Equal(t, "---", second.Data["text"])
+}
+
+func TestBuildPipeline(t *testing.T) {
+	tests := []struct {
+		name           string
+		fillFS         func(afero.Fs)
+		expectedResult *Pipeline
+		expectedError  bool
+	}{
+		{
+			name: "empty",
+			fillFS: func(fs afero.Fs) {
+				fs.Mkdir("/", 0700)
+				fs.Mkdir("/jobs", 0700)
+				fs.Mkdir("/resources", 0700)
+				fs.Mkdir("/resource_types", 0700)
+			},
+			expectedResult: &Pipeline{
+				Groups:        []Resource{},
+				Resources:     []Resource{},
+				ResourceTypes: []Resource{},
+				Jobs:          []Resource{},
+			},
+			expectedError: false,
+		}, {
+			name: "simple",
+			fillFS: func(fs afero.Fs) {
+				fs.Mkdir("/", 0700)
+				fs.Mkdir("/jobs", 0700)
+				afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n"), 0600)
+			},
+			expectedResult: &Pipeline{
+				Groups:        []Resource{},
+				Resources:     []Resource{},
+				ResourceTypes: []Resource{},
+				Jobs: []Resource{
+					{"name": "build"},
+				},
+			},
+			expectedError: false,
+		}, {
+			name: "simple-with-yaml",
+			fillFS: func(fs afero.Fs) {
+				fs.Mkdir("/", 0700)
+				fs.Mkdir("/jobs", 0700)
+				afero.WriteFile(fs, "/jobs/build.yaml", []byte("meta:\n  name: build\ndata:\n"), 0600)
+			},
+			expectedResult: &Pipeline{
+				Groups:        []Resource{},
+				Resources:     []Resource{},
+				ResourceTypes: []Resource{},
+				Jobs: []Resource{
+					{"name": "build"},
+				},
+			},
+			expectedError: false,
+		}, {
+			name: "simple-with-tmpl",
+			fillFS: func(fs afero.Fs) {
+				fs.Mkdir("/", 0700)
+				fs.Mkdir("/jobs", 0700)
+				afero.WriteFile(fs, "/jobs/build.yml.tmpl", []byte("meta:\n  name: build\ndata:\n"), 0600)
+				afero.WriteFile(fs, "/jobs/test.yaml.tmpl", []byte("meta:\n  name: test\ndata:\n"), 0600)
+				afero.WriteFile(fs, "/jobs/README.md", []byte("Not a template"), 0600)
+			},
+			expectedResult: &Pipeline{
+				Groups:        []Resource{},
+				Resources:     []Resource{},
+				ResourceTypes: []Resource{},
+				Jobs: []Resource{
+					{"name": "build"},
+					{"name": "test"},
+				},
+			},
+			expectedError: false,
+		}, {
+			name: "multiple-documents",
+			fillFS: func(fs afero.Fs) {
+				fs.Mkdir("/", 0700)
+				fs.Mkdir("/resources", 0700)
+				afero.WriteFile(fs, "/resources/git.yml", []byte(`---
+meta:
+  name: source
+data:
+  type: git
+---
+meta:
+  name_template: image-{{ .Instance }}
+  instances:
+  - a
+data:
+  type: docker-image
+`), 0600)
+			},
+			expectedResult: &Pipeline{
+				Groups: []Resource{},
+				Resources: []Resource{
+					{"name": "source", "type": "git"},
+					{"name": "image-a", "type": "docker-image"},
+				},
+				ResourceTypes: []Resource{},
+				Jobs:          []Resource{},
+			},
+			expectedError: false,
+		}, {
+			name: "anchors",
+			fillFS: func(fs afero.Fs) {
+				fs.Mkdir("/", 0700)
+				fs.Mkdir("/jobs", 0700)
+				afero.WriteFile(fs, "/jobs/build.yml", []byte(`meta:
+  name_template: build-{{ .Instance }}
+  instances:
+  - a
+data:
+  plan:
+  - get: source
+    params: &params
+      depth: 1
+      branch: {{ .Instance }}
+  - get: tools
+    params: *params
+  - get: docs
+    params:
+      <<: *params
+      depth: 5
+`), 0600)
+			},
+			expectedResult: &Pipeline{
+				Groups:        []Resource{},
+				Resources:     []Resource{},
+				ResourceTypes: []Resource{},
+				Jobs: []Resource{
+					{"name": "build-a", "plan": []interface{}{
+						map[interface{}]interface{}{"get": "source", "params": map[interface{}]interface{}{"depth": 1, "branch": "a"}},
+						map[interface{}]interface{}{"get": "tools", "params": map[interface{}]interface{}{"depth": 1, "branch": "a"}},
+						map[interface{}]interface{}{"get": "docs", "params": map[interface{}]interface{}{"depth": 5, "branch": "a"}},
+					}},
+				},
+			},
+			expectedError: false,
+		}, {
+			name: "conditional-instances",
+			fillFS: func(fs afero.Fs) {
+				fs.Mkdir("/", 0700)
+				fs.Mkdir("/jobs", 0700)
+				afero.WriteFile(fs, "/jobs/deploy.yml", []byte(`meta:
+  name_template: deploy-{{ .Instance }}
+  instances:
+  - a
+  - b
+  params:
+    a:
+    - name: enabled
+      value: "true"
+data:
+  {{- if getParam "enabled" "" }}
+  serial: true
+  {{- end }}
+`), 0600)
+			},
+			expectedResult: &Pipeline{
+				Groups:        []Resource{},
+				Resources:     []Resource{},
+				ResourceTypes: []Resource{},
+				Jobs: []Resource{
+					{"name": "deploy-a", "serial": true},
+				},
+			},
+			expectedError: false,
+		}, {
+			name: "partials",
+			fillFS: func(fs afero.Fs) {
+				fs.Mkdir("/", 0700)
+				fs.Mkdir("/jobs", 0700)
+				fs.Mkdir("/partials", 0700)
+				afero.WriteFile(fs, "/partials/job-def.yml", []byte("file: some-other-file-{{ getParam \"param\" \"<nil>\" }}.yml"), 0600)
+				afero.WriteFile(fs, "/jobs/build.yml", []byte(`meta:
+  name_template: build-{{ .Instance }}
+  instances:
+  - a
+  - b
+  params:
+    a:
+    - name: param
+      value: a
+    b:
+    - name: param
+      value: b
+data:
+  {{ partial "job-def.yml" 0 . }}`), 0600)
+			},
+			expectedResult: &Pipeline{
+				Groups:        []Resource{},
+				Resources:     []Resource{},
+				ResourceTypes: []Resource{},
+				Jobs: []Resource{
+					{
+						"name": "build-a",
+						"file": "some-other-file-a.yml",
+					},
+					{
+						"name": "build-b",
+						"file": "some-other-file-b.yml",
+					},
+				},
+			},
+			expectedError: false,
+		},
+	}
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	for _, testcase := range tests {
+		t.Run(testcase.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			testcase.fillFS(fs)
+			result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+			if testcase.expectedError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				// Origins are covered by TestOrigins.
+				result.Origins = nil
+				result.originIndex = nil
+				require.Equal(t, testcase.expectedResult, result)
+			}
+		})
+	}
+}
+
+func TestNestedPartials(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/inner.txt", []byte("data:\n  value: INNER"), 0600)
+	afero.WriteFile(fs, "/outer.txt", []byte("{{ partial \"inner.txt\" 0 . }}"), 0600)
+	tmpls, err := loadPartials(Options{Fs: fs}, "/")
+	require.NoError(t, err)
+	require.NotNil(t, tmpls)
+	out := &ResourceConfig{}
+	logger := logrus.New()
+	err = generateInstance(out, "some-instance", "some-path", []byte(`{{ partial "outer.txt" 4 . }}`), ResourceConfigHeader{}, tmpls, Options{Pipeline: "active-pipeline", Log: logger})
+	require.NoError(t, err)
+	require.Equal(t, out.Data["value"], "INNER")
+}
+
+func TestRecursivePartials(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/a.txt", []byte(`{{ partial "b.txt" 0 . }}`), 0600)
+	afero.WriteFile(fs, "/b.txt", []byte(`{{ partial "a.txt" 0 . }}`), 0600)
+	tmpls, err := loadPartials(Options{Fs: fs}, "/")
+	require.NoError(t, err)
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	out := &ResourceConfig{}
+	err = generateInstance(out, "some-instance", "some-path", []byte(`{{ partial "a.txt" 0 . }}`), ResourceConfigHeader{}, tmpls, Options{Log: logger})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "partial a.txt includes itself: a.txt -> b.txt -> a.txt")
+
+	// Including the same partial multiple times without a cycle is fine.
+	afero.WriteFile(fs, "/value.txt", []byte(`INNER`), 0600)
+	afero.WriteFile(fs, "/twice.txt", []byte("data:\n  a: {{ partial \"value.txt\" 0 . }}\n  b: {{ partial \"value.txt\" 0 . }}"), 0600)
+	tmpls, err = loadPartials(Options{Fs: fs}, "/")
+	require.NoError(t, err)
+	out = &ResourceConfig{}
+	err = generateInstance(out, "some-instance", "some-path", []byte(`{{ partial "twice.txt" 0 . }}`), ResourceConfigHeader{}, tmpls, Options{Log: logger})
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"a": "INNER", "b": "INNER"}, out.Data)
+}
+
+func TestPartialsWithArgs(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/inner.txt", []byte("data:\n  value: {{ index .Args \"value\" }}"), 0600)
+	afero.WriteFile(fs, "/outer.txt", []byte("{{ partial \"inner.txt\" 0 . \"value\" \"INNER\" }}"), 0600)
+	tmpls, err := loadPartials(Options{Fs: fs}, "/")
+	require.NoError(t, err)
+	require.NotNil(t, tmpls)
+	out := &ResourceConfig{}
+	logger := logrus.New()
+	err = generateInstance(out, "some-instance", "some-path", []byte(`{{ partial "outer.txt" 4 . }}`), ResourceConfigHeader{}, tmpls, Options{Pipeline: "active-pipeline", Log: logger})
+	require.NoError(t, err)
+}
+
+func TestCustomFuncs(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	funcs := map[string]interface{}{
+		"vaultPath": func(name string) string {
+			return "secret/" + name
+		},
+		"ite": func(condition bool, trueValue interface{}, falseValue interface{}) interface{} {
+			return "overridden"
+		},
+	}
+	newFS := func() afero.Fs {
+		fs := afero.NewMemMapFs()
+		afero.WriteFile(fs, "/partials/source.yml", []byte(`path: {{ vaultPath "from-partial" }}`), 0600)
+		afero.WriteFile(fs, "/jobs/build.yml", []byte(`meta:
+  name: build
+data:
+  secret: {{ vaultPath "build" }}
+  mode: {{ ite true "builtin" "other" }}
+  {{ partial "source.yml" 2 . }}`), 0600)
+		return fs
+	}
+
+	t.Run("builtins-win", func(t *testing.T) {
+		result, err := Build(ctx, Options{Fs: newFS(), Folders: []string{"/"}, Log: log, Funcs: funcs})
+		require.NoError(t, err)
+		require.Len(t, result.Jobs, 1)
+		require.Equal(t, "secret/build", result.Jobs[0]["secret"])
+		require.Equal(t, "builtin", result.Jobs[0]["mode"])
+		require.Equal(t, "secret/from-partial", result.Jobs[0]["path"])
+	})
+
+	t.Run("override", func(t *testing.T) {
+		result, err := Build(ctx, Options{Fs: newFS(), Folders: []string{"/"}, Log: log, Funcs: funcs, OverrideFuncs: true})
+		require.NoError(t, err)
+		require.Len(t, result.Jobs, 1)
+		require.Equal(t, "overridden", result.Jobs[0]["mode"])
+	})
+}
+
+func TestTemplateErrorsReferenceSourcePath(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	tmpls, err := loadPartials(Options{Fs: fs}, "/")
+	require.NoError(t, err)
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	out := &ResourceConfig{}
+	err = generateInstance(out, "some-instance", "jobs/build.yml", []byte("meta:\n  name: build\ndata:\n  value: {{ foo }}"), ResourceConfigHeader{}, tmpls, Options{Log: logger})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `jobs/build.yml:4: function "foo" not defined`)
+
+	err = generateInstance(out, "some-instance", "jobs/build.yml", []byte("meta:\n  name: build\ndata:\n  value: {{ index .Args 1 }}"), ResourceConfigHeader{}, tmpls, Options{Log: logger})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "jobs/build.yml:4:")
+}
+
+func TestMaxFileSize(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n"), 0600)
+	afero.WriteFile(fs, "/jobs/huge.yml", []byte("meta:\n  name: huge\ndata:\n  value: "+strings.Repeat("x", 1024)), 0600)
+
+	_, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log, MaxFileSize: 512})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "huge.yml exceeds the maximum file size")
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	require.Len(t, result.Jobs, 2)
+}
+
+// flakyFs fails opening files until failures is used up.
+type flakyFs struct {
+	afero.Fs
+	failures int
+}
+
+func (f *flakyFs) Open(name string) (afero.File, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("input/output error")
+	}
+	return f.Fs.Open(name)
+}
+
+func TestReadRetries(t *testing.T) {
+	defer func(delay time.Duration) { readRetryDelay = delay }(readRetryDelay)
+	readRetryDelay = 0
+	log := logrus.New()
+	log.SetLevel(logrus.FatalLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n"), 0600)
+
+	_, err := readTemplateFile(Options{Fs: &flakyFs{Fs: fs, failures: 1}, Log: log}, "/jobs/build.yml")
+	require.Error(t, err, "Without retries the first failure is final")
+
+	data, err := readTemplateFile(Options{Fs: &flakyFs{Fs: fs, failures: 2}, ReadRetries: 2, Log: log}, "/jobs/build.yml")
+	require.NoError(t, err)
+	require.Contains(t, string(data), "name: build")
+
+	_, err = readTemplateFile(Options{Fs: &flakyFs{Fs: fs, failures: 3}, ReadRetries: 2, Log: log}, "/jobs/build.yml")
+	require.Error(t, err)
+
+	readRetryDelay = time.Hour
+	_, err = readTemplateFile(Options{Fs: fs, ReadRetries: 2, Log: log}, "/jobs/missing.yml")
+	require.True(t, os.IsNotExist(err), "Missing files are not retried")
+}
+
+func TestMaxInstances(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.FatalLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/matrix.yml", []byte("meta:\n  name_template: job-{{ .Instance }}\n  instances: [a, b, c]\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/resources/source.yml", []byte("meta:\n  name: source\ndata:\n  type: git"), 0600)
+
+	_, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, MaxInstances: 4, Log: log})
+	require.NoError(t, err)
+
+	_, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, MaxInstances: 2, Log: log})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "/jobs/matrix.yml: header failed: 3 instances exceed the maximum of 2")
+
+	_, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, MaxInstances: 3, Log: log})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "the pipeline consists of 4 entries exceeding the maximum of 3")
+}
+
+func TestIsTemplateFile(t *testing.T) {
+	tests := []struct {
+		path   string
+		result bool
+	}{
+		{path: "/jobs/build.yml", result: true},
+		{path: "/jobs/build.yaml", result: true},
+		{path: "/jobs/build.yml.tmpl", result: true},
+		{path: "/jobs/build.yaml.tmpl", result: true},
+		{path: "/jobs/build.json", result: true},
+		{path: "/jobs/build.tmpl", result: false},
+		{path: "/jobs/build.yml.bak", result: false},
+		{path: "/jobs", result: false},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.result, isTemplateFile(test.path), test.path)
+	}
+}
+
+func TestMultipleFolders(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/base/partials/source.yml", []byte("uri: base"), 0600)
+	afero.WriteFile(fs, "/base/resources/source.yml", []byte("meta:\n  name: source\ndata:\n  {{ partial \"source.yml\" 2 . }}"), 0600)
+	afero.WriteFile(fs, "/base/resources/shared.yml", []byte("meta:\n  name: shared\ndata:\n  {{ partial \"team.yml\" 2 . }}"), 0600)
+	afero.WriteFile(fs, "/base/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n  origin: base"), 0600)
+	afero.WriteFile(fs, "/team/partials/team.yml", []byte("uri: team"), 0600)
+	afero.WriteFile(fs, "/team/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n  origin: team"), 0600)
+	afero.WriteFile(fs, "/team/jobs/test.yml", []byte("meta:\n  name: test\ndata:\n  origin: team"), 0600)
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/base", "/team"}, Log: log})
+	require.NoError(t, err)
+	require.Equal(t, []Resource{
+		{"name": "build", "origin": "team"},
+		{"name": "test", "origin": "team"},
+	}, result.Jobs)
+	require.Equal(t, []Resource{
+		{"name": "shared", "uri": "team"},
+		{"name": "source", "uri": "base"},
+	}, result.Resources)
+}
+
+func TestRenderedTemplateLogging(t *testing.T) {
+	ctx := context.Background()
+	var out bytes.Buffer
+	log := logrus.New()
+	log.Out = &out
+	log.SetLevel(logrus.DebugLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name_template: \"build-{{ .Instance }}\"\n  instances:\n    - a\ndata:\n  plan: [{get: source-{{ .Instance }}}]"), 0600)
+
+	_, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "path=/jobs/build.yml")
+	require.Contains(t, out.String(), "instance=a")
+	require.Contains(t, out.String(), "get: source-a")
+}
+
+// captureHook records all log entries.
+type captureHook struct {
+	mu      sync.Mutex
+	entries []*logrus.Entry
+}
+
+func (h *captureHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *captureHook) Fire(entry *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, entry)
+	return nil
+}
+
+func TestHeaderVars(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.FatalLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/deploy.yml", []byte(`meta:
+  name_template: deploy-{{ .Instance }}
+  instances: [{{ .Vars.regions }}]
+  pipelines: [{{ .Vars.pipeline }}]
+data:
+  serial: {{ eq .Instance .Vars.primary }}`), 0600)
+	vars := map[string]string{"regions": "eu, us", "pipeline": "deploy", "primary": "eu"}
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Pipeline: "deploy", Vars: vars, Log: log})
+	require.NoError(t, err)
+	require.Equal(t, []Resource{
+		{"name": "deploy-eu", "serial": true},
+		{"name": "deploy-us", "serial": false},
+	}, result.Jobs)
+
+	result, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Vars: vars, Log: log})
+	require.NoError(t, err)
+	require.Empty(t, result.Jobs, "The pipelines of the header are rendered as well")
+
+	afero.WriteFile(fs, "/jobs/deploy.yml", []byte("meta:\n  name: {{ .Unknown }}\ndata:\n  serial: true"), 0600)
+	_, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.Error(t, err)
+	var genErr *GenerationError
+	require.True(t, errors.As(err, &genErr))
+	require.Equal(t, PhaseHeader, genErr.Phase)
+}
+
+func TestRenderHeader(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.FatalLevel)
+	build := func(path string, data string) (*Pipeline, error) {
+		fs := afero.NewMemMapFs()
+		afero.WriteFile(fs, "/partials/regions.yml", []byte("{{ .Args.regions }}"), 0600)
+		afero.WriteFile(fs, path, []byte(data), 0600)
+		return Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Pipeline: "deploy", Vars: map[string]string{"regions": "eu, us", "json_regions": `"eu", "us"`, "pipeline": "deploy"}, Log: log})
+	}
+
+	t.Run("partials", func(t *testing.T) {
+		result, err := build("/jobs/deploy.yml", `meta:
+  name_template: deploy-{{ .Instance }}
+  instances: [{{ partial "regions" 0 . "regions" .Vars.regions }}]
+  pipelines: [deploy]
+data:
+  serial: true`)
+		require.NoError(t, err)
+		require.Equal(t, []Resource{{"name": "deploy-eu", "serial": true}, {"name": "deploy-us", "serial": true}}, result.Jobs)
+	})
+
+	t.Run("blocks spanning the data section", func(t *testing.T) {
+		result, err := build("/jobs/deploy.yml", `meta:
+  name: deploy
+{{- if .Vars.regions }}
+  pipelines: [deploy]
+data:
+  serial: true
+{{- else }}
+data:
+  serial: false
+{{- end }}`)
+		require.NoError(t, err)
+		require.Equal(t, []Resource{{"name": "deploy", "serial": true}}, result.Jobs)
+	})
+
+	t.Run("functions and context", func(t *testing.T) {
+		result, err := build("/jobs/deploy.yml", `meta:
+  name_template: deploy-{{ .Instance }}
+  instances: [{{ param "regions" }}]
+  pipelines: [{{ if eq (len .AllInstances) 2 }}{{ .Vars.pipeline }}{{ end }}]
+data:
+  serial: true`)
+		require.NoError(t, err)
+		require.Len(t, result.Jobs, 2)
+	})
+
+	t.Run("errors within the data section", func(t *testing.T) {
+		_, err := build("/jobs/deploy.yml", `meta:
+  name: deploy
+  pipelines: [{{ .Vars.pipeline }}]
+data:
+  serial: {{ .Unknown }}`)
+		var genErr *GenerationError
+		require.True(t, errors.As(err, &genErr))
+		require.Equal(t, PhaseRender, genErr.Phase, "The data section is only reported when rendering the instance")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		result, err := build("/jobs/deploy.json", `{
+  "meta": {"name_template": "deploy-{{ .Instance }}", "instances": [{{ partial "regions" 0 . "regions" .Vars.json_regions }}], "pipelines": ["{{ .Vars.pipeline }}"]},
+  "data": {"serial": true}
+}`)
+		require.NoError(t, err)
+		require.Equal(t, []Resource{{"name": "deploy-eu", "serial": true}, {"name": "deploy-us", "serial": true}}, result.Jobs)
+	})
+
+	t.Run("headers depending on the instance", func(t *testing.T) {
+		result, err := build("/jobs/deploy.yml", `meta:
+  name_template: '{{ .Instance }}-{{ param "region" }}-{{ paramsOf .Instance "region" }}'
+  instances: [a, b]
+  pipelines: [deploy]
+  params:
+    a:
+    - name: region
+      value: eu
+    b:
+    - name: region
+      value: us
+data:
+  serial: true`)
+		require.NoError(t, err)
+		require.Equal(t, []Resource{{"name": "a-eu-eu", "serial": true}, {"name": "b-us-us", "serial": true}}, result.Jobs)
+	})
+
+	t.Run("headers failing to render", func(t *testing.T) {
+		result, err := build("/jobs/deploy.yml", `meta:
+  name_template: '{{ .Instance }}-{{ param "region" }}-{{ .Vars.pipeline }}'
+  instances: [a]
+  pipelines: [deploy]
+  params:
+    a:
+    - name: region
+      value: eu
+data:
+  serial: true`)
+		require.NoError(t, err, "The raw header is used instead")
+		require.Equal(t, []Resource{{"name": "a-eu-deploy", "serial": true}}, result.Jobs)
+	})
+
+	t.Run("headers not referring to vars", func(t *testing.T) {
+		data := []byte("meta:\n  name_template: deploy-{{ .Instance }}\ndata:\n  serial: {{ broken")
+		header, err := renderHeader(Options{Log: log}, template.New("partials"), "/jobs/deploy.yml", data)
+		require.NoError(t, err)
+		require.Equal(t, "meta:\n  name_template: deploy-{{ .Instance }}", string(header))
+	})
+}
+
+func TestPrintContext(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	log.SetLevel(logrus.DebugLevel)
+	hook := &captureHook{}
+	log.Hooks.Add(hook)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name_template: \"build-{{ .Instance }}\"\n  instances:\n    - a\n  params:\n    a:\n    - name: branch\n      value: main\n      section: git\ndata:\n  serial: true"), 0600)
+	contexts := func() []*logrus.Entry {
+		var result []*logrus.Entry
+		for _, entry := range hook.entries {
+			if strings.HasPrefix(entry.Message, "Context:") {
+				result = append(result, entry)
+			}
+		}
+		return result
+	}
+
+	_, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	require.Empty(t, contexts())
+
+	_, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, PrintContext: true, Log: log})
+	require.NoError(t, err)
+	entries := contexts()
+	require.Len(t, entries, 1)
+	require.Equal(t, "a", entries[0].Data["instance"])
+	require.Contains(t, entries[0].Message, "Instance: a\n")
+	require.Contains(t, entries[0].Message, "- name: branch\n  value: main\n  section: git\n")
+}
+
+func TestJSONTemplates(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	yamlFs := afero.NewMemMapFs()
+	afero.WriteFile(yamlFs, "/resources/source.yml", []byte("meta:\n  name_template: \"source-{{ .Instance }}\"\n  instances:\n    - a\n    - b\ndata:\n  type: git\n  source:\n    branch: {{ .Instance }}\n    depth: 1"), 0600)
+	jsonFs := afero.NewMemMapFs()
+	afero.WriteFile(jsonFs, "/resources/source.json", []byte(`{
+  "meta": {"name_template": "source-{{ .Instance }}", "instances": ["a", "b"]},
+  "data": {
+    "type": "git",
+    "source": {"branch": "{{ .Instance }}", "depth": 1}
+  }
+}`), 0600)
+
+	expected, err := Build(ctx, Options{Fs: yamlFs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	result, err := Build(ctx, Options{Fs: jsonFs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	require.Len(t, result.Resources, 2)
+	require.Equal(t, expected.Resources, result.Resources)
+
+	afero.WriteFile(jsonFs, "/resources/broken.json", []byte(`{"data": {}}`), 0600)
+	_, err = Build(ctx, Options{Fs: jsonFs, Folders: []string{"/"}, Log: log})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "could not find header")
+}
+
+func TestVarSources(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n  serial: true"), 0600)
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	require.Nil(t, result.VarSources)
+	out, err := Marshal(result, MarshalOptions{})
+	require.NoError(t, err)
+	require.NotContains(t, string(out), "var_sources")
+
+	afero.WriteFile(fs, "/var_sources/vault.yml", []byte(`meta:
+  name_template: vault-{{ .Instance }}
+  instances: [dev, prod]
+data:
+  type: vault
+  config:
+    url: https://vault.{{ .Instance }}.example.com`), 0600)
+	result, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	require.Equal(t, []Resource{
+		{"name": "vault-dev", "type": "vault", "config": map[interface{}]interface{}{"url": "https://vault.dev.example.com"}},
+		{"name": "vault-prod", "type": "vault", "config": map[interface{}]interface{}{"url": "https://vault.prod.example.com"}},
+	}, result.VarSources)
+	origin, ok := result.Origin("var_sources", "vault-prod")
+	require.True(t, ok)
+	require.Equal(t, "/var_sources/vault.yml", origin.Path)
+	require.NoError(t, ValidateKeys(result))
+	out, err = Marshal(result, MarshalOptions{OmitEmpty: true})
+	require.NoError(t, err)
+	require.Equal(t, `jobs:
+- name: build
+  serial: true
+var_sources:
+- config:
+    url: https://vault.dev.example.com
+  name: vault-dev
+  type: vault
+- config:
+    url: https://vault.prod.example.com
+  name: vault-prod
+  type: vault
+`, string(out))
+}
+
+func TestEnvOverrides(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/resources/source.yml", []byte("meta:\n  name: source\ndata:\n  type: git"), 0600)
+	afero.WriteFile(fs, "/resources/nested/image.yml", []byte("meta:\n  name: image\ndata:\n  type: docker-image"), 0600)
+	afero.WriteFile(fs, "/resources.prod/nested/image.yml", []byte("meta:\n  name: image\ndata:\n  type: registry-image"), 0600)
+	afero.WriteFile(fs, "/resources.prod/alerts.yml", []byte("meta:\n  name: alerts\ndata:\n  type: slack"), 0600)
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	require.Equal(t, []Resource{
+		{"name": "image", "type": "docker-image"},
+		{"name": "source", "type": "git"},
+	}, result.Resources)
+
+	result, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Env: "prod", Log: log})
+	require.NoError(t, err)
+	require.Equal(t, []Resource{
+		{"name": "alerts", "type": "slack"},
+		{"name": "image", "type": "registry-image"},
+		{"name": "source", "type": "git"},
+	}, result.Resources)
+	origin, _ := result.Origin("resources", "image")
+	require.Equal(t, "/resources.prod/nested/image.yml", origin.Path)
+
+	afero.WriteFile(fs, "/resources/nested-image.yml", []byte("meta:\n  name: nested-image\ndata:\n  type: mock"), 0600)
+	files, err := templateFiles(Options{Fs: fs, Log: log}, "/resources")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/resources/nested/image.yml", "/resources/nested-image.yml", "/resources/source.yml"}, files)
+}
+
+func TestSingletonNameUsesPipeline(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/deploy.yml", []byte(`meta:
+  name: deploy-{{ .Pipeline }}
+  pipelines:
+  - prod
+  - staging
+data:
+  serial: true`), 0600)
+
+	for _, pipeline := range []string{"prod", "staging"} {
+		result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Pipeline: pipeline, Log: log})
+		require.NoError(t, err)
+		require.Equal(t, []Resource{{"name": "deploy-" + pipeline, "serial": true}}, result.Jobs)
+	}
+}
+
+func TestTeams(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/core.yml", []byte("meta:\n  name: core\n  teams: [core]\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/jobs/web.yml", []byte("meta:\n  name: web\n  teams: [web]\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/jobs/shared.yml", []byte("meta:\n  name: shared\ndata:\n  serial: true"), 0600)
+
+	names := func(team string) []string {
+		result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Team: team, Log: log})
+		require.NoError(t, err)
+		names := make([]string, 0, len(result.Jobs))
+		for _, job := range result.Jobs {
+			names = append(names, job.String())
+		}
+		return names
+	}
+	require.ElementsMatch(t, []string{"core", "web", "shared"}, names(""))
+	require.ElementsMatch(t, []string{"core", "shared"}, names("core"))
+	require.ElementsMatch(t, []string{"web", "shared"}, names("web"))
+	require.ElementsMatch(t, []string{"shared"}, names("ops"))
+}
+
+func TestAllInstances(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/test.yml", []byte(`meta:
+  name_template: test-{{ .Instance }}
+  instances:
+  - a
+  - b
+data:
+  plan:
+  - get: source
+    passed:
+    {{- range .AllInstances }}
+    {{- if ne . $.Instance }}
+    - test-{{ . }}
+    {{- end }}
+    {{- end }}`), 0600)
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	require.Len(t, result.Jobs, 2)
+	require.Equal(t, []PlanStep{{Kind: "get", Name: "source", Resource: "source", Passed: []string{"test-b"}}}, ScanPlan(result.Jobs[0]))
+	require.Equal(t, []PlanStep{{Kind: "get", Name: "source", Resource: "source", Passed: []string{"test-a"}}}, ScanPlan(result.Jobs[1]))
+}
+
+func TestParamsOf(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.FatalLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/test.yml", []byte(`meta:
+  name_template: test-{{ .Instance }}
+  instances:
+  - a
+  - b
+  - name: all
+  params:
+    a:
+    - name: branch
+      value: main
+    b:
+    - name: branch
+      value: develop
+data:
+  {{- if eq .Instance "all" }}
+  plan:
+  - get: a
+    params: {branch: {{ paramsOf "a" "branch" }}}
+  - get: b
+    params: {branch: {{ paramsOf "b" "branch" }}}
+  {{- end }}`), 0600)
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	require.Len(t, result.Jobs, 1, "Only the fan-in instance has a data section")
+	require.Equal(t, []interface{}{
+		map[interface{}]interface{}{"get": "a", "params": map[interface{}]interface{}{"branch": "main"}},
+		map[interface{}]interface{}{"get": "b", "params": map[interface{}]interface{}{"branch": "develop"}},
+	}, result.Jobs[0]["plan"])
+
+	afero.WriteFile(fs, "/jobs/test.yml", []byte("meta:\n  name: test\ndata:\n  value: {{ paramsOf \"unknown\" \"branch\" }}"), 0600)
+	_, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown instance unknown")
+
+	afero.WriteFile(fs, "/jobs/test.yml", []byte("meta:\n  name: test\ndata:\n  value: {{ paramsOf \"test\" \"branch\" }}"), 0600)
+	_, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "instance test has no param branch")
+}
+
+func TestBase(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/base.yml", []byte(`resources:
+- name: source
+  type: git
+- name: vendor
+  type: s3
+jobs:
+- name: build
+  plan: []
+- name: vendor-job
+  plan: []
+`), 0600)
+	afero.WriteFile(fs, "/templates/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/templates/jobs/deploy.yml", []byte("meta:\n  name: deploy\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/templates/resources/source.yml", []byte("meta:\n  name: source\ndata:\n  type: mock"), 0600)
+
+	base, err := LoadPipeline(fs, "/base.yml")
+	require.NoError(t, err)
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/templates"}, Base: base, Log: log})
+	require.NoError(t, err)
+	require.Equal(t, []Resource{
+		{"name": "source", "type": "mock"},
+		{"name": "vendor", "type": "s3"},
+	}, result.Resources)
+	require.Equal(t, []Resource{
+		{"name": "build", "serial": true},
+		{"name": "vendor-job", "plan": []interface{}{}},
+		{"name": "deploy", "serial": true},
+	}, result.Jobs)
+	require.Len(t, base.Jobs, 2)
+	require.Equal(t, []interface{}{}, base.Jobs[0]["plan"], "The base pipeline must not be modified")
+
+	_, err = LoadPipeline(fs, "/missing.yml")
+	require.Error(t, err)
+}
+
+func TestPartialsWithoutExtension(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/job-def.yml", []byte("data:\n  value: INNER"), 0600)
+	tmpls, err := loadPartials(Options{Fs: fs}, "/")
+	require.NoError(t, err)
+	logger := logrus.New()
+	for _, name := range []string{"job-def", "job-def.yml"} {
+		out := &ResourceConfig{}
+		err = generateInstance(out, "some-instance", "some-path", []byte(`{{ partial "`+name+`" 0 . }}`), ResourceConfigHeader{}, tmpls, Options{Log: logger})
+		require.NoError(t, err)
+		require.Equal(t, "INNER", out.Data["value"])
+	}
+}
+
+func TestAmbiguousPartialNames(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/job-def.yml", []byte("value: a"), 0600)
+	afero.WriteFile(fs, "/job-def.yaml", []byte("value: b"), 0600)
+	_, err := loadPartials(Options{Fs: fs}, "/")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "job-def is ambiguous")
+
+	fs = afero.NewMemMapFs()
+	afero.WriteFile(fs, "/job-def", []byte("value: a"), 0600)
+	afero.WriteFile(fs, "/job-def.yml", []byte("value: b"), 0600)
+	_, err = loadPartials(Options{Fs: fs}, "/")
+	require.Error(t, err)
+}
+
+func TestPartialBlocks(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/steps.yml", []byte(`{{ define "get-source" }}get: {{ .Args.name }}{{ end }}
+{{- define "run-tests" }}task: test-{{ .Instance }}{{ end }}`), 0600)
+	tmpls, err := loadPartials(Options{Fs: fs}, "/")
+	require.NoError(t, err)
+	out := &ResourceConfig{}
+	err = generateInstance(out, "unit", "some-path", []byte(`data:
+  plan:
+  - {{ partial "get-source" 0 . "name" "source" }}
+  - {{ partial "run-tests" 0 . }}`), ResourceConfigHeader{}, tmpls, Options{Log: logrus.New()})
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{
+		map[interface{}]interface{}{"get": "source"},
+		map[interface{}]interface{}{"task": "test-unit"},
+	}, out.Data["plan"])
+
+	for name, partials := range map[string]map[string]string{
+		"a partial has the same name":          {"/steps.yml": `{{ define "source.yml" }}{{ end }}`, "/source.yml": "a"},
+		"partial source.yml has the same name": {"/steps.yml": `{{ define "source" }}x{{ end }}`, "/source.yml": "a"},
+		"defined in both partials":             {"/a.yml": `{{ define "step" }}a{{ end }}`, "/b.yml": `{{ define "step" }}b{{ end }}`},
+	} {
+		fs = afero.NewMemMapFs()
+		for path, content := range partials {
+			afero.WriteFile(fs, path, []byte(content), 0600)
+		}
+		_, err = loadPartials(Options{Fs: fs}, "/")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), name)
+	}
+}
+
+func TestRender(t *testing.T) {
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/partials/source.yml", []byte("uri: {{ .Instance }}"), 0600)
+	resources, err := Render(Options{Fs: fs, Folders: []string{"/"}, Pipeline: "prod", Log: log}, "<stdin>", []byte(`meta:
+  name_template: source-{{ .Instance }}
+  instances:
+  - a
+  - b
+  pipelines:
+  - prod
+data:
+  {{ partial "source" 2 . }}`))
+	require.NoError(t, err)
+	require.Equal(t, []Resource{
+		{"name": "source-a", "uri": "a"},
+		{"name": "source-b", "uri": "b"},
+	}, resources)
+
+	resources, err = Render(Options{Fs: fs, Folders: []string{"/"}, Pipeline: "staging", Log: log}, "<stdin>", []byte("meta:\n  name: build\n  pipelines: [prod]\ndata:\n"))
+	require.NoError(t, err)
+	require.Empty(t, resources)
+}
+
+func TestGenerationError(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.FatalLevel)
+	tests := []struct {
+		name     string
+		content  string
+		instance string
+		phase    Phase
+	}{
+		{name: "header", content: "meta: [\ndata:\n", phase: PhaseHeader},
+		{name: "parse", content: "meta:\n  name: build\ndata:\n  {{ unknown }}", instance: "build", phase: PhaseParse},
+		{name: "render", content: "meta:\n  name_template: build-{{ .Instance }}\n  instances: [a]\ndata:\n  {{ index .Args 1 }}", instance: "a", phase: PhaseRender},
+		{name: "unmarshal", content: "meta:\n  name: build\ndata:\n  - [", instance: "build", phase: PhaseUnmarshal},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			afero.WriteFile(fs, "/jobs/build.yml", []byte(test.content), 0600)
+			_, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+			require.Error(t, err)
+			var genErr *GenerationError
+			require.True(t, errors.As(err, &genErr), "%v should contain a GenerationError", err)
+			require.Equal(t, "/jobs/build.yml", genErr.Path)
+			require.Equal(t, test.instance, genErr.Instance)
+			require.Equal(t, test.phase, genErr.Phase)
+			require.NotNil(t, errors.Unwrap(genErr))
+		})
+	}
+}
+
+func TestOrigins(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/build.yml", []byte(`meta:
+  name_template: build-{{ .Instance }}
+  description: Builds {{ .Instance }}
+  instances: [a, b]
+data:
+`), 0600)
+	afero.WriteFile(fs, "/resources/source.yml", []byte("meta:\n  name: source\ndata:\n"), 0600)
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	require.Len(t, result.Origins, 3)
+	origin, ok := result.Origin("jobs", "build-b")
+	require.True(t, ok)
+	require.Equal(t, "/jobs/build.yml", origin.Path)
+	require.Equal(t, "b", origin.Instance)
+	require.Equal(t, "Builds b", origin.Meta.Description)
+	origin, ok = result.Origin("resources", "source")
+	require.True(t, ok)
+	require.Equal(t, "/resources/source.yml", origin.Path)
+	require.Equal(t, "", origin.Meta.Description)
+	_, ok = result.Origin("resources", "build-a")
+	require.False(t, ok)
+
+	// The last origin of a name wins with and without an index.
+	p := &Pipeline{Origins: []Origin{
+		{Category: "jobs", Name: "build", Path: "/a.yml"},
+		{Category: "jobs", Name: "build", Path: "/b.yml"},
+	}}
+	origin, ok = p.Origin("jobs", "build")
+	require.True(t, ok)
+	require.Equal(t, "/b.yml", origin.Path)
+	p.IndexOrigins()
+	origin, ok = p.Origin("jobs", "build")
+	require.True(t, ok)
+	require.Equal(t, "/b.yml", origin.Path)
+	p.Origins[1].Name = "test"
+	p.IndexOrigins()
+	origin, ok = p.Origin("jobs", "build")
+	require.True(t, ok)
+	require.Equal(t, "/a.yml", origin.Path)
+}
+
+func TestCategoryErrorIsolation(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.FatalLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n"), 0600)
+	afero.WriteFile(fs, "/resources/source.yml", []byte("meta:\n  name: source\ndata:\n"), 0600)
+	afero.WriteFile(fs, "/groups/broken.yml", []byte("meta:\n  name: broken\ndata:\n  {{ broken }}"), 0600)
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to load groups")
+	require.Equal(t, []Resource{{"name": "build"}}, result.Jobs)
+	require.Equal(t, []Resource{{"name": "source"}}, result.Resources)
+
+	afero.WriteFile(fs, "/resource_types/broken.yml", []byte("meta:\n  name: broken\ndata:\n  {{ broken }}"), 0600)
+	result, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.Error(t, err)
+	errs, ok := err.(Errors)
+	require.True(t, ok)
+	require.Len(t, errs, 2)
+	require.Contains(t, errs[0].Error(), "failed to load groups")
+	require.Contains(t, errs[1].Error(), "failed to load resource_types")
+	require.Equal(t, []Resource{{"name": "build"}}, result.Jobs)
+
+	_, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log, FailFast: true})
+	require.Error(t, err)
+	_, ok = err.(Errors)
+	require.False(t, ok, "fail-fast mode should only report the first error")
+}
+
+func TestSortResourceTypes(t *testing.T) {
+	log := logrus.New()
+	log.SetLevel(logrus.FatalLevel)
+	p := &Pipeline{
+		ResourceTypes: []Resource{{"name": "a"}, {"name": "b"}, {"name": "c"}, {"name": "d"}},
+		Origins: []Origin{
+			{Category: "resource_types", Name: "a", Meta: ResourceMeta{Requires: []string{"c"}}},
+			{Category: "resource_types", Name: "c", Meta: ResourceMeta{Requires: []string{"d", "unknown"}}},
+		},
+	}
+	require.NoError(t, sortResourceTypes(log, p))
+	require.Equal(t, []Resource{{"name": "d"}, {"name": "c"}, {"name": "a"}, {"name": "b"}}, p.ResourceTypes)
+
+	p.Origins = append(p.Origins, Origin{Category: "resource_types", Name: "d", Meta: ResourceMeta{Requires: []string{"a"}}})
+	err := sortResourceTypes(log, p)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "d -> a -> c -> d")
+}
+
+func TestWorldGroup(t *testing.T) {
+	p := &Pipeline{
+		Jobs:          []Resource{{"name": "build"}, {"name": "trigger-nightly"}},
+		Resources:     []Resource{{"name": "source"}, {"name": "nightly"}},
+		ResourceTypes: []Resource{{"name": "slack"}},
+	}
+	group, err := generateWorldGroup(Options{WorldGroupName: "WORLD"}, p)
+	require.NoError(t, err)
+	require.Equal(t, Resource{
+		"name":      "WORLD",
+		"jobs":      []string{"build", "trigger-nightly"},
+		"resources": []string{"source", "nightly"},
+	}, group)
+	group, err = generateWorldGroup(Options{
+		WorldGroupName:          "ALL",
+		WorldGroupResourceTypes: true,
+		WorldGroupExclude:       []string{"trigger-nightly", "nightly"},
+	}, p)
+	require.NoError(t, err)
+	require.Equal(t, Resource{
+		"name":           "ALL",
+		"jobs":           []string{"build"},
+		"resources":      []string{"source"},
+		"resource_types": []string{"slack"},
+	}, group)
+}
+
+func TestGroupPerPipeline(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\n  pipelines: [staging, prod]\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/jobs/deploy.yml", []byte("meta:\n  name: deploy\n  pipelines: [prod]\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/jobs/smoke.yml", []byte("meta:\n  name: smoke\n  pipelines: [staging]\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/jobs/local.yml", []byte("meta:\n  name: local\ndata:\n  serial: true"), 0600)
+	afero.WriteFile(fs, "/resources/source.yml", []byte("meta:\n  name: source\n  pipelines: [\"*\"]\ndata:\n  type: git"), 0600)
+	afero.WriteFile(fs, "/resources/prod.yml", []byte("meta:\n  name: prod\n  pipelines: [prod]\ndata:\n  type: git"), 0600)
+	opts := Options{Fs: fs, Folders: []string{"/"}, GroupPerPipeline: true, WorldGroupExclude: []string{"build"}, Log: log}
+
+	opts.Pipeline = "prod"
+	result, err := Build(ctx, opts)
+	require.NoError(t, err)
+	require.Equal(t, []Resource{
+		{"name": "prod", "jobs": []string{"deploy"}, "resources": []string{"prod", "source"}},
+	}, result.Groups, "Only the selected pipeline gets a group")
+
+	opts.Pipeline = ""
+	result, err = Build(ctx, opts)
+	require.NoError(t, err)
+	require.Equal(t, []Resource{
+		{"name": DefaultPipelineGroupName, "jobs": []string{"local"}, "resources": []string{"source"}},
+	}, result.Groups)
+}
+
+func TestMetaGroups(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/compile.yml", []byte("meta:\n  name: compile\n  groups: [build]\ndata:\n  plan: []"), 0600)
+	afero.WriteFile(fs, "/jobs/test.yml", []byte("meta:\n  name: test\n  groups: [build]\ndata:\n  plan: []"), 0600)
+	afero.WriteFile(fs, "/jobs/deploy.yml", []byte("meta:\n  name_template: deploy-{{ .Instance }}\n  instances: [staging, prod]\n  groups: [deploy]\ndata:\n  plan: []"), 0600)
+	afero.WriteFile(fs, "/jobs/cleanup.yml", []byte("meta:\n  name: cleanup\ndata:\n  plan: []"), 0600)
+	afero.WriteFile(fs, "/resources/source.yml", []byte("meta:\n  name: source\n  groups: [build, deploy]\ndata:\n  type: git"), 0600)
+	afero.WriteFile(fs, "/resource_types/cf.yml", []byte("meta:\n  name: cf\n  groups: [deploy]\ndata:\n  type: registry-image"), 0600)
+
+	p, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, WorldGroup: true, Log: log})
+	require.NoError(t, err)
+	require.Len(t, p.Groups, 3)
+	require.Equal(t, "WORLD", p.Groups[0]["name"])
+	require.Equal(t, []Resource{
+		{"name": "build", "jobs": []string{"compile", "test"}, "resources": []string{"source"}},
+		{"name": "deploy", "jobs": []string{"deploy-staging", "deploy-prod"}, "resources": []string{"source"}, "resource_types": []string{"cf"}},
+	}, p.Groups[1:])
+}
+
+func TestImageRegistry(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/resource_types/slack.yml", []byte(`meta:
+  name: slack
+data:
+  type: registry-image
+  source:
+    repository: cfcommunity/slack-notification-resource
+    tag: v1.5.0`), 0600)
+	afero.WriteFile(fs, "/resource_types/mirrored.yml", []byte(`meta:
+  name: mirrored
+data:
+  type: registry-image
+  source:
+    repository: registry.example.org/concourse/git-resource`), 0600)
+	afero.WriteFile(fs, "/resource_types/local.yml", []byte(`meta:
+  name: local
+data:
+  type: mock`), 0600)
+
+	result, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, ImageRegistry: "registry.example.org/", Log: log})
+	require.NoError(t, err)
+	repositories := make(map[string]interface{})
+	for _, r := range result.ResourceTypes {
+		source, ok := r["source"].(map[interface{}]interface{})
+		if !ok {
+			repositories[r.String()] = nil
+			continue
+		}
+		repositories[r.String()] = source["repository"]
+		if r.String() == "slack" {
+			require.Equal(t, "v1.5.0", source["tag"])
+		}
+	}
+	require.Equal(t, map[string]interface{}{
+		"slack":    "registry.example.org/cfcommunity/slack-notification-resource",
+		"mirrored": "registry.example.org/concourse/git-resource",
+		"local":    nil,
+	}, repositories)
+}
+
+func TestWorldGroupWithNonStringName(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.FatalLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n  name: 42"), 0600)
+	require.NotPanics(t, func() {
+		_, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log, WorldGroup: true})
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "/jobs/build.yml")
+	})
+
+	_, err := generateWorldGroup(Options{}, &Pipeline{Resources: []Resource{{"type": "git"}}})
+	require.Error(t, err)
+}
+
+func TestSequential(t *testing.T) {
+	ctx := context.Background()
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/groups/all.yml", []byte("meta:\n  name: all\ndata:\n  jobs: [build]"), 0600)
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n  plan: [{get: source}]"), 0600)
+	afero.WriteFile(fs, "/resources/source.yml", []byte("meta:\n  name: source\ndata:\n  type: git"), 0600)
+	afero.WriteFile(fs, "/resource_types/cf.yml", []byte("meta:\n  name: cf\ndata:\n  type: registry-image"), 0600)
+	afero.WriteFile(fs, "/var_sources/vault.yml", []byte("meta:\n  name: vault\ndata:\n  type: vault"), 0600)
+
+	log := logrus.New()
+	log.Out = &bytes.Buffer{}
+	concurrent, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+
+	hook := &captureHook{}
+	log.Hooks.Add(hook)
+	sequential, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Sequential: true, Log: log})
+	require.NoError(t, err)
+	require.Equal(t, concurrent, sequential)
+
+	var processed []string
+	for _, entry := range hook.entries {
+		if strings.HasPrefix(entry.Message, "Processing ") {
+			processed = append(processed, strings.TrimPrefix(entry.Message, "Processing "))
+		}
+	}
+	require.Equal(t, []string{"/resource_types/cf.yml", "/resources/source.yml", "/jobs/build.yml", "/groups/all.yml", "/var_sources/vault.yml"}, processed)
+
+	afero.WriteFile(fs, "/resources/broken.yml", []byte("meta:\n  name: broken\ndata:\n  type: {{ broken }}"), 0600)
+	hook.entries = nil
+	_, err = Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Sequential: true, FailFast: true, Log: log})
+	require.Error(t, err)
+	for _, entry := range hook.entries {
+		require.NotEqual(t, "Processing /jobs/build.yml", entry.Message, "no category must be loaded after a failing one")
+	}
+}
+
+func TestAbstractTemplates(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/jobs/base.yml", []byte("meta:\n  abstract: true\n  pipelines: [typo]\ndata:\n  serial: true\n  plan: [{get: source}]"), 0600)
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\ndata:\n  {{- renderResource \"jobs/base.yml\" | toYaml | nindent 2 }}"), 0600)
+	afero.WriteFile(fs, "/resources/source.yml", []byte("meta:\n  name: source\ndata:\n  type: git"), 0600)
+
+	p, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Log: log})
+	require.NoError(t, err)
+	require.Len(t, p.Jobs, 1)
+	require.Equal(t, "build", p.Jobs[0].String())
+	require.Equal(t, true, p.Jobs[0]["serial"])
+
+	counts, err := CountInstances(Options{Fs: fs, Folders: []string{"/"}})
+	require.NoError(t, err)
+	require.Len(t, counts, 1, "pipelines of abstract templates should not be counted")
+	require.Equal(t, 1, counts[0].Counts["jobs"])
+
+	orphans, err := FindOrphans(Options{Fs: fs, Folders: []string{"/"}})
+	require.NoError(t, err)
+	require.Empty(t, orphans)
+}
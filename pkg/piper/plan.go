@@ -0,0 +1,129 @@
+package piper
+
+// PlanStep is a get or put step found within a job's plan.
+type PlanStep struct {
+	// Kind is either "get" or "put".
+	Kind string
+	// Name is the name of the step as it appears in the plan.
+	Name string
+	// Resource is the name of the resource the step operates on.
+	// This is the same as Name unless the step sets `resource`.
+	Resource string
+	// Passed lists the jobs a get step is constrained by.
+	Passed []string
+}
+
+// nestedStepKeys are the keys of a step that may contain further
+// steps.
+var nestedStepKeys = []string{"do", "in_parallel", "aggregate", "try", "on_success", "on_failure", "on_abort", "on_error", "ensure", "steps"}
+
+// ScanPlan returns all get and put steps of the given job's plan
+// in the order they appear in, including steps nested inside of
+// do, in_parallel, try, hooks, etc.
+func ScanPlan(job Resource) []PlanStep {
+	steps := make([]PlanStep, 0, 5)
+	visitSteps(job["plan"], func(s step) {
+		for _, kind := range []string{"get", "put"} {
+			name, ok := s.get(kind).(string)
+			if !ok {
+				continue
+			}
+			planStep := PlanStep{Kind: kind, Name: name, Resource: name}
+			if resource, ok := s.get("resource").(string); ok {
+				planStep.Resource = resource
+			}
+			planStep.Passed = stringList(s.get("passed"))
+			steps = append(steps, planStep)
+		}
+	})
+	return steps
+}
+
+// step provides access to a single step of a plan independent of the
+// kind of map it has been decoded into.
+type step struct {
+	m  map[string]interface{}
+	im map[interface{}]interface{}
+}
+
+func (s step) get(key string) interface{} {
+	if s.m != nil {
+		return s.m[key]
+	}
+	return s.im[key]
+}
+
+func (s step) set(key string, value interface{}) {
+	if s.m != nil {
+		s.m[key] = value
+		return
+	}
+	s.im[key] = value
+}
+
+func (s step) delete(key string) {
+	if s.m != nil {
+		delete(s.m, key)
+		return
+	}
+	delete(s.im, key)
+}
+
+// visitSteps calls fn for every step within node followed by the
+// steps nested inside of it.
+func visitSteps(node interface{}, fn func(s step)) {
+	var s step
+	switch n := node.(type) {
+	case []interface{}:
+		for _, item := range n {
+			visitSteps(item, fn)
+		}
+		return
+	case []Resource:
+		for _, item := range n {
+			visitSteps(map[string]interface{}(item), fn)
+		}
+		return
+	case Resource:
+		s = step{m: n}
+	case map[string]interface{}:
+		s = step{m: n}
+	case map[interface{}]interface{}:
+		s = step{im: n}
+	default:
+		return
+	}
+	fn(s)
+	for _, key := range nestedStepKeys {
+		if nested := s.get(key); nested != nil {
+			visitSteps(nested, fn)
+		}
+	}
+}
+
+// stringMap converts a map as produced by the YAML decoder into one
+// with string keys. Non-string keys are dropped.
+func stringMap(m map[interface{}]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		if key, ok := k.(string); ok {
+			result[key] = v
+		}
+	}
+	return result
+}
+
+func stringList(value interface{}) []string {
+	var result []string
+	switch v := value.(type) {
+	case []string:
+		result = append(result, v...)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,86 @@
+package piper
+
+// jobHookKeys are the keys of a job that may contain steps outside of
+// its plan.
+var jobHookKeys = []string{"on_success", "on_failure", "on_abort", "on_error", "ensure"}
+
+// applyNamePrefix prepends prefix to the name of every group, resource
+// type, resource, and job of the pipeline. References between them
+// are rewritten accordingly: the resources of get and put steps, the
+// jobs of passed constraints, the jobs and resources of groups, and
+// the type of resources and resource types if it is one of the
+// pipeline's resource types. The names of get and put steps are kept
+// so that tasks can still refer to them as inputs.
+func applyNamePrefix(p *Pipeline, prefix string) {
+	resourceTypes := nameSet(p.ResourceTypes)
+	prefixName := func(r Resource) {
+		if name, ok := r["name"].(string); ok {
+			r["name"] = prefix + name
+		}
+	}
+	prefixList := func(value interface{}) interface{} {
+		names := stringList(value)
+		if names == nil {
+			return value
+		}
+		result := make([]interface{}, 0, len(names))
+		for _, name := range names {
+			result = append(result, prefix+name)
+		}
+		return result
+	}
+	prefixType := func(r Resource) {
+		if t, ok := r["type"].(string); ok {
+			if _, custom := resourceTypes[t]; custom {
+				r["type"] = prefix + t
+			}
+		}
+	}
+
+	for _, r := range p.ResourceTypes {
+		prefixName(r)
+		prefixType(r)
+	}
+	for _, r := range p.Resources {
+		prefixName(r)
+		prefixType(r)
+	}
+	for _, r := range p.Groups {
+		prefixName(r)
+		for _, key := range []string{"jobs", "resources", "resource_types"} {
+			if value, ok := r[key]; ok {
+				r[key] = prefixList(value)
+			}
+		}
+	}
+	rewriteStep := func(s step) {
+		for _, kind := range []string{"get", "put"} {
+			name, ok := s.get(kind).(string)
+			if !ok {
+				continue
+			}
+			if resource, ok := s.get("resource").(string); ok {
+				name = resource
+			}
+			s.set("resource", prefix+name)
+			if passed := s.get("passed"); passed != nil {
+				s.set("passed", prefixList(passed))
+			}
+		}
+	}
+	for _, job := range p.Jobs {
+		prefixName(job)
+		visitSteps(job["plan"], rewriteStep)
+		for _, key := range jobHookKeys {
+			visitSteps(job[key], rewriteStep)
+		}
+	}
+	for i := range p.Origins {
+		// Var sources keep their names as they aren't prefixed.
+		if p.Origins[i].Category == "var_sources" {
+			continue
+		}
+		p.Origins[i].Name = prefix + p.Origins[i].Name
+	}
+	p.IndexOrigins()
+}
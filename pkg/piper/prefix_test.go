@@ -0,0 +1,77 @@
+package piper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestApplyNamePrefix(t *testing.T) {
+	var p Pipeline
+	require.NoError(t, yaml.Unmarshal([]byte(`
+groups:
+- name: all
+  jobs: [build, deploy]
+  resources: [source]
+resource_types:
+- name: slack
+  type: registry-image
+resources:
+- name: source
+  type: git
+- name: notify
+  type: slack
+jobs:
+- name: build
+  plan:
+  - get: source
+  - get: code
+    resource: source
+- name: deploy
+  plan:
+  - in_parallel:
+    - get: source
+      passed: [build]
+  on_failure:
+    put: notify
+`), &p))
+	p.Origins = []Origin{{Category: "jobs", Name: "build"}, {Category: "var_sources", Name: "vault"}}
+	applyNamePrefix(&p, "dev-")
+	require.NoError(t, Validate(&p))
+
+	var expected Pipeline
+	require.NoError(t, yaml.Unmarshal([]byte(`
+groups:
+- name: dev-all
+  jobs: [dev-build, dev-deploy]
+  resources: [dev-source]
+resource_types:
+- name: dev-slack
+  type: registry-image
+resources:
+- name: dev-source
+  type: git
+- name: dev-notify
+  type: dev-slack
+jobs:
+- name: dev-build
+  plan:
+  - get: source
+    resource: dev-source
+  - get: code
+    resource: dev-source
+- name: dev-deploy
+  plan:
+  - in_parallel:
+    - get: source
+      resource: dev-source
+      passed: [dev-build]
+  on_failure:
+    put: notify
+    resource: dev-notify
+`), &expected))
+	expected.Origins = []Origin{{Category: "jobs", Name: "dev-build"}, {Category: "var_sources", Name: "vault"}}
+	expected.IndexOrigins()
+	require.Equal(t, expected, p)
+}
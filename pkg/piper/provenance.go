@@ -0,0 +1,36 @@
+package piper
+
+// ProvenanceRecord describes which template an entry of the generated
+// pipeline originates from.
+type ProvenanceRecord struct {
+	Name       string `json:"name"`
+	Category   string `json:"category"`
+	SourceFile string `json:"sourceFile"`
+	Instance   string `json:"instance"`
+	Pipeline   string `json:"pipeline"`
+}
+
+// Provenance returns a record for every entry of the pipeline that was
+// generated from a template, in the order of the generated output.
+// Entries without a template, like the world group or entries of a
+// base pipeline, are left out.
+func Provenance(p *Pipeline) []ProvenanceRecord {
+	records := make([]ProvenanceRecord, 0, len(p.Origins))
+	for _, category := range []string{"groups", "resource_types", "resources", "jobs", "var_sources"} {
+		resources, _ := p.category(category)
+		for _, r := range resources {
+			origin, ok := p.Origin(category, r.String())
+			if !ok {
+				continue
+			}
+			records = append(records, ProvenanceRecord{
+				Name:       origin.Name,
+				Category:   category,
+				SourceFile: origin.Path,
+				Instance:   origin.Instance,
+				Pipeline:   origin.Pipeline,
+			})
+		}
+	}
+	return records
+}
@@ -0,0 +1,27 @@
+package piper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvenance(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/resources/source.yml", []byte("meta:\n  name_template: source-{{ .Instance }}\n  instances: [a, b]\n  pipelines: [prod]\ndata:\n  type: git"), 0600)
+	afero.WriteFile(fs, "/jobs/build.yml", []byte("meta:\n  name: build\n  pipelines: [prod]\ndata:\n  plan: [{get: source-a}]"), 0600)
+
+	p, err := Build(ctx, Options{Fs: fs, Folders: []string{"/"}, Pipeline: "prod", WorldGroup: true, Log: log})
+	require.NoError(t, err)
+	require.Equal(t, []ProvenanceRecord{
+		{Name: "source-a", Category: "resources", SourceFile: "/resources/source.yml", Instance: "a", Pipeline: "prod"},
+		{Name: "source-b", Category: "resources", SourceFile: "/resources/source.yml", Instance: "b", Pipeline: "prod"},
+		{Name: "build", Category: "jobs", SourceFile: "/jobs/build.yml", Instance: "build", Pipeline: "prod"},
+	}, Provenance(p))
+}
@@ -0,0 +1,88 @@
+package piper
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// renderResource renders the single-instance template found at path
+// within the last of opts.Folders containing it and returns its data
+// section. from is the template asking for it, which is used to
+// detect templates rendering themselves.
+func renderResource(opts Options, partials *template.Template, from string, path string) (map[string]interface{}, error) {
+	file, err := findInFolders(opts, path)
+	if err != nil {
+		return nil, fmt.Errorf("renderResource: %w", err)
+	}
+	chain := append(append([]string{}, opts.rendering...), documentPath(from))
+	for idx, active := range chain {
+		if active == file {
+			chain = append(chain[idx:], file)
+			return nil, fmt.Errorf("renderResource: %s renders itself: %s", path, strings.Join(chain, " -> "))
+		}
+	}
+	if opts.inputs != nil {
+		*opts.inputs = append(*opts.inputs, escapeGlob(file))
+	}
+	data, err := loadTemplateFile(opts, file)
+	if err != nil {
+		return nil, fmt.Errorf("renderResource: %w", err)
+	}
+	if !isJSONFile(file) && len(splitDocuments(data)) > 1 {
+		return nil, fmt.Errorf("renderResource: %s contains more than one template", path)
+	}
+	// The header is rendered as part of the whole template, which may
+	// render further templates already.
+	opts.rendering = chain
+	var rc ResourceConfigHeader
+	if err := parseTemplateHeader(opts, partials, file, &rc, data); err != nil {
+		return nil, &GenerationError{Path: file, Phase: PhaseHeader, Err: err}
+	}
+	instances := rc.Meta.AllInstances()
+	if len(instances) != 1 {
+		return nil, fmt.Errorf("renderResource: %s has %d instances but only templates with a single instance can be rendered", path, len(instances))
+	}
+	var out ResourceConfig
+	if err := generateInstance(&out, instances[0], file, data, rc, partials, opts); err != nil {
+		return nil, err
+	}
+	if out.Data == nil {
+		return map[string]interface{}{}, nil
+	}
+	return out.Data, nil
+}
+
+// findInFolders resolves path within every folder of opts.Folders and
+// returns the one found in the last of them.
+func findInFolders(opts Options, path string) (string, error) {
+	var tried []string
+	for idx := len(opts.Folders) - 1; idx >= 0; idx-- {
+		file, err := resolvePath(opts.Folders[idx], path)
+		if err != nil {
+			return "", err
+		}
+		if _, err := opts.Fs.Stat(file); err == nil {
+			return file, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		tried = append(tried, file)
+	}
+	return "", fmt.Errorf("%s not found (looked for %s)", path, strings.Join(tried, ", "))
+}
+
+// documentPath strips the "#N" suffix added to the paths of
+// templates within files containing more than one template.
+func documentPath(path string) string {
+	idx := strings.LastIndex(path, "#")
+	if idx == -1 {
+		return path
+	}
+	if _, err := strconv.Atoi(path[idx+1:]); err != nil {
+		return path
+	}
+	return path[:idx]
+}
@@ -0,0 +1,56 @@
+package piper
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderResource(t *testing.T) {
+	ctx := context.Background()
+	log := logrus.New()
+	log.SetLevel(logrus.ErrorLevel)
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "/base/resources/source.yml", []byte("meta:\n  name: source\ndata:\n  type: git\n  source:\n    uri: https://example.org/base.git"), 0600)
+	afero.WriteFile(fs, "/team/resources/source.yml", []byte("meta:\n  name: source\ndata:\n  type: git\n  source:\n    uri: https://example.org/{{ .Pipeline }}.git"), 0600)
+	afero.WriteFile(fs, "/team/jobs/build.yml", []byte(`meta:
+  name: build
+  pipelines: [team]
+data:
+  plan:
+  - get: source
+  - task: test
+    config:
+      image_resource: {{ renderResource "resources/source.yml" | toYaml | nindent 8 }}`), 0600)
+
+	p, err := Build(ctx, Options{Fs: fs, Folders: []string{"/base", "/team"}, Pipeline: "team", Log: log})
+	require.NoError(t, err)
+	config := p.Jobs[0]["plan"].([]interface{})[1].(map[interface{}]interface{})["config"].(map[interface{}]interface{})
+	require.Equal(t, map[interface{}]interface{}{
+		"type":   "git",
+		"source": map[interface{}]interface{}{"uri": "https://example.org/team.git"},
+	}, config["image_resource"])
+
+	render := func(tmpl string) error {
+		_, err := Render(Options{Fs: fs, Folders: []string{"/team"}, Log: log}, "/team/jobs/test.yml", []byte("meta:\n  name: test\ndata:\n  a: {{ "+tmpl+" | toYaml }}"))
+		return err
+	}
+	afero.WriteFile(fs, "/team/jobs/test.yml", []byte("meta:\n  name: test"), 0600)
+	afero.WriteFile(fs, "/team/resources/multi.yml", []byte("meta:\n  name_template: x-{{ .Instance }}\n  instances: [a, b]\ndata:\n  type: git"), 0600)
+	afero.WriteFile(fs, "/team/resources/a.yml", []byte("meta:\n  name: a\ndata:\n  b: {{ renderResource \"resources/b.yml\" | toYaml }}"), 0600)
+	afero.WriteFile(fs, "/team/resources/b.yml", []byte("meta:\n  name: b\ndata:\n  a: {{ renderResource \"resources/a.yml\" | toYaml }}"), 0600)
+	for tmpl, message := range map[string]string{
+		`renderResource "resources/multi.yml"`:          "has 2 instances",
+		`renderResource "resources/a.yml"`:              "/team/resources/a.yml -> /team/resources/b.yml -> /team/resources/a.yml",
+		`renderResource "jobs/test.yml"`:                "renders itself",
+		`renderResource "../base/resources/source.yml"`: "escapes",
+		`renderResource "resources/missing.yml"`:        "not found",
+	} {
+		err := render(tmpl)
+		require.Error(t, err, tmpl)
+		require.Contains(t, err.Error(), message, tmpl)
+	}
+}
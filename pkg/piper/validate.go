@@ -0,0 +1,131 @@
+package piper
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Validate checks the pipeline for problems that would make Concourse
+// reject it: entries sharing a name within a category, steps
+// referencing unknown resources, passed constraints referencing
+// unknown jobs, and groups referencing unknown jobs or resources. All
+// problems found are reported together.
+func Validate(p *Pipeline) error {
+	var errs Errors
+	categories := []struct {
+		name      string
+		resources []Resource
+	}{
+		{"resource_types", p.ResourceTypes},
+		{"resources", p.Resources},
+		{"jobs", p.Jobs},
+		{"groups", p.Groups},
+		{"var_sources", p.VarSources},
+	}
+	for _, category := range categories {
+		seen := make(map[string]struct{}, len(category.resources))
+		for _, r := range category.resources {
+			name := r.String()
+			if _, exists := seen[name]; exists {
+				errs = append(errs, fmt.Errorf("%s: %s is defined more than once%s", category.name, name, describeOrigins(p, category.name, name)))
+				continue
+			}
+			seen[name] = struct{}{}
+		}
+	}
+
+	resources := nameSet(p.Resources)
+	jobs := nameSet(p.Jobs)
+	for _, job := range p.Jobs {
+		for _, step := range ScanPlan(job) {
+			if _, exists := resources[step.Resource]; !exists {
+				errs = append(errs, fmt.Errorf("jobs: %s: %s step %s references unknown resource %s", job, step.Kind, step.Name, step.Resource))
+			}
+			for _, passed := range step.Passed {
+				if _, exists := jobs[passed]; !exists {
+					errs = append(errs, fmt.Errorf("jobs: %s: get step %s is constrained by unknown job %s", job, step.Name, passed))
+				}
+			}
+		}
+	}
+	for _, group := range p.Groups {
+		for _, name := range stringList(group["jobs"]) {
+			if _, exists := jobs[name]; !exists {
+				errs = append(errs, fmt.Errorf("groups: %s references unknown job %s", group, name))
+			}
+		}
+		for _, name := range stringList(group["resources"]) {
+			if _, exists := resources[name]; !exists {
+				errs = append(errs, fmt.Errorf("groups: %s references unknown resource %s", group, name))
+			}
+		}
+	}
+	return errs.orNil()
+}
+
+func nameSet(resources []Resource) map[string]struct{} {
+	result := make(map[string]struct{}, len(resources))
+	for _, r := range resources {
+		result[r.String()] = struct{}{}
+	}
+	return result
+}
+
+// describeOrigins lists the paths of all templates that generated the
+// given entry, e.g. " (generated from a.yml, b.yml)".
+func describeOrigins(p *Pipeline, category, name string) string {
+	var paths []string
+	for _, origin := range p.Origins {
+		if origin.Category == category && origin.Name == name {
+			paths = append(paths, origin.Path)
+		}
+	}
+	if len(paths) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (generated from %s)", strings.Join(paths, ", "))
+}
+
+// knownKeys lists the top-level keys Concourse understands for every
+// category.
+var knownKeys = map[string][]string{
+	"jobs": {
+		"name", "old_name", "plan", "serial", "serial_groups", "max_in_flight",
+		"build_log_retention", "build_logs_to_retain", "public",
+		"disable_manual_trigger", "interruptible", "on_success", "on_failure",
+		"on_abort", "on_error", "ensure",
+	},
+	"resources": {
+		"name", "old_name", "type", "source", "version", "icon", "check_every",
+		"check_timeout", "expose_build_created_by", "tags", "public",
+		"webhook_token",
+	},
+	"resource_types": {
+		"name", "type", "source", "privileged", "params", "check_every", "tags",
+		"defaults", "unique_version_history",
+	},
+	"groups":      {"name", "jobs", "resources", "resource_types"},
+	"var_sources": {"name", "type", "config"},
+}
+
+// ValidateKeys checks that every entry of the pipeline only consists
+// of keys Concourse knows for its category. This catches typos like
+// "sources" instead of "source" that Concourse would silently ignore.
+func ValidateKeys(p *Pipeline) error {
+	var errs Errors
+	for _, category := range []string{"resource_types", "resources", "jobs", "groups", "var_sources"} {
+		resources, _ := p.category(category)
+		known := make(map[string]struct{}, len(knownKeys[category]))
+		for _, key := range knownKeys[category] {
+			known[key] = struct{}{}
+		}
+		for _, r := range resources {
+			for key := range r {
+				if _, exists := known[key]; !exists {
+					errs = append(errs, fmt.Errorf("%s: %s has unknown key %s%s", category, r, key, describeOrigins(p, category, r.String())))
+				}
+			}
+		}
+	}
+	return errs.orNil()
+}
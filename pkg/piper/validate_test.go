@@ -0,0 +1,85 @@
+package piper
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestValidate(t *testing.T) {
+	var valid Pipeline
+	require.NoError(t, yaml.Unmarshal([]byte(`
+groups:
+- name: all
+  jobs: [build]
+  resources: [source]
+resources:
+- name: source
+jobs:
+- name: build
+  plan:
+  - get: source
+- name: deploy
+  plan:
+  - get: source
+    passed: [build]
+`), &valid))
+	require.NoError(t, Validate(&valid))
+
+	var invalid Pipeline
+	require.NoError(t, yaml.Unmarshal([]byte(`
+groups:
+- name: all
+  jobs: [build, unknown-job]
+  resources: [unknown-resource]
+resources:
+- name: source
+- name: source
+jobs:
+- name: build
+  plan:
+  - get: source
+  - put: release
+- name: deploy
+  plan:
+  - get: source
+    passed: [test]
+`), &invalid))
+	invalid.Origins = []Origin{
+		{Category: "resources", Name: "source", Path: "a/resources/source.yml"},
+		{Category: "resources", Name: "source", Path: "a/resources/source2.yml"},
+	}
+	err := Validate(&invalid)
+	require.Error(t, err)
+	var errs Errors
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 5)
+	require.Contains(t, err.Error(), "resources: source is defined more than once (generated from a/resources/source.yml, a/resources/source2.yml)")
+	require.Contains(t, err.Error(), "jobs: build: put step release references unknown resource release")
+	require.Contains(t, err.Error(), "jobs: deploy: get step source is constrained by unknown job test")
+	require.Contains(t, err.Error(), "groups: all references unknown job unknown-job")
+	require.Contains(t, err.Error(), "groups: all references unknown resource unknown-resource")
+}
+
+func TestValidateKeys(t *testing.T) {
+	p := &Pipeline{
+		ResourceTypes: []Resource{{"name": "slack", "type": "registry-image", "source": nil}},
+		Resources:     []Resource{{"name": "source", "type": "git", "sources": nil, "icon": "git"}},
+		Jobs:          []Resource{{"name": "build", "plan": nil, "serial": true, "on_sucess": nil}},
+		Groups:        []Resource{{"name": "all", "jobs": nil, "resource_types": nil}},
+		Origins:       []Origin{{Category: "resources", Name: "source", Path: "resources/source.yml"}},
+	}
+	err := ValidateKeys(p)
+	require.Error(t, err)
+	var errs Errors
+	require.True(t, errors.As(err, &errs))
+	require.Len(t, errs, 2)
+	require.Equal(t, "jobs: build has unknown key on_sucess", errs[0].Error())
+	require.Equal(t, "resources: source has unknown key sources (generated from resources/source.yml)", errs[1].Error())
+
+	delete(p.Resources[0], "sources")
+	delete(p.Jobs[0], "on_sucess")
+	require.NoError(t, ValidateKeys(p))
+}
@@ -0,0 +1,39 @@
+package piper
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+var concourseVarPattern = regexp.MustCompile(`\(\(([^()]*)\)\)`)
+
+// ConcourseVar is a ((var)) placeholder found within a rendered
+// pipeline that Concourse would resolve using its credential manager
+// or var sources.
+type ConcourseVar struct {
+	// Name is the placeholder including its parentheses.
+	Name string
+	// Line is the 1-based line the placeholder was found in.
+	Line int
+	// Context is the trimmed content of that line.
+	Context string
+}
+
+// FindConcourseVars returns all ((var)) placeholders within data in
+// the order they appear in.
+func FindConcourseVars(data []byte) []ConcourseVar {
+	var result []ConcourseVar
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		for _, match := range concourseVarPattern.FindAllString(text, -1) {
+			result = append(result, ConcourseVar{Name: match, Line: line, Context: strings.TrimSpace(text)})
+		}
+	}
+	return result
+}
@@ -0,0 +1,23 @@
+package piper
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindConcourseVars(t *testing.T) {
+	data := []byte(`resources:
+- name: source
+  source:
+    uri: ((git-uri))
+    private_key: "((git.key))-((suffix))"
+    branch: (main)
+`)
+	require.Equal(t, []ConcourseVar{
+		{Name: "((git-uri))", Line: 4, Context: "uri: ((git-uri))"},
+		{Name: "((git.key))", Line: 5, Context: `private_key: "((git.key))-((suffix))"`},
+		{Name: "((suffix))", Line: 5, Context: `private_key: "((git.key))-((suffix))"`},
+	}, FindConcourseVars(data))
+	require.Nil(t, FindConcourseVars([]byte("jobs: []\n")))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/zerok/concourse-piper/pkg/piper"
+)
+
+// example is a small set of templates generated by --self-test
+// together with the pipeline expected to be generated from them.
+//
+//go:embed example
+var example embed.FS
+
+const exampleExpected = "example/expected.yaml"
+
+// selfTest generates the pipeline of the embedded example, writes it
+// to w, and compares it to the expected result.
+func selfTest(log *logrus.Logger, w io.Writer) error {
+	mem := afero.NewMemMapFs()
+	err := fs.WalkDir(example, "example", func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || p == exampleExpected {
+			return err
+		}
+		data, err := example.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return afero.WriteFile(mem, path.Join("/", p), data, 0644)
+	})
+	if err != nil {
+		return err
+	}
+	p, err := piper.Build(context.Background(), piper.Options{
+		Fs:         mem,
+		Folders:    []string{"/example"},
+		WorldGroup: true,
+		Log:        log,
+	})
+	if err != nil {
+		return err
+	}
+	out, err := piper.Marshal(p, piper.MarshalOptions{})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(out); err != nil {
+		return err
+	}
+	expected, err := example.ReadFile(exampleExpected)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(out, expected) {
+		return fmt.Errorf("the generated pipeline doesn't match the expected one:\n%s", expected)
+	}
+	return nil
+}
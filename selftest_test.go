@@ -0,0 +1,17 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTest(t *testing.T) {
+	log := logrus.New()
+	log.Out = &bytes.Buffer{}
+	var out bytes.Buffer
+	require.NoError(t, selfTest(log, &out))
+	require.Contains(t, out.String(), "- name: source-web\n  source:\n    branch: develop\n")
+}
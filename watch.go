@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+)
+
+// fileState is what is compared between two polls to detect that a
+// file changed.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// snapshotInputs records the state of every file within the
+// subfolders of the given folders and of the given files. Files
+// directly inside the folders are never templates and therefore
+// skipped, just like folders and files that don't exist and all files
+// and folders listed in ignore.
+func snapshotInputs(fs afero.Fs, folders []string, files []string, ignore []string) (map[string]fileState, error) {
+	ignored := make(map[string]struct{}, len(ignore))
+	for _, path := range ignore {
+		ignored[absPath(path)] = struct{}{}
+	}
+	result := make(map[string]fileState)
+	for _, folder := range folders {
+		err := afero.Walk(fs, folder, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if _, skip := ignored[absPath(path)]; skip {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.IsDir() && filepath.Dir(path) != filepath.Clean(folder) {
+				result[path] = fileState{size: info.Size(), modTime: info.ModTime()}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range files {
+		info, err := fs.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		result[path] = fileState{size: info.Size(), modTime: info.ModTime()}
+	}
+	return result, nil
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+func snapshotsEqual(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, state := range a {
+		other, ok := b[path]
+		if !ok || other.size != state.size || !other.modTime.Equal(state.modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// watchInputs calls regenerate once and then again every time a
+// template within the given folders or one of the given files, like
+// the --base pipeline, changes until stop is closed. Changes are
+// detected by polling every interval; paths listed in ignore, like the
+// generated output, are not watched. After
+// every successful regeneration onChange is called. Failures are
+// logged and don't stop the watching.
+func watchInputs(log *logrus.Logger, fs afero.Fs, folders []string, files []string, ignore []string, interval time.Duration, stop <-chan struct{}, regenerate func() error, onChange func()) error {
+	previous, err := snapshotInputs(fs, folders, files, ignore)
+	if err != nil {
+		return err
+	}
+	run := func() {
+		if err := regenerate(); err != nil {
+			log.WithError(err).Error("Failed to regenerate pipeline")
+			return
+		}
+		onChange()
+	}
+	run()
+	log.Infof("Watching %s for changes", strings.Join(append(append([]string{}, folders...), files...), ", "))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+		current, err := snapshotInputs(fs, folders, files, ignore)
+		if err != nil {
+			log.WithError(err).Error("Failed to check for changes")
+			continue
+		}
+		if snapshotsEqual(previous, current) {
+			continue
+		}
+		previous = current
+		log.Info("Change detected, regenerating pipeline")
+		run()
+	}
+}
+
+// runOnChange executes the given shell command and logs its output.
+// The path the pipeline was written to is available to the command as
+// PIPER_OUTPUT environment variable. A failing command is only logged
+// as warning.
+func runOnChange(log *logrus.Logger, command string, output string) {
+	if command == "" {
+		return
+	}
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), "PIPER_OUTPUT="+output)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	if msg := strings.TrimRight(out.String(), "\n"); msg != "" {
+		log.Infof("Output of --on-change:\n%s", msg)
+	}
+	if err != nil {
+		log.WithError(err).Warn("--on-change command failed")
+	}
+}
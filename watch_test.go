@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchInputs(t *testing.T) {
+	log := logrus.New()
+	log.Out = &bytes.Buffer{}
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "/jobs/build.yml", []byte("a"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/defaults.yml", []byte("a"), 0644))
+
+	regenerated := make(chan struct{}, 10)
+	changed := make(chan struct{}, 10)
+	failing := false
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- watchInputs(log, fs, []string{"/"}, []string{"/defaults.yml", "/base.yml"}, []string{"/out"}, 5*time.Millisecond, stop, func() error {
+			regenerated <- struct{}{}
+			if failing {
+				return errors.New("broken template")
+			}
+			return nil
+		}, func() { changed <- struct{}{} })
+	}()
+	<-regenerated
+	<-changed
+
+	require.NoError(t, afero.WriteFile(fs, "/pipeline.yaml", []byte("ignored"), 0644))
+	require.NoError(t, afero.WriteFile(fs, "/out/jobs.yaml", []byte("ignored"), 0644))
+	time.Sleep(20 * time.Millisecond)
+	require.Len(t, regenerated, 0, "files outside of the template folders must not be watched")
+
+	require.NoError(t, afero.WriteFile(fs, "/defaults.yml", []byte("changed"), 0644))
+	<-regenerated
+	<-changed
+	require.NoError(t, afero.WriteFile(fs, "/base.yml", []byte("created"), 0644))
+	<-regenerated
+	<-changed
+
+	failing = true
+	require.NoError(t, afero.WriteFile(fs, "/jobs/test.yml", []byte("b"), 0644))
+	<-regenerated
+	require.NoError(t, afero.WriteFile(fs, "/jobs/build.yml", []byte("changed"), 0644))
+	<-regenerated
+	close(stop)
+	require.NoError(t, <-done)
+	require.Len(t, changed, 0, "onChange must only be called after successful regenerations")
+}
+
+func TestRunOnChange(t *testing.T) {
+	var out bytes.Buffer
+	log := logrus.New()
+	log.Out = &out
+	runOnChange(log, "echo $PIPER_OUTPUT; exit 1", "pipeline.yaml")
+	require.Contains(t, out.String(), "pipeline.yaml")
+	require.Contains(t, out.String(), "--on-change command failed")
+}